@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// inspectGCode analyzes and validates the G-code at path, produced for job,
+// and records the results on job.
+func (srv *SnuggieServer) inspectGCode(job *slicerjob.Job, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("analyze job:%v err:%v", job.ID, err)
+		return
+	}
+	defer f.Close()
+
+	analyzer := gcode.NewAnalyzer(srv.filament(job.Preset))
+	estimator := gcode.NewEstimator(srv.Printer)
+	indexer := new(gcode.Indexer)
+	var validator *gcode.Validator
+	if srv.Validation != ValidateOff {
+		validator = gcode.NewValidator(srv.limits(job.Preset))
+	}
+	s := gcode.NewScanner(f)
+	for s.Scan() {
+		analyzer.Exec(s.Command())
+		estimator.Exec(s.Command())
+		indexer.Exec(s.Command(), s.Offset())
+		if validator != nil {
+			validator.Exec(s.Command())
+		}
+	}
+	if s.Err() != nil {
+		log.Printf("analyze job:%v err:%v", job.ID, s.Err())
+		return
+	}
+	job.Stats = analyzer.Stats()
+	job.Estimate = estimator.Estimate()
+	if validator != nil {
+		job.Warnings = validator.Issues()
+	}
+	err = PutLayers(job.ID, indexer.Layers(s.End()))
+	if err != nil {
+		log.Printf("layer index job:%v err:%v", job.ID, err)
+	}
+}
+
+// filament returns the filament used by preset.  The filament diameter is
+// read from the preset configuration if it is present.
+func (srv *SnuggieServer) filament(preset string) gcode.Filament {
+	filament := srv.Filament
+	config, err := ReadConfigSlic3r(srv.Slic3rPresets[preset])
+	if err != nil {
+		return filament
+	}
+	d, err := strconv.ParseFloat(config["filament_diameter"], 64)
+	if err == nil && d > 0 {
+		filament.Diameter = d
+	}
+	return filament
+}
+
+func (srv *SnuggieServer) GetGCodeStats(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := srv.lookupJob(id)
+	if err != nil {
+		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if job.Stats == nil {
+		http.Error(w, "no statistics for job", http.StatusNotFound)
+		return
+	}
+	err = json.NewEncoder(w).Encode(job.Stats)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
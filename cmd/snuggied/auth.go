@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// API key scopes.  A key with the admin scope may perform any request.
+const (
+	ScopeSubmit = "submit"
+	ScopeRead   = "read"
+	ScopeCancel = "cancel"
+	ScopeAdmin  = "admin"
+)
+
+var validScopes = map[string]bool{
+	ScopeSubmit: true,
+	ScopeRead:   true,
+	ScopeCancel: true,
+	ScopeAdmin:  true,
+}
+
+// APIKey describes a key used to authenticate requests.  Only a hash of the
+// secret key is stored.
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+// Has returns true if k grants scope.
+func (k *APIKey) Has(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopes parses a comma separated list of scopes.
+func parseScopes(s string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !validScopes[scope] {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scopes given")
+	}
+	return scopes, nil
+}
+
+func hashKey(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateAPIKey stores a new key with the given name and scopes.  The secret
+// key is returned and cannot be recovered later.
+func CreateAPIKey(name string, scopes []string) (secret string, key *APIKey, err error) {
+	p := make([]byte, 24)
+	_, err = rand.Read(p)
+	if err != nil {
+		return "", nil, err
+	}
+	secret = "snug_" + hex.EncodeToString(p)
+	hash := hashKey(secret)
+	key = &APIKey{
+		ID:      hash[:12],
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	err = PutAPIKey(hash, key)
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, key, nil
+}
+
+// requestKey returns the secret key given in the Authorization header, as a
+// bearer token, or in the X-API-Key header.
+func requestKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authenticate returns the key used to make r, which may be the key of its
+// verified client certificate.  If r has no valid key authenticate returns
+// nil.
+func (srv *SnuggieServer) authenticate(r *http.Request) *APIKey {
+	if key := srv.certKey(r); key != nil {
+		return key
+	}
+	secret := requestKey(r)
+	if secret == "" {
+		return nil
+	}
+	key, err := ViewAPIKey(hashKey(secret))
+	if err != nil {
+		log.Printf("auth: %v", err)
+		return nil
+	}
+	return key
+}
+
+// authorize wraps h so that it is only called for requests made with a key
+// granting scope.  If srv.Auth is false every request is allowed.
+func (srv *SnuggieServer) authorize(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !srv.Auth {
+			h(w, r)
+			return
+		}
+		// a signed url grants read access to the resource at its path.
+		if scope == ScopeRead && srv.validSignature(r) {
+			h(w, r)
+			return
+		}
+		key := srv.authenticate(r)
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="snuggied"`)
+			http.Error(w, "a valid api key is required", http.StatusUnauthorized)
+			return
+		}
+		if !key.Has(scope) {
+			http.Error(w, "api key lacks scope: "+scope, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// GetAPIKeys lists the api keys.
+func (srv *SnuggieServer) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys := []*APIKey{}
+	err := ForEachAPIKey(func(hash string, key *APIKey) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(keys)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// CreateAPIKey creates a key with the name and comma separated scopes given in
+// the request form.  The response contains the secret key, which is not
+// stored by the server.
+func (srv *SnuggieServer) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	scopes, err := parseScopes(r.FormValue("scopes"))
+	if err != nil {
+		http.Error(w, "scopes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret, key, err := CreateAPIKey(name, scopes)
+	if err != nil {
+		http.Error(w, "key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("created api key:%v name:%q scopes:%v", key.ID, key.Name, key.Scopes)
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(struct {
+		*APIKey
+		Key string `json:"key"`
+	}{key, secret})
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// DeleteAPIKey revokes the key with the id in the request path.
+func (srv *SnuggieServer) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.trimPath(r.URL.Path, "/admin/keys/")
+	found, err := RevokeAPIKey(id)
+	if err != nil {
+		http.Error(w, "key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "unknown key", http.StatusNotFound)
+		return
+	}
+	log.Printf("revoked api key:%v", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAPIKey deletes the key with the given id.  It returns false if there
+// is no such key.
+func RevokeAPIKey(id string) (bool, error) {
+	var hash string
+	err := ForEachAPIKey(func(h string, key *APIKey) error {
+		if key.ID == id {
+			hash = h
+		}
+		return nil
+	})
+	if err != nil || hash == "" {
+		return false, err
+	}
+	return true, DeleteAPIKey(hash)
+}
+
+// owner returns the owner recorded on jobs created by r.  The owner is empty
+// when authentication is disabled.
+func (srv *SnuggieServer) owner(r *http.Request) string {
+	if !srv.Auth {
+		return ""
+	}
+	key := srv.authenticate(r)
+	if key == nil {
+		return ""
+	}
+	return key.ID
+}
+
+// canAccessJob returns true if the request r may see, download or cancel
+// job.  Only the key that created a job, or an admin key, may access it.
+func (srv *SnuggieServer) canAccessJob(r *http.Request, job *slicerjob.Job) bool {
+	return srv.isOwner(r, job.Owner)
+}
+
+// isOwner returns true if the request r is authenticated by the key owner or
+// by an admin key.
+func (srv *SnuggieServer) isOwner(r *http.Request, owner string) bool {
+	if !srv.Auth {
+		return true
+	}
+	key := srv.authenticate(r)
+	if key == nil {
+		return false
+	}
+	return key.Has(ScopeAdmin) || (owner != "" && owner == key.ID)
+}
+
+// canUseMesh returns true if the request r may create a job from the stored
+// mesh with the given hash.  Without an admin key the mesh must belong to one
+// of the caller's own jobs so that other users' meshes cannot be discovered or
+// sliced by guessing their hash.
+func (srv *SnuggieServer) canUseMesh(r *http.Request, sum string) (bool, error) {
+	if !srv.Auth {
+		return true, nil
+	}
+	key := srv.authenticate(r)
+	if key == nil {
+		return false, nil
+	}
+	if key.Has(ScopeAdmin) {
+		return true, nil
+	}
+	return OwnerHasMesh(key.ID, sum)
+}
+
+// authorizeJob writes an error response and returns false if the request r
+// may not access the job with the given id.  Jobs belonging to other users are
+// reported as unknown so their existence is not revealed.
+func (srv *SnuggieServer) authorizeJob(w http.ResponseWriter, r *http.Request, id string) bool {
+	if !srv.Auth || srv.validSignature(r) {
+		return true
+	}
+	job, err := ViewJob(id)
+	if err != nil || job == nil || !srv.canAccessJob(r, job) {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return false
+	}
+	return true
+}
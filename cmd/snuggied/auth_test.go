@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// testKey creates an api key with the given scopes and returns its secret.
+func testKey(t *testing.T, scopes ...string) (secret string, key *APIKey) {
+	secret, key, err := CreateAPIKey("test", scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, key
+}
+
+// keyRequest returns a request made with the given secret api key.
+func keyRequest(method, url, body, secret string) *http.Request {
+	r := newRequest(method, url, body)
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return r
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes(" read, submit ,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(scopes, ",") != "read,submit" {
+		t.Errorf("scopes: %q", scopes)
+	}
+	for _, s := range []string{"", " , ", "read,write"} {
+		_, err := parseScopes(s)
+		if err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestAuthorizeScopes(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	h := srv.RegisterHandlers(http.NewServeMux())
+	read, _ := testKey(t, ScopeRead)
+	submit, _ := testKey(t, ScopeSubmit)
+	admin, _ := testKey(t, ScopeAdmin)
+	revoked, key := testKey(t, ScopeRead)
+	_, err := RevokeAPIKey(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method, path, secret string
+		code                 int
+	}{
+		{"GET", "/slicer/cache", "", http.StatusUnauthorized},
+		{"GET", "/slicer/cache", "snug_invalid", http.StatusUnauthorized},
+		{"GET", "/slicer/cache", revoked, http.StatusUnauthorized},
+		{"GET", "/slicer/cache", read, http.StatusOK},
+		{"GET", "/slicer/cache", submit, http.StatusForbidden},
+		{"POST", "/slicer/jobs", read, http.StatusForbidden},
+		{"POST", "/slicer/uploads", read, http.StatusForbidden},
+		{"GET", "/slicer/admin/keys", read, http.StatusForbidden},
+		{"GET", "/slicer/admin/keys", submit, http.StatusForbidden},
+		{"GET", "/slicer/admin/keys", admin, http.StatusOK},
+		{"GET", "/slicer/cache", admin, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, keyRequest(test.method, test.path, "", test.secret))
+		if w.Code != test.code {
+			t.Errorf("%s %s with %q: status %d (expected %d)", test.method, test.path, test.secret, w.Code, test.code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s with %q: missing WWW-Authenticate", test.method, test.path, test.secret)
+		}
+	}
+
+	srv.Auth = false
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, keyRequest("GET", "/slicer/admin/keys", "", ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("auth disabled: status %d (expected %d)", w.Code, http.StatusOK)
+	}
+}
+
+func TestJobOwner(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	h := srv.RegisterHandlers(http.NewServeMux())
+	alice, key := testKey(t, ScopeRead, ScopeCancel)
+	bob, _ := testKey(t, ScopeRead, ScopeCancel)
+	admin, _ := testKey(t, ScopeAdmin)
+
+	job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 1)
+	job.Owner = key.ID
+	err := PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := addTestJob(t, srv, slicerjob.Complete, time.Now(), 1)
+
+	for _, test := range []struct {
+		method, path, secret string
+		code                 int
+	}{
+		{"GET", "/slicer/jobs/" + job.ID, alice, http.StatusOK},
+		{"GET", "/slicer/jobs/" + job.ID, admin, http.StatusOK},
+		{"GET", "/slicer/jobs/" + job.ID, bob, http.StatusNotFound},
+		{"GET", "/slicer/gcodes/" + job.ID, bob, http.StatusNotFound},
+		{"DELETE", "/slicer/jobs/" + job.ID, bob, http.StatusNotFound},
+		{"GET", "/slicer/jobs/" + legacy.ID, alice, http.StatusNotFound},
+		{"GET", "/slicer/jobs/" + legacy.ID, admin, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, keyRequest(test.method, test.path, "", test.secret))
+		if w.Code != test.code {
+			t.Errorf("%s %s with %q: status %d (expected %d)", test.method, test.path, test.secret, w.Code, test.code)
+		}
+	}
+
+	for _, test := range []struct {
+		secret string
+		n      int
+	}{
+		{alice, 1},
+		{bob, 0},
+		{admin, 2},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, keyRequest("GET", "/slicer/jobs", "", test.secret))
+		var jobs []*slicerjob.Job
+		err := json.NewDecoder(w.Body).Decode(&jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != test.n {
+			t.Errorf("jobs listed for %q: %d (expected %d)", test.secret, len(jobs), test.n)
+		}
+	}
+}
+
+func TestUploadOwner(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	alice, _ := testKey(t, ScopeSubmit)
+	bob, _ := testKey(t, ScopeSubmit)
+	admin, _ := testKey(t, ScopeAdmin)
+
+	w := httptest.NewRecorder()
+	srv.CreateUpload(w, keyRequest("POST", "/slicer/uploads", "filename=cube.stl&size=4", alice))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d %s", w.Code, w.Body)
+	}
+	upload := new(slicerjob.Upload)
+	err := json.NewDecoder(w.Body).Decode(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/slicer/uploads/" + upload.ID
+
+	w = httptest.NewRecorder()
+	r := keyRequest("PUT", path, "soli", bob)
+	r.Header.Set("Content-Range", "bytes 0-3/4")
+	srv.PutUploadChunk(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("put by other user: status %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+	w = httptest.NewRecorder()
+	srv.CreateJob(w, keyRequest("POST", "/slicer/jobs", "slicer=slic3r&preset=hq&upload="+upload.ID, bob))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("job by other user: status %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+	for _, secret := range []string{bob, ""} {
+		w = httptest.NewRecorder()
+		srv.GetUpload(w, keyRequest("GET", path, "", secret))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("get by %q: status %d (expected %d)", secret, w.Code, http.StatusNotFound)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r = keyRequest("PUT", path, "soli", alice)
+	r.Header.Set("Content-Range", "bytes 0-3/4")
+	srv.PutUploadChunk(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("put by owner: status %d %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	srv.GetUpload(w, keyRequest("GET", path, "", admin))
+	if w.Code != http.StatusOK {
+		t.Errorf("get by admin: status %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCanUseMesh(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	alice, key := testKey(t, ScopeSubmit)
+	bob, _ := testKey(t, ScopeSubmit)
+	admin, _ := testKey(t, ScopeAdmin)
+
+	job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 1)
+	job.Owner = key.ID
+	job.MeshSHA256 = "acfe"
+	err := PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		secret string
+		sum    string
+		ok     bool
+	}{
+		{alice, "acfe", true},
+		{alice, "beef", false},
+		{bob, "acfe", false},
+		{"", "acfe", false},
+		{admin, "acfe", true},
+	} {
+		ok, err := srv.canUseMesh(keyRequest("POST", "/slicer/jobs", "", test.secret), test.sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok {
+			t.Errorf("key %q mesh %s: %v (expected %v)", test.secret, test.sum, ok, test.ok)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.CreateJob(w, keyRequest("POST", "/slicer/jobs", "slicer=slic3r&preset=hq&mesh_sha256=acfe", bob))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("job by other user: status %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+}
+
+// ownerJobs returns the number of jobs indexed for owner.
+func ownerJobs(t *testing.T, owner string) int {
+	n := 0
+	err := ForEachOwnerJob(owner, func(job *slicerjob.Job) error {
+		if job.Owner != owner {
+			t.Errorf("job of %q indexed for %q", job.Owner, owner)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// ownerHasMesh calls OwnerHasMesh and fails the test if it returns an error.
+func ownerHasMesh(t *testing.T, owner, sum string) bool {
+	ok, err := OwnerHasMesh(owner, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestOwnerIndex(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	var jobs []*slicerjob.Job
+	for _, owner := range []string{"alice", "alice", "alicex", ""} {
+		job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 1)
+		job.Owner = owner
+		job.MeshSHA256 = "acfe"
+		err := PutJob(job.ID, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+	if n := ownerJobs(t, "alice"); n != 2 {
+		t.Errorf("alice has %d jobs (expected 2)", n)
+	}
+	if !ownerHasMesh(t, "alice", "acfe") || ownerHasMesh(t, "bob", "acfe") {
+		t.Errorf("mesh owners not indexed")
+	}
+
+	// the index is rebuilt for databases created before it existed.
+	path := DB.Path()
+	err := DB.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(b(dbOwnerJobs))
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket(b(dbOwnerMesh))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB.Close()
+	DB = loadDB(path)
+	if n := ownerJobs(t, "alice"); n != 2 {
+		t.Errorf("alice has %d jobs after reindexing (expected 2)", n)
+	}
+
+	err = DeleteJob(jobs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ownerJobs(t, "alice"); n != 1 || !ownerHasMesh(t, "alice", "acfe") {
+		t.Errorf("alice has %d jobs after deleting one (expected 1 using the mesh)", n)
+	}
+	err = DeleteJob(jobs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ownerJobs(t, "alice"); n != 0 || ownerHasMesh(t, "alice", "acfe") {
+		t.Errorf("alice has %d jobs after deleting all (expected none)", n)
+	}
+	if n := ownerJobs(t, "alicex"); n != 1 {
+		t.Errorf("alicex has %d jobs (expected 1)", n)
+	}
+}
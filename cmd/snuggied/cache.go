@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// CacheStats reports the effectiveness of the result cache.
+type CacheStats struct {
+	Entries  int     `json:"entries"`
+	Bytes    int64   `json:"bytes"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Bypassed int64   `json:"bypassed"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+// cacheCounters are updated atomically as jobs are registered.
+type cacheCounters struct {
+	hits     int64
+	misses   int64
+	bypassed int64
+}
+
+// cacheEnabled returns true if completed jobs may be cached and served from
+// the cache.  The output of a slicer whose version is unknown cannot be told
+// apart from that of an upgraded slicer, so it is never cached.
+func (srv *SnuggieServer) cacheEnabled() bool {
+	return srv.Slic3rVersion != "" && srv.Slic3rVersion != unknownVersion
+}
+
+// resultKey computes the result cache key for job from its mesh hash, backend,
+// preset and post-processors.  The key covers the slicer version and the
+// content of the preset's configuration so that edited presets or upgraded
+// slicers do not return stale G-code.
+func (srv *SnuggieServer) resultKey(job *slicerjob.Job) (string, error) {
+	configPath := srv.Slic3rPresets[job.Preset]
+	if configPath == "" {
+		return "", fmt.Errorf("unknown preset")
+	}
+	config, err := os.Open(configPath)
+	if err != nil {
+		return "", err
+	}
+	defer config.Close()
+	hconfig := sha256.New()
+	_, err = io.Copy(hconfig, config)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "mesh:%s\n", job.MeshSHA256)
+	fmt.Fprintf(h, "backend:%s\n", job.Slicer)
+	fmt.Fprintf(h, "version:%s\n", srv.Slic3rVersion)
+	fmt.Fprintf(h, "config:%x\n", hconfig.Sum(nil))
+	if len(srv.Thumbnails) > 0 {
+		fmt.Fprintf(h, "thumbnails:%v %g %g\n", srv.Thumbnails, srv.ThumbnailView.Azimuth, srv.ThumbnailView.Elevation)
+	}
+	for _, spec := range job.PostProcess {
+		fmt.Fprintf(h, "postprocess:%q\n", spec)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedResult returns the cache record for key.  Entries whose files no
+// longer exist are removed from the cache.
+func (srv *SnuggieServer) cachedResult(key string) (rec *resultRecord, ok bool) {
+	rec, err := ViewResult(key)
+	if err != nil {
+		log.Printf("cache: %v", err)
+		return nil, false
+	}
+	if rec == nil {
+		return nil, false
+	}
+	_, err = os.Stat(rec.Path)
+	if err != nil {
+		log.Printf("cache: %v", err)
+		DeleteResult(key)
+		return nil, false
+	}
+	err = HitResult(key)
+	if err != nil {
+		log.Printf("cache: %v", err)
+	}
+	return rec, true
+}
+
+// cacheResult stores a copy of the G-code at path in the result cache under
+// the job's cache key, along with the job's original G-code if it was
+// post-processed.  The copies are hard links when the filesystem allows it.
+// Jobs completed from the cache get their own links to the result so that
+// removing either leaves the other intact.
+func (srv *SnuggieServer) cacheResult(job *slicerjob.Job, path string) error {
+	key := job.CacheKey
+	dir := filepath.Join(srv.DataDir, "cache")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	cpath := filepath.Join(dir, key+".gcode")
+	err = linkGCode(cpath, path)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(cpath)
+	if err != nil {
+		return err
+	}
+	rec := &resultRecord{Path: cpath, Size: stat.Size(), ArcFit: job.ArcFit}
+	orig, err := ViewOriginalGCodeFile(job.ID)
+	if err == nil && orig != "" {
+		rec.Original = filepath.Join(dir, key+".orig.gcode")
+		err = linkFile(rec.Original, orig)
+		if err != nil {
+			log.Printf("cache: %v", err)
+			rec.Original = ""
+		}
+	}
+	return PutResult(key, rec)
+}
+
+// CacheStats returns the current statistics for the result cache.
+func (srv *SnuggieServer) CacheStats() (*CacheStats, error) {
+	stats := &CacheStats{
+		Hits:     atomic.LoadInt64(&srv.cache.hits),
+		Misses:   atomic.LoadInt64(&srv.cache.misses),
+		Bypassed: atomic.LoadInt64(&srv.cache.bypassed),
+	}
+	if stats.Hits+stats.Misses > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+	}
+	err := ForEachResult(func(key string, rec *resultRecord) error {
+		stats.Entries++
+		stats.Bytes += rec.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (srv *SnuggieServer) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := srv.CacheStats()
+	if err != nil {
+		http.Error(w, "cache: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// linkFile replaces dst with a hard link to src, or a copy of src.
+func linkFile(dst, src string) error {
+	os.Remove(dst)
+	err := os.Link(src, dst)
+	if err != nil {
+		err = copyFile(dst, src)
+	}
+	return err
+}
+
+// linkGCode links the G-code at src to dst along with its gzip compressed
+// copy, if there is one.
+func linkGCode(dst, src string) error {
+	err := linkFile(dst, src)
+	if err != nil {
+		return err
+	}
+	err = linkFile(dst+".gz", src+".gz")
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cache: %v", err)
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	errclose := out.Close()
+	if err == nil {
+		err = errclose
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+func TestCachedOriginal(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	first := slicerjob.New()
+	first.MeshSHA256 = "mesh"
+	first.Slicer = "slic3r"
+	first.Preset = "hq"
+	first.PostProcess = []string{"arc_fit"}
+	key, err := srv.resultKey(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.CacheKey = key
+	path := filepath.Join(srv.DataDir, first.ID+".gcode")
+	orig := filepath.Join(srv.DataDir, first.ID+".orig.gcode")
+	err = ioutil.WriteFile(path, []byte(testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(orig, []byte("; original\n"+testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutOriginalGCodeFile(first.ID, orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.cacheResult(first, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := slicerjob.New()
+	second.MeshSHA256 = first.MeshSHA256
+	second.Slicer = first.Slicer
+	second.Preset = first.Preset
+	second.PostProcess = first.PostProcess
+	second, err = srv.registerJob(second, filepath.Join(srv.DataDir, "mesh.stl"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Cached {
+		t.Fatalf("job was not completed from the cache")
+	}
+	path, err = ViewOriginalGCodeFile(second.ID)
+	if err != nil || path == "" {
+		t.Fatalf("cached job has no original gcode: %v", err)
+	}
+	p, err := ioutil.ReadFile(path)
+	if err != nil || string(p) != "; original\n"+testGCode {
+		t.Errorf("original gcode %q: %v", p, err)
+	}
+}
+
+func TestCacheUnknownVersion(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.S = MemoryQueue(srv.JobDone)
+
+	first := slicerjob.New()
+	first.MeshSHA256 = "mesh"
+	first.Slicer = "slic3r"
+	first.Preset = "hq"
+	key, err := srv.resultKey(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.CacheKey = key
+	path := filepath.Join(srv.DataDir, first.ID+".gcode")
+	err = ioutil.WriteFile(path, []byte(testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.cacheResult(first, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Slic3rVersion = unknownVersion
+	second := slicerjob.New()
+	second.MeshSHA256 = first.MeshSHA256
+	second.Slicer = first.Slicer
+	second.Preset = first.Preset
+	second, err = srv.registerJob(second, filepath.Join(srv.DataDir, "mesh.stl"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Cached || second.CacheKey != "" {
+		t.Fatalf("job of an unknown slicer version used the cache: %+v", second)
+	}
+
+	path = filepath.Join(srv.DataDir, second.ID+".gcode")
+	err = ioutil.WriteFile(path, []byte(testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.JobDone(second.ID, path, nil)
+	stats, err := srv.CacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 1 || stats.Bypassed != 1 {
+		t.Errorf("cache stats %+v (expected only the first result and one bypass)", stats)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// maxRecentFailures is the number of failed jobs reported by ClusterStatus.
+const maxRecentFailures = 20
+
+// NodeStatus summarizes the jobs scheduled by a node.  Consumers is only
+// known for the node serving the request.
+type NodeStatus struct {
+	ID        string    `json:"id"`
+	Local     bool      `json:"local,omitempty"`
+	Consumers int       `json:"consumers"`
+	Queued    int       `json:"queued"`
+	Running   int       `json:"running"`
+	Complete  int       `json:"complete"`
+	Failed    int       `json:"failed"`
+	Cancelled int       `json:"cancelled"`
+	LastJob   time.Time `json:"last_job"`
+}
+
+// ClusterStatus is the data shown by the dashboard.  Queued jobs are listed
+// oldest first, running and failed jobs newest first.
+type ClusterStatus struct {
+	Node    string           `json:"node"`
+	Nodes   []*NodeStatus    `json:"nodes"`
+	Queued  []*slicerjob.Job `json:"queued"`
+	Running []*slicerjob.Job `json:"running"`
+	Failed  []*slicerjob.Job `json:"failed"`
+}
+
+type nodesByID []*NodeStatus
+
+func (s nodesByID) Len() int           { return len(s) }
+func (s nodesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s nodesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ClusterStatus collects the state of the queue and of every node which has
+// scheduled jobs.
+func (srv *SnuggieServer) ClusterStatus() (*ClusterStatus, error) {
+	var jobs jobsByAge
+	err := ForEachJob(func(job *slicerjob.Job) error {
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(jobs)
+
+	status := &ClusterStatus{
+		Node:    srv.NodeID,
+		Queued:  []*slicerjob.Job{},
+		Running: []*slicerjob.Job{},
+		Failed:  []*slicerjob.Job{},
+	}
+	nodes := map[string]*NodeStatus{
+		srv.NodeID: {
+			ID:        srv.NodeID,
+			Local:     true,
+			Consumers: int(atomic.LoadInt32(&srv.consumers)),
+		},
+	}
+	for _, job := range jobs {
+		node := nodes[job.Node]
+		if node == nil {
+			node = &NodeStatus{ID: job.Node}
+			nodes[job.Node] = node
+		}
+		if job.Created.After(node.LastJob) {
+			node.LastJob = job.Created
+		}
+		switch job.Status {
+		case slicerjob.Accepted:
+			node.Queued++
+			status.Queued = append(status.Queued, job)
+		case slicerjob.Processing:
+			node.Running++
+			status.Running = append(status.Running, job)
+		case slicerjob.Complete:
+			node.Complete++
+		case slicerjob.Failed:
+			node.Failed++
+			if len(status.Failed) < maxRecentFailures {
+				status.Failed = append(status.Failed, job)
+			}
+		case slicerjob.Cancelled:
+			node.Cancelled++
+		}
+	}
+	for i, j := 0, len(status.Queued)-1; i < j; i, j = i+1, j-1 {
+		status.Queued[i], status.Queued[j] = status.Queued[j], status.Queued[i]
+	}
+	for _, node := range nodes {
+		status.Nodes = append(status.Nodes, node)
+	}
+	sort.Sort(nodesByID(status.Nodes))
+	return status, nil
+}
+
+// GetClusterStatus reports the state of the queue and nodes as JSON.
+func (srv *SnuggieServer) GetClusterStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := srv.ClusterStatus()
+	if err != nil {
+		http.Error(w, "status: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// GetDashboard serves the monitoring dashboard.  The page itself contains no
+// data; it polls GetClusterStatus with the api key entered by the user.
+func (srv *SnuggieServer) GetDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := io.WriteString(w, dashboardHTML)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// PostAdminJob performs an administrative action on the job in the request
+// path.  The only action is requeue.
+func (srv *SnuggieServer) PostAdminJob(w http.ResponseWriter, r *http.Request) {
+	suffix, _ := srv.trimPath(r.URL.Path, "/admin/jobs/")
+	id, sub := splitID(suffix)
+	switch sub {
+	case "requeue":
+		srv.RequeueJob(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// RequeueJob slices the mesh of job id again in a new job with the same
+// settings and owner, bypassing the result cache.  If job id has not
+// terminated it is cancelled.
+func (srv *SnuggieServer) RequeueJob(w http.ResponseWriter, r *http.Request, id string) {
+	old, err := srv.lookupJob(id)
+	if err != nil {
+		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	if old.MeshSHA256 == "" {
+		http.Error(w, "the job's mesh is not stored", http.StatusConflict)
+		return
+	}
+	path, err := AcquireMesh(old.MeshSHA256)
+	if err != nil {
+		http.Error(w, "mesh: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	if old.Status == slicerjob.Accepted || old.Status == slicerjob.Processing {
+		srv.S.CancelSliceJob(old.ID)
+		// the job may have terminated since it was looked up, in which case
+		// it keeps its status and was already counted.
+		cancelled := false
+		err = UpdateJob(old.ID, func(job *slicerjob.Job) error {
+			if job.Status == slicerjob.Accepted || job.Status == slicerjob.Processing {
+				job.Status = slicerjob.Cancelled
+				cancelled = true
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("cancel job:%v err:%v", old.ID, err)
+		}
+		if cancelled {
+			old.Status = slicerjob.Cancelled
+			srv.metrics.jobFinished(old)
+		}
+	}
+
+	job := slicerjob.New()
+	job.MeshSHA256 = old.MeshSHA256
+	job.Slicer = old.Slicer
+	job.Preset = old.Preset
+	job.PostProcess = old.PostProcess
+	job.Owner = old.Owner
+	job, err = srv.registerJob(job, path, true)
+	if err != nil {
+		ReleaseMesh(old.MeshSHA256)
+		http.Error(w, "registration failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("requeued job:%v as job:%v", old.ID, job.ID)
+
+	srv.signJobURLs(job)
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
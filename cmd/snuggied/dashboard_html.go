@@ -0,0 +1,191 @@
+package main
+
+// dashboardHTML is the page served at /slicer/admin/dashboard.  It polls the
+// status endpoint relative to its own location so it works under any path
+// prefix.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>snuggied dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; font-size: 0.9em; }
+th { background: #f4f4f4; }
+td.num { text-align: right; }
+.empty { color: #888; font-style: italic; }
+.error { color: #b00; }
+#status { color: #888; font-size: 0.8em; }
+button { font-size: 0.8em; margin-right: 0.3em; }
+</style>
+</head>
+<body>
+<h1>snuggied <span id="node"></span></h1>
+<p>
+API key <input id="key" type="password" size="40">
+<button id="save">Save</button>
+<span id="status"></span>
+</p>
+
+<h2>Nodes</h2>
+<table>
+<thead><tr><th>Node</th><th>Consumers</th><th>Queued</th><th>Running</th><th>Complete</th><th>Failed</th><th>Cancelled</th><th>Last job</th></tr></thead>
+<tbody id="nodes"></tbody>
+</table>
+
+<h2>Running</h2>
+<table>
+<thead><tr><th>Job</th><th>Node</th><th>Preset</th><th>Owner</th><th>Created</th><th></th></tr></thead>
+<tbody id="running"></tbody>
+</table>
+
+<h2>Queue</h2>
+<table>
+<thead><tr><th>Job</th><th>Node</th><th>Preset</th><th>Owner</th><th>Created</th><th></th></tr></thead>
+<tbody id="queued"></tbody>
+</table>
+
+<h2>Recent failures</h2>
+<table>
+<thead><tr><th>Job</th><th>Node</th><th>Preset</th><th>Owner</th><th>Created</th><th>Error</th><th></th></tr></thead>
+<tbody id="failed"></tbody>
+</table>
+
+<script>
+(function() {
+	var keyInput = document.getElementById("key");
+	keyInput.value = localStorage.getItem("snuggies_api_key") || "";
+	document.getElementById("save").onclick = function() {
+		localStorage.setItem("snuggies_api_key", keyInput.value);
+		refresh();
+	};
+
+	function request(method, path, done) {
+		var xhr = new XMLHttpRequest();
+		xhr.open(method, path);
+		if (keyInput.value) {
+			xhr.setRequestHeader("Authorization", "Bearer " + keyInput.value);
+		}
+		xhr.onload = function() {
+			if (xhr.status >= 400) {
+				setStatus(method + " " + path + ": " + xhr.status + " " + xhr.responseText, true);
+				return;
+			}
+			done(xhr.responseText);
+		};
+		xhr.onerror = function() {
+			setStatus(method + " " + path + ": connection failed", true);
+		};
+		xhr.send();
+	}
+
+	function setStatus(msg, isError) {
+		var el = document.getElementById("status");
+		el.textContent = msg;
+		el.className = isError ? "error" : "";
+	}
+
+	function cell(row, text, className) {
+		var td = document.createElement("td");
+		td.textContent = text;
+		if (className) {
+			td.className = className;
+		}
+		row.appendChild(td);
+		return td;
+	}
+
+	function button(td, label, method, path) {
+		var b = document.createElement("button");
+		b.textContent = label;
+		b.onclick = function() {
+			request(method, path, refresh);
+		};
+		td.appendChild(b);
+	}
+
+	function time(s) {
+		var t = new Date(s);
+		if (isNaN(t) || t.getFullYear() < 2000) {
+			return "";
+		}
+		return t.toLocaleString();
+	}
+
+	function fill(id, items, ncols, render) {
+		var body = document.getElementById(id);
+		while (body.firstChild) {
+			body.removeChild(body.firstChild);
+		}
+		if (!items || items.length === 0) {
+			var row = body.insertRow();
+			var td = cell(row, "none", "empty");
+			td.colSpan = ncols;
+			return;
+		}
+		for (var i = 0; i < items.length; i++) {
+			render(body.insertRow(), items[i]);
+		}
+	}
+
+	function jobCells(row, job) {
+		cell(row, job.id);
+		cell(row, job.node || "");
+		cell(row, job.slicer + "/" + job.preset);
+		cell(row, job.owner || "");
+		cell(row, time(job.created));
+	}
+
+	function actions(row, job, cancel) {
+		var td = cell(row, "");
+		if (cancel) {
+			button(td, "Cancel", "DELETE", "../jobs/" + job.id);
+		}
+		button(td, "Requeue", "POST", "jobs/" + job.id + "/requeue");
+	}
+
+	function render(status) {
+		document.getElementById("node").textContent = status.node;
+		fill("nodes", status.nodes, 8, function(row, node) {
+			cell(row, (node.id || "unknown") + (node.local ? " (this node)" : ""));
+			cell(row, node.local ? node.consumers : "", "num");
+			cell(row, node.queued, "num");
+			cell(row, node.running, "num");
+			cell(row, node.complete, "num");
+			cell(row, node.failed, "num");
+			cell(row, node.cancelled, "num");
+			cell(row, time(node.last_job));
+		});
+		// slic3r does not report its progress, so running jobs have none.
+		fill("running", status.running, 6, function(row, job) {
+			jobCells(row, job);
+			actions(row, job, true);
+		});
+		fill("queued", status.queued, 6, function(row, job) {
+			jobCells(row, job);
+			actions(row, job, true);
+		});
+		fill("failed", status.failed, 7, function(row, job) {
+			jobCells(row, job);
+			cell(row, job.error || "", "error");
+			actions(row, job, false);
+		});
+	}
+
+	function refresh() {
+		request("GET", "status", function(body) {
+			render(JSON.parse(body));
+			setStatus("updated " + new Date().toLocaleTimeString(), false);
+		});
+	}
+
+	refresh();
+	setInterval(refresh, 2000);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// addNodeJob stores a job scheduled by node like addTestJob.
+func addNodeJob(t *testing.T, srv *SnuggieServer, node string, status slicerjob.Status, created time.Time) *slicerjob.Job {
+	job := addTestJob(t, srv, status, created, 10)
+	job.Node = node
+	err := PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestClusterStatus(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.NodeID = "n1"
+	srv.consumers = 2
+	now := time.Now()
+
+	queued1 := addNodeJob(t, srv, "n1", slicerjob.Accepted, now.Add(-3*time.Minute))
+	queued2 := addNodeJob(t, srv, "n2", slicerjob.Accepted, now.Add(-time.Minute))
+	running := addNodeJob(t, srv, "n1", slicerjob.Processing, now.Add(-2*time.Minute))
+	addNodeJob(t, srv, "n1", slicerjob.Complete, now.Add(-time.Hour))
+	failed1 := addNodeJob(t, srv, "n2", slicerjob.Failed, now.Add(-2*time.Hour))
+	failed2 := addNodeJob(t, srv, "n2", slicerjob.Failed, now.Add(-30*time.Minute))
+	addNodeJob(t, srv, "n2", slicerjob.Cancelled, now.Add(-time.Hour))
+
+	w := httptest.NewRecorder()
+	srv.GetClusterStatus(w, newRequest("GET", "/slicer/admin/status", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body)
+	}
+	status := new(ClusterStatus)
+	err := json.NewDecoder(w.Body).Decode(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(jobs []*slicerjob.Job) string {
+		var s []string
+		for _, job := range jobs {
+			s = append(s, job.ID)
+		}
+		return strings.Join(s, ",")
+	}
+	if ids(status.Queued) != queued1.ID+","+queued2.ID {
+		t.Errorf("queued %s (expected oldest first)", ids(status.Queued))
+	}
+	if ids(status.Running) != running.ID {
+		t.Errorf("running %s", ids(status.Running))
+	}
+	if ids(status.Failed) != failed2.ID+","+failed1.ID {
+		t.Errorf("failed %s (expected newest first)", ids(status.Failed))
+	}
+
+	if len(status.Nodes) != 2 {
+		t.Fatalf("%d nodes (expected 2)", len(status.Nodes))
+	}
+	n1, n2 := status.Nodes[0], status.Nodes[1]
+	if n1.ID != "n1" || !n1.Local || n1.Consumers != 2 || n1.Queued != 1 || n1.Running != 1 || n1.Complete != 1 {
+		t.Errorf("node n1: %+v", n1)
+	}
+	if n2.ID != "n2" || n2.Local || n2.Queued != 1 || n2.Failed != 2 || n2.Cancelled != 1 {
+		t.Errorf("node n2: %+v", n2)
+	}
+	if !n2.LastJob.Equal(queued2.Created) {
+		t.Errorf("node n2: last job %v (expected %v)", n2.LastJob, queued2.Created)
+	}
+}
+
+// addMeshJob stores a job with the given status whose mesh is stored.
+func addMeshJob(t *testing.T, srv *SnuggieServer, status slicerjob.Status) *slicerjob.Job {
+	sum, _, err := srv.storeMesh(strings.NewReader("solid cube"), ".stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := addTestJob(t, srv, status, time.Now(), 10)
+	job.MeshSHA256 = sum
+	job.Preset = "hq"
+	job.Slicer = "slic3r"
+	job.Owner = "alice"
+	err = PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestRequeueJob(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.metrics = newServerMetrics()
+	q := MemoryQueue(srv.JobDone)
+	srv.S = q
+
+	old := addMeshJob(t, srv, slicerjob.Processing)
+	w := httptest.NewRecorder()
+	srv.PostAdminJob(w, newRequest("POST", "/slicer/admin/jobs/"+old.ID+"/requeue", ""))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("requeue: status %d %s", w.Code, w.Body)
+	}
+	job := new(slicerjob.Job)
+	err := json.NewDecoder(w.Body).Decode(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == old.ID || job.Status != slicerjob.Accepted {
+		t.Errorf("requeued job %v status %v", job.ID, job.Status)
+	}
+	if job.MeshSHA256 != old.MeshSHA256 || job.Preset != old.Preset || job.Owner != old.Owner {
+		t.Errorf("requeued job: %+v", job)
+	}
+	if _, queued := q.QueueStats(); queued != 1 {
+		t.Errorf("%d jobs queued (expected 1)", queued)
+	}
+
+	// the running job was cancelled and counted once.
+	stored, err := ViewJob(old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != slicerjob.Cancelled {
+		t.Errorf("old job status %v (expected %v)", stored.Status, slicerjob.Cancelled)
+	}
+	if n := finishedCount(srv.metrics, slicerjob.Cancelled); n != 1 {
+		t.Errorf("cancelled jobs counted %d times (expected 1)", n)
+	}
+
+	// a finished job is requeued without being cancelled.
+	done := addMeshJob(t, srv, slicerjob.Complete)
+	w = httptest.NewRecorder()
+	srv.PostAdminJob(w, newRequest("POST", "/slicer/admin/jobs/"+done.ID+"/requeue", ""))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("requeue complete job: status %d %s", w.Code, w.Body)
+	}
+	stored, err = ViewJob(done.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != slicerjob.Complete {
+		t.Errorf("complete job status %v after requeue", stored.Status)
+	}
+}
+
+func TestPostAdminJob(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.S = MemoryQueue(nil)
+
+	nomesh := addTestJob(t, srv, slicerjob.Failed, time.Now(), 10)
+	withMesh := addMeshJob(t, srv, slicerjob.Failed)
+	for _, test := range []struct {
+		path string
+		code int
+	}{
+		{"/slicer/admin/jobs/" + nomesh.ID + "/requeue", http.StatusConflict},
+		{"/slicer/admin/jobs/unknown/requeue", http.StatusNotFound},
+		{"/slicer/admin/jobs/" + withMesh.ID + "/restart", http.StatusNotFound},
+		{"/slicer/admin/jobs/" + withMesh.ID, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		srv.PostAdminJob(w, newRequest("POST", test.path, ""))
+		if w.Code != test.code {
+			t.Errorf("POST %s: status %d (expected %d)", test.path, w.Code, test.code)
+		}
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	srv.S = MemoryQueue(nil)
+	admin, _ := testKey(t, ScopeAdmin)
+	user, _ := testKey(t, ScopeSubmit, ScopeRead, ScopeCancel)
+	job := addMeshJob(t, srv, slicerjob.Failed)
+	h := srv.RegisterHandlers(http.NewServeMux())
+
+	for _, test := range []struct {
+		method, path, secret string
+		code                 int
+	}{
+		// the dashboard page holds no data and is served to anyone.
+		{"GET", "/slicer/admin/dashboard", "", http.StatusOK},
+		{"GET", "/slicer/admin/status", "", http.StatusUnauthorized},
+		{"GET", "/slicer/admin/status", user, http.StatusForbidden},
+		{"GET", "/slicer/admin/status", admin, http.StatusOK},
+		{"POST", "/slicer/admin/jobs/" + job.ID + "/requeue", user, http.StatusForbidden},
+		{"POST", "/slicer/admin/jobs/" + job.ID + "/requeue", admin, http.StatusAccepted},
+		{"GET", "/slicer/admin/jobs/" + job.ID + "/requeue", admin, http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, keyRequest(test.method, test.path, "", test.secret))
+		if w.Code != test.code {
+			t.Errorf("%s %s: status %d (expected %d)", test.method, test.path, w.Code, test.code)
+		}
+	}
+}
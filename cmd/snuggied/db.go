@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/gophergala/matching-snuggies/gcode"
 	"github.com/gophergala/matching-snuggies/slicerjob"
 )
 
@@ -18,10 +24,21 @@ const (
 	dbJobs       = "jobs"
 	dbMeshFiles  = "meshFiles"
 	dbGCodeFiles = "gCodeFiles"
+	dbUploads    = "uploads"
+	dbMeshes     = "meshes"
+	dbResults    = "results"
+	dbLayers     = "layers"
+	dbOriginals  = "originalGCodeFiles"
+	dbAPIKeys    = "apiKeys"
+	dbUsage      = "usage"
+	dbOwnerJobs  = "ownerJobs"
+	dbOwnerMesh  = "ownerMeshes"
 )
 
 func loadDB(path string) *bolt.DB {
-	db, err := bolt.Open(path, 0666, nil)
+	// another process, like a running server, holding the database lock
+	// would otherwise block forever.
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		panic(err)
 	}
@@ -39,11 +56,125 @@ func loadDB(path string) *bolt.DB {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(b(dbUploads))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(b(dbMeshes))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(b(dbResults))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(b(dbLayers))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(b(dbOriginals))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(b(dbAPIKeys))
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(b(dbUsage))
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(b(dbOwnerJobs)) == nil {
+			return indexOwners(tx)
+		}
 		return nil
 	})
 	return db
 }
 
+// indexOwners creates the buckets indexing jobs and meshes by owner from the
+// jobs in the database.
+func indexOwners(tx *bolt.Tx) error {
+	_, err := tx.CreateBucket(b(dbOwnerJobs))
+	if err != nil {
+		return err
+	}
+	_, err = tx.CreateBucket(b(dbOwnerMesh))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(b(dbJobs)).ForEach(func(k, v []byte) error {
+		job := new(slicerjob.Job)
+		err := json.Unmarshal(v, job)
+		if err != nil {
+			return fmt.Errorf("job %s: %v", k, err)
+		}
+		return indexJob(tx, job)
+	})
+}
+
+// ownerKey returns the key of id in the buckets indexed by owner.  Keys of the
+// same owner share a prefix so they can be found with a cursor.
+func ownerKey(owner, id string) []byte {
+	return b(owner + "\x00" + id)
+}
+
+// indexJob records job in the indexes of jobs and meshes by owner.  The
+// ownerMeshes bucket counts the owner's jobs referring to each mesh.
+func indexJob(tx *bolt.Tx, job *slicerjob.Job) error {
+	if job.Owner == "" {
+		return nil
+	}
+	jobs := tx.Bucket(b(dbOwnerJobs))
+	key := ownerKey(job.Owner, job.ID)
+	if prev := jobs.Get(key); prev != nil {
+		if string(prev) == job.MeshSHA256 {
+			return nil
+		}
+		err := countOwnerMesh(tx, job.Owner, string(prev), -1)
+		if err != nil {
+			return err
+		}
+	}
+	err := jobs.Put(key, b(job.MeshSHA256))
+	if err != nil {
+		return err
+	}
+	return countOwnerMesh(tx, job.Owner, job.MeshSHA256, 1)
+}
+
+// unindexJob removes job from the indexes of jobs and meshes by owner.
+func unindexJob(tx *bolt.Tx, job *slicerjob.Job) error {
+	if job.Owner == "" {
+		return nil
+	}
+	jobs := tx.Bucket(b(dbOwnerJobs))
+	key := ownerKey(job.Owner, job.ID)
+	sum := jobs.Get(key)
+	if sum == nil {
+		return nil
+	}
+	err := countOwnerMesh(tx, job.Owner, string(sum), -1)
+	if err != nil {
+		return err
+	}
+	return jobs.Delete(key)
+}
+
+func countOwnerMesh(tx *bolt.Tx, owner, sum string, delta int) error {
+	if sum == "" {
+		return nil
+	}
+	meshes := tx.Bucket(b(dbOwnerMesh))
+	key := ownerKey(owner, sum)
+	n, _ := strconv.Atoi(string(meshes.Get(key)))
+	n += delta
+	if n <= 0 {
+		return meshes.Delete(key)
+	}
+	return meshes.Put(key, b(strconv.Itoa(n)))
+}
+
 func PutMeshFile(key string, path string) error {
 	return DB.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket(b(dbMeshFiles)).
@@ -61,6 +192,28 @@ func PutGCodeFile(key string, value string) error {
 	})
 }
 
+// PutOriginalGCodeFile records the location of the G-code produced by the
+// slicer for job key before post-processing.
+func PutOriginalGCodeFile(key string, path string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbOriginals)).Put(b(key), b(path))
+	})
+}
+
+func ViewOriginalGCodeFile(key string) (path string, err error) {
+	err = DB.View(func(tx *bolt.Tx) error {
+		path = string(tx.Bucket(b(dbOriginals)).Get(b(key)))
+		return nil
+	})
+	return path, err
+}
+
+func DeleteOriginalGCodeFile(key string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbOriginals)).Delete(b(key))
+	})
+}
+
 func PutJob(key string, job *slicerjob.Job) error {
 	jsonJob, err := json.Marshal(job)
 	if err != nil {
@@ -73,7 +226,11 @@ func PutJob(key string, job *slicerjob.Job) error {
 		if bucket == nil {
 			return fmt.Errorf("%v bucket doesn't exist!", bucketName)
 		}
-		return bucket.Put(b(key), jsonJob)
+		err := bucket.Put(b(key), jsonJob)
+		if err != nil {
+			return err
+		}
+		return indexJob(tx, job)
 	})
 }
 
@@ -108,29 +265,528 @@ func ViewJob(key string) (*slicerjob.Job, error) {
 	return job, err
 }
 
-func CancelJob(id string) error {
-	job, err := ViewJob(id)
-	if err != nil {
-		return err
-	}
-	job.Status = slicerjob.Cancelled
-	return PutJob(id, job)
+// ForEachJob calls fn for every job in the database.  The database cannot be
+// modified by fn.
+func ForEachJob(fn func(job *slicerjob.Job) error) error {
+	return DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbJobs)).ForEach(func(k, v []byte) error {
+			job := new(slicerjob.Job)
+			err := json.Unmarshal(v, job)
+			if err != nil {
+				return fmt.Errorf("job %s: %v", k, err)
+			}
+			return fn(job)
+		})
+	})
+}
+
+// ForEachOwnerJob calls fn for every job belonging to owner.  The database
+// cannot be modified by fn.
+func ForEachOwnerJob(owner string, fn func(job *slicerjob.Job) error) error {
+	return DB.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(b(dbJobs))
+		prefix := ownerKey(owner, "")
+		c := tx.Bucket(b(dbOwnerJobs)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			id := k[len(prefix):]
+			v := jobs.Get(id)
+			if v == nil {
+				continue
+			}
+			job := new(slicerjob.Job)
+			err := json.Unmarshal(v, job)
+			if err != nil {
+				return fmt.Errorf("job %s: %v", id, err)
+			}
+			err = fn(job)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// OwnerHasMesh returns true if a job belonging to owner refers to the mesh
+// with hash sum.
+func OwnerHasMesh(owner, sum string) (bool, error) {
+	found := false
+	err := DB.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(b(dbOwnerMesh)).Get(ownerKey(owner, sum)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// UpdateJob stores job id as modified by fn in a single transaction, so that
+// concurrent updates are not lost.  If fn returns an error the job is not
+// changed and the error is returned.
+func UpdateJob(id string, fn func(job *slicerjob.Job) error) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b(dbJobs))
+		v := bucket.Get(b(id))
+		if v == nil {
+			return fmt.Errorf("job %s not found", id)
+		}
+		job := new(slicerjob.Job)
+		err := json.Unmarshal(v, job)
+		if err != nil {
+			return err
+		}
+		err = fn(job)
+		if err != nil {
+			return err
+		}
+		jsonJob, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(b(id), jsonJob)
+		if err != nil {
+			return err
+		}
+		return indexJob(tx, job)
+	})
+}
+
+// CancelJob marks job id as Cancelled and returns the status it had before.
+func CancelJob(id string) (prev slicerjob.Status, err error) {
+	err = UpdateJob(id, func(job *slicerjob.Job) error {
+		prev = job.Status
+		job.Status = slicerjob.Cancelled
+		return nil
+	})
+	return prev, err
 }
 
 func DeleteJob(id string) error {
 	bucket := "jobs"
-	err := DB.View(func(tx *bolt.Tx) error {
-		err := tx.Bucket(b(bucket)).Delete(b(id))
-		return err
+	err := DB.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(b(bucket)).Get(b(id))
+		if v == nil {
+			return nil
+		}
+		// a job which cannot be decoded was never indexed.
+		job := new(slicerjob.Job)
+		if json.Unmarshal(v, job) == nil {
+			job.ID = id
+			err := unindexJob(tx, job)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(b(bucket)).Delete(b(id))
 	})
 	return err
 }
 
 func DeleteGCodeFile(id string) error {
 	bucket := "gCodeFiles"
-	err := DB.View(func(tx *bolt.Tx) error {
+	err := DB.Update(func(tx *bolt.Tx) error {
 		err := tx.Bucket(b(bucket)).Delete(b(id))
 		return err
 	})
 	return err
 }
+
+func DeleteMeshFile(id string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbMeshFiles)).Delete(b(id))
+	})
+}
+
+// meshRecord describes a mesh file stored by content hash.  Refs counts the
+// jobs that refer to the mesh.
+type meshRecord struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Refs int    `json:"refs"`
+}
+
+// meshMut serializes changes to the set of stored meshes.  Mesh files are
+// created and removed outside of database transactions, which may be retried
+// or rolled back, so PutMesh and ReleaseMesh hold meshMut while a mesh's
+// record and its file disagree.
+var meshMut sync.Mutex
+
+// PutMesh records the mesh with hash sum, which was written to tmp, and
+// acquires a reference to it.  If the mesh is already stored tmp is removed.
+// Otherwise tmp is moved to path.  The location of the stored mesh is
+// returned.
+func PutMesh(sum, tmp, path string, size int64) (string, error) {
+	meshMut.Lock()
+	defer meshMut.Unlock()
+
+	rec, err := ViewMesh(sum)
+	if err != nil {
+		return "", err
+	}
+	stored := rec != nil
+	if !stored {
+		// the file is moved into place before it is recorded so that a
+		// recorded mesh always exists.
+		err = os.Rename(tmp, path)
+		if err != nil {
+			return "", err
+		}
+		rec = &meshRecord{Path: path, Size: size}
+	}
+	rec.Refs++
+	err = DB.Update(func(tx *bolt.Tx) error {
+		p, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(b(dbMeshes)).Put(b(sum), p)
+	})
+	if err != nil {
+		if !stored {
+			os.Remove(path)
+		}
+		return "", err
+	}
+	if stored {
+		os.Remove(tmp)
+	}
+	return rec.Path, nil
+}
+
+// ViewMesh returns the record of the stored mesh with hash sum.  If the mesh is
+// not stored ViewMesh returns nil and a nil error.
+func ViewMesh(sum string) (*meshRecord, error) {
+	var rec *meshRecord
+	err := DB.View(func(tx *bolt.Tx) error {
+		p := tx.Bucket(b(dbMeshes)).Get(b(sum))
+		if p == nil {
+			return nil
+		}
+		rec = new(meshRecord)
+		return json.Unmarshal(p, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// AcquireMesh acquires a reference to the stored mesh with hash sum and
+// returns its location.
+func AcquireMesh(sum string) (path string, err error) {
+	err = DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b(dbMeshes))
+		p := bucket.Get(b(sum))
+		if p == nil {
+			return fmt.Errorf("unknown mesh %v", sum)
+		}
+		var rec meshRecord
+		err := json.Unmarshal(p, &rec)
+		if err != nil {
+			return err
+		}
+		rec.Refs++
+		path = rec.Path
+		p, err = json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(b(sum), p)
+	})
+	return path, err
+}
+
+// ReleaseMesh releases a reference to the stored mesh with hash sum.  When no
+// references remain the mesh file and the files derived from it are removed.
+func ReleaseMesh(sum string) error {
+	meshMut.Lock()
+	defer meshMut.Unlock()
+
+	var removed *meshRecord
+	err := DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b(dbMeshes))
+		p := bucket.Get(b(sum))
+		if p == nil {
+			return nil
+		}
+		var rec meshRecord
+		err := json.Unmarshal(p, &rec)
+		if err != nil {
+			return err
+		}
+		rec.Refs--
+		if rec.Refs > 0 {
+			p, err = json.Marshal(&rec)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(b(sum), p)
+		}
+		removed = &rec
+		return bucket.Delete(b(sum))
+	})
+	if err != nil || removed == nil {
+		return err
+	}
+	err = os.Remove(removed.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeDerivedMeshFiles(removed.Path)
+	return nil
+}
+
+// ForEachUpload calls fn for every upload session in the database.
+func ForEachUpload(fn func(upload *slicerjob.Upload) error) error {
+	return DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbUploads)).ForEach(func(k, v []byte) error {
+			upload := new(slicerjob.Upload)
+			err := json.Unmarshal(v, upload)
+			if err != nil {
+				return fmt.Errorf("upload %s: %v", k, err)
+			}
+			return fn(upload)
+		})
+	})
+}
+
+func PutUpload(key string, upload *slicerjob.Upload) error {
+	jsonUpload, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbUploads)).Put(b(key), jsonUpload)
+	})
+}
+
+func ViewUpload(key string) (*slicerjob.Upload, error) {
+	var upload = new(slicerjob.Upload)
+	err := DB.View(func(tx *bolt.Tx) error {
+		jsonUpload := tx.Bucket(b(dbUploads)).Get(b(key))
+		if jsonUpload == nil {
+			return fmt.Errorf("upload not found: %v", key)
+		}
+		return json.Unmarshal(jsonUpload, upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func DeleteUpload(key string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbUploads)).Delete(b(key))
+	})
+}
+
+// resultRecord describes cached G-code produced by slicing a mesh.
+type resultRecord struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Hits    int       `json:"hits"`
+	Created time.Time `json:"created"`
+
+	// Original is the G-code produced by the slicer before post-processing.
+	// It is empty if the result was not post-processed.
+	Original string `json:"original,omitempty"`
+
+	// ArcFit is copied to jobs served from the cache.
+	ArcFit *gcode.ArcStats `json:"arc_fit,omitempty"`
+}
+
+func PutResult(key string, rec *resultRecord) error {
+	if rec.Created.IsZero() {
+		rec.Created = time.Now()
+	}
+	p, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbResults)).Put(b(key), p)
+	})
+}
+
+// ViewResult returns the cached result for key.  If there is no result for key
+// ViewResult returns nil and a nil error.
+func ViewResult(key string) (*resultRecord, error) {
+	var rec *resultRecord
+	err := DB.View(func(tx *bolt.Tx) error {
+		p := tx.Bucket(b(dbResults)).Get(b(key))
+		if p == nil {
+			return nil
+		}
+		rec = new(resultRecord)
+		return json.Unmarshal(p, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// HitResult increments the hit count of the cached result for key.
+func HitResult(key string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b(dbResults))
+		p := bucket.Get(b(key))
+		if p == nil {
+			return nil
+		}
+		var rec resultRecord
+		err := json.Unmarshal(p, &rec)
+		if err != nil {
+			return err
+		}
+		rec.Hits++
+		p, err = json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(b(key), p)
+	})
+}
+
+func ForEachResult(fn func(key string, rec *resultRecord) error) error {
+	return DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbResults)).ForEach(func(k, v []byte) error {
+			var rec resultRecord
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				return err
+			}
+			return fn(string(k), &rec)
+		})
+	})
+}
+
+func DeleteResult(key string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbResults)).Delete(b(key))
+	})
+}
+
+func PutLayers(key string, layers []gcode.Layer) error {
+	p, err := json.Marshal(layers)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbLayers)).Put(b(key), p)
+	})
+}
+
+// ViewLayers returns the layer index of the G-code for job key.  If the G-code
+// has not been indexed ViewLayers returns nil and a nil error.
+func ViewLayers(key string) ([]gcode.Layer, error) {
+	var layers []gcode.Layer
+	err := DB.View(func(tx *bolt.Tx) error {
+		p := tx.Bucket(b(dbLayers)).Get(b(key))
+		if p == nil {
+			return nil
+		}
+		return json.Unmarshal(p, &layers)
+	})
+	return layers, err
+}
+
+func DeleteLayers(key string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbLayers)).Delete(b(key))
+	})
+}
+
+// PutAPIKey stores key under the hash of its secret.
+func PutAPIKey(hash string, key *APIKey) error {
+	p, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbAPIKeys)).Put(b(hash), p)
+	})
+}
+
+// ViewAPIKey returns the key with the given hash or nil if there is no such
+// key.
+func ViewAPIKey(hash string) (*APIKey, error) {
+	var key *APIKey
+	err := DB.View(func(tx *bolt.Tx) error {
+		p := tx.Bucket(b(dbAPIKeys)).Get(b(hash))
+		if p == nil {
+			return nil
+		}
+		key = new(APIKey)
+		return json.Unmarshal(p, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func ForEachAPIKey(fn func(hash string, key *APIKey) error) error {
+	return DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbAPIKeys)).ForEach(func(k, v []byte) error {
+			key := new(APIKey)
+			err := json.Unmarshal(v, key)
+			if err != nil {
+				return fmt.Errorf("api key %s: %v", k, err)
+			}
+			return fn(string(k), key)
+		})
+	})
+}
+
+func DeleteAPIKey(hash string) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b(dbAPIKeys)).Delete(b(hash))
+	})
+}
+
+// usageRecord counts the bytes uploaded by an api key during one day.
+type usageRecord struct {
+	Day         string `json:"day"`
+	UploadBytes int64  `json:"upload_bytes"`
+}
+
+// AddUploadBytes adds n to the bytes uploaded by owner on day.  Counts for
+// previous days are discarded.
+func AddUploadBytes(owner, day string, n int64) error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b(dbUsage))
+		var rec usageRecord
+		p := bucket.Get(b(owner))
+		if p != nil {
+			err := json.Unmarshal(p, &rec)
+			if err != nil {
+				return err
+			}
+		}
+		if rec.Day != day {
+			rec = usageRecord{Day: day}
+		}
+		rec.UploadBytes += n
+		p, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(b(owner), p)
+	})
+}
+
+// ViewUploadBytes returns the number of bytes uploaded by owner on day.
+func ViewUploadBytes(owner, day string) (int64, error) {
+	var rec usageRecord
+	err := DB.View(func(tx *bolt.Tx) error {
+		p := tx.Bucket(b(dbUsage)).Get(b(owner))
+		if p == nil {
+			return nil
+		}
+		return json.Unmarshal(p, &rec)
+	})
+	if err != nil || rec.Day != day {
+		return 0, err
+	}
+	return rec.UploadBytes, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+)
+
+// compressGCode stores a gzip compressed copy of the G-code at path in
+// path+".gz", which is served to clients that accept gzip encoding.
+func compressGCode(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "gzip-")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(tmp)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	errclose := tmp.Close()
+	if err == nil {
+		err = errclose
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path+".gz")
+}
+
+// acceptsGzip returns true if the client accepts gzip content encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.Replace(p, " ", "", -1)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil || q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveGCode writes the G-code at path for job id in the format requested by
+// the query parameter "format".  Plain G-code is sent gzip compressed when
+// the client accepts it and a compressed copy is stored.
+func (srv *SnuggieServer) serveGCode(w http.ResponseWriter, r *http.Request, id, path string) {
+	format := r.FormValue("format")
+	switch format {
+	case "", "gcode":
+	case "meatpack":
+		srv.encodeGCode(w, id, path, id+".gcode", func(w io.Writer, r io.Reader) error {
+			return gcode.EncodeMeatPack(w, r)
+		})
+		return
+	case "bgcode":
+		meta := srv.binaryMetadata(id)
+		srv.encodeGCode(w, id, path, id+".bgcode", func(w io.Writer, r io.Reader) error {
+			return gcode.EncodeBinary(w, r, meta)
+		})
+		return
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		f, err := os.Open(path + ".gz")
+		if err == nil {
+			defer f.Close()
+			stat, err := f.Stat()
+			if err == nil {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("Content-Encoding", "gzip")
+				http.ServeContent(w, r, "", stat.ModTime(), f)
+				return
+			}
+		}
+	}
+	http.ServeFile(w, r, path)
+}
+
+// encodeGCode writes the G-code at path to w using encode.  The output is
+// served as an attachment with the given filename.
+func (srv *SnuggieServer) encodeGCode(w http.ResponseWriter, id, path, filename string, encode func(io.Writer, io.Reader) error) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "gcode: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	err = encode(w, f)
+	if err != nil {
+		log.Printf("encode job:%v err:%v", id, err)
+	}
+}
+
+// binaryMetadata returns the metadata embedded in binary G-code for job id.
+func (srv *SnuggieServer) binaryMetadata(id string) *gcode.BinaryMetadata {
+	meta := &gcode.BinaryMetadata{
+		File:    map[string]string{"Producer": "snuggied"},
+		Printer: map[string]string{},
+		Print:   map[string]string{},
+		Slicer:  map[string]string{},
+	}
+	job, err := ViewJob(id)
+	if err != nil {
+		log.Printf("metadata job:%v err:%v", id, err)
+		return meta
+	}
+	if job.Stats != nil {
+		used := map[string]string{
+			"filament used [mm]":  fmt.Sprintf("%.2f", job.Stats.FilamentLength),
+			"filament used [cm3]": fmt.Sprintf("%.2f", job.Stats.FilamentVolume/1000),
+			"filament used [g]":   fmt.Sprintf("%.2f", job.Stats.FilamentWeight),
+		}
+		for k, v := range used {
+			meta.Printer[k] = v
+			meta.Print[k] = v
+		}
+	}
+	if job.Estimate != nil {
+		t := formatDuration(job.Estimate.Total)
+		meta.Printer["estimated printing time (normal mode)"] = t
+		meta.Print["estimated printing time (normal mode)"] = t
+	}
+	if config, err := ReadConfigSlic3r(srv.Slic3rPresets[job.Preset]); err == nil {
+		for k, v := range config {
+			meta.Slicer[k] = v
+		}
+	}
+	meta.File["Producer"] = fmt.Sprintf("snuggied (%s %s)", job.Slicer, srv.Slic3rVersion)
+	return meta
+}
+
+// formatDuration formats a number of seconds like "1h 2m 3s".
+func formatDuration(seconds float64) string {
+	s := int(seconds + 0.5)
+	h, m := s/3600, s/60%60
+	s %= 60
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh %dm %ds", h, m, s)
+	case m > 0:
+		return fmt.Sprintf("%dm %ds", m, s)
+	}
+	return fmt.Sprintf("%ds", s)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		gzip   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5", true},
+		{"gzip; q=0", false},
+		{"gzip;q=x", false},
+		{"deflate", false},
+		{"x-gzip", false},
+	} {
+		r := newRequest("GET", "/slicer/gcodes/x", "")
+		r.Header.Set("Accept-Encoding", test.header)
+		if acceptsGzip(r) != test.gzip {
+			t.Errorf("Accept-Encoding %q: gzip %v", test.header, !test.gzip)
+		}
+	}
+}
+
+// getGCode requests the G-code of job id with the given query and
+// Accept-Encoding header.
+func getGCode(srv *SnuggieServer, id, query, encoding string) *httptest.ResponseRecorder {
+	r := newRequest("GET", "/slicer/gcodes/"+id+query, "")
+	if encoding != "" {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	srv.GetGCode(w, r)
+	return w
+}
+
+func TestGetGCodeGzip(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addGCodeJob(t, srv)
+
+	// without a compressed copy plain G-code is sent to every client.
+	w := getGCode(srv, job.ID, "", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" || w.Body.String() != testGCode {
+		t.Errorf("uncompressed: status %d encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	path, err := ViewGCodeFile(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressGCode(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = getGCode(srv, job.ID, "", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip: status %d encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("gzip: Vary %q", w.Header().Get("Vary"))
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("gzip: Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != testGCode {
+		t.Errorf("gzip: decompressed G-code %q", p)
+	}
+
+	for _, encoding := range []string{"", "gzip;q=0", "deflate"} {
+		w = getGCode(srv, job.ID, "", encoding)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != testGCode {
+			t.Errorf("Accept-Encoding %q: encoding %q", encoding, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestGetGCodeFormats(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addGCodeJob(t, srv)
+
+	w := getGCode(srv, job.ID, "?format=meatpack", "gzip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("meatpack: status %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), job.ID+".gcode") {
+		t.Errorf("meatpack: Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("meatpack: Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+	header := []byte{0xff, 0xff, 0xfb, 0xff, 0xff, 0xf7}
+	if !bytes.HasPrefix(w.Body.Bytes(), header) || w.Body.Len() >= len(testGCode) {
+		t.Errorf("meatpack: %d bytes % x", w.Body.Len(), w.Body.Bytes())
+	}
+
+	w = getGCode(srv, job.ID, "?format=bgcode", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("bgcode: status %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), job.ID+".bgcode") {
+		t.Errorf("bgcode: Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("GCDE")) {
+		t.Errorf("bgcode: %d bytes without a GCDE header", w.Body.Len())
+	}
+
+	for _, query := range []string{"?format=gcode", "?format="} {
+		w = getGCode(srv, job.ID, query, "")
+		if w.Code != http.StatusOK || w.Body.String() != testGCode {
+			t.Errorf("%s: status %d", query, w.Code)
+		}
+	}
+	w = getGCode(srv, job.ID, "?format=x3g", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+	w = getGCode(srv, "unknown", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package main
+
+// diskFree is not supported on this platform.
+func diskFree(path string) (int64, error) {
+	return 0, errNoDiskFree
+}
@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package main
+
+import "syscall"
+
+// diskFree returns the number of bytes available to unprivileged users on the
+// filesystem containing path.
+func diskFree(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// MeshFetcher downloads mesh files from remote HTTP servers.  Only servers in
+// the Hosts allowlist are contacted, so that clients cannot use snuggied to
+// make requests to arbitrary URLs.
+type MeshFetcher struct {
+	// Hosts contains allowed host names.  An entry may include a port to
+	// restrict access to a single port on the host.
+	Hosts []string
+
+	// MaxSize is the maximum size in bytes of a fetched mesh file.
+	MaxSize int64
+
+	// Timeout limits the total time spent fetching a mesh file.
+	Timeout time.Duration
+
+	// TempDir is the directory where fetched files are written.
+	TempDir string
+}
+
+// errHostNotAllowed is returned when a URL's host is not in the allowlist.
+type errHostNotAllowed string
+
+func (err errHostNotAllowed) Error() string {
+	return "host not allowed: " + string(err)
+}
+
+// errURL is returned when a URL cannot be parsed or has a scheme other than
+// http or https.
+type errURL string
+
+func (err errURL) Error() string {
+	return "invalid url: " + string(err)
+}
+
+// errTooLarge is returned when a mesh exceeds the maximum fetch size.
+type errTooLarge int64
+
+func (err errTooLarge) Error() string {
+	return fmt.Sprintf("mesh exceeds %d bytes", int64(err))
+}
+
+// errChecksum is returned when a fetched file does not match its checksum.
+type errChecksum string
+
+func (err errChecksum) Error() string {
+	return "checksum: " + string(err)
+}
+
+// Fetch downloads the mesh at rawurl into a temporary file.  If checksum is
+// non-empty it has the form "sha256:<hex>" (or "sha1:<hex>") and the
+// downloaded content must match it.  The caller is responsible for closing and
+// removing the returned file.  The returned file is positioned at the start of
+// the content.
+func (f *MeshFetcher) Fetch(rawurl, checksum string) (_ *os.File, filename string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", errURL(err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", errURL(fmt.Sprintf("unsupported scheme %q", u.Scheme))
+	}
+	if !f.allowed(u) {
+		return nil, "", errHostNotAllowed(u.Host)
+	}
+	h, sum, err := parseChecksum(checksum)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client := &http.Client{
+		Timeout: f.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("too many redirects")
+			}
+			if !f.allowed(req.URL) {
+				return errHostNotAllowed(req.URL.Host)
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		// a redirect to a host outside the allowlist is the client's fault
+		// like any other disallowed host.
+		if uerr, ok := err.(*url.Error); ok {
+			if herr, ok := uerr.Err.(errHostNotAllowed); ok {
+				return nil, "", herr
+			}
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("http %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	// the slicer determines the mesh format from the file extension.
+	filename = path.Base(resp.Request.URL.Path)
+	if path.Ext(filename) == "" {
+		return nil, "", errURL(fmt.Sprintf("no file extension in path %q", resp.Request.URL.Path))
+	}
+	if f.MaxSize > 0 && resp.ContentLength > f.MaxSize {
+		return nil, "", errTooLarge(f.MaxSize)
+	}
+
+	tmp, err := ioutil.TempFile(f.TempDir, "fetch-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	var body io.Reader = resp.Body
+	if f.MaxSize > 0 {
+		body = io.LimitReader(body, f.MaxSize+1)
+	}
+	var w io.Writer = tmp
+	if h != nil {
+		w = io.MultiWriter(tmp, h)
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return nil, "", err
+	}
+	if f.MaxSize > 0 && n > f.MaxSize {
+		return nil, "", errTooLarge(f.MaxSize)
+	}
+	if h != nil && hex.EncodeToString(h.Sum(nil)) != sum {
+		return nil, "", errChecksum("content does not match " + checksum)
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return tmp, filename, nil
+}
+
+// allowed returns true if the host of u is in the allowlist.
+func (f *MeshFetcher) allowed(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range f.Hosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == host || allowed == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHosts parses a comma separated list of allowed hosts, ignoring spaces
+// and empty entries.
+func parseHosts(s string) []string {
+	var hosts []string
+	for _, host := range strings.Split(s, ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// parseChecksum parses a checksum of the form "algorithm:hex".  If checksum is
+// empty a nil hash is returned.
+func parseChecksum(checksum string) (h hash.Hash, sum string, err error) {
+	if checksum == "" {
+		return nil, "", nil
+	}
+	pieces := strings.SplitN(checksum, ":", 2)
+	if len(pieces) != 2 {
+		return nil, "", errChecksum("expected algorithm:hex")
+	}
+	switch strings.ToLower(pieces[0]) {
+	case "sha256":
+		h = sha256.New()
+	case "sha1":
+		h = sha1.New()
+	default:
+		return nil, "", errChecksum("unsupported algorithm " + pieces[0])
+	}
+	sum = strings.ToLower(pieces[1])
+	if len(sum) != 2*h.Size() {
+		return nil, "", errChecksum("invalid length")
+	}
+	return h, sum, nil
+}
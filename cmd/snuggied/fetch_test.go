@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	hosts := parseHosts(" a.com, b.com:8080,,  ")
+	expect := []string{"a.com", "b.com:8080"}
+	if !reflect.DeepEqual(hosts, expect) {
+		t.Errorf("hosts: %q (expected %q)", hosts, expect)
+	}
+	if hosts := parseHosts(" , "); len(hosts) != 0 {
+		t.Errorf("hosts: %q (expected none)", hosts)
+	}
+}
+
+// fetchServer serves a mesh at / and /cube.stl, larger ones at /big.stl (with
+// a Content-Length) and /stream.stl (without one), and redirects
+// /moved.stl to /cube.stl and /away.stl to a host outside the allowlist.  It
+// returns the server and a fetcher allowing only the server's host.
+func fetchServer(t *testing.T) (*httptest.Server, *MeshFetcher) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/cube.stl" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "solid cube")
+	})
+	mux.HandleFunc("/big.stl", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	})
+	mux.HandleFunc("/stream.stl", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write(make([]byte, 10))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/moved.stl", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/cube.stl", http.StatusFound)
+	})
+	mux.HandleFunc("/away.stl", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://elsewhere.local/cube.stl", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return ts, &MeshFetcher{Hosts: []string{u.Host}, MaxSize: 50}
+}
+
+// checksum returns the checksum of "solid cube" computed with h.
+func checksum(algorithm string, h hash.Hash) string {
+	io.WriteString(h, "solid cube")
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+func TestFetch(t *testing.T) {
+	ts, f := fetchServer(t)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		path, checksum string
+	}{
+		{"/cube.stl", ""},
+		{"/cube.stl", checksum("sha256", sha256.New())},
+		{"/cube.stl", strings.ToUpper(checksum("sha1", sha1.New()))},
+		{"/moved.stl", ""},
+	} {
+		file, name, err := f.Fetch(ts.URL+test.path, test.checksum)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.path, test.checksum, err)
+			continue
+		}
+		p, err := ioutil.ReadAll(file)
+		file.Close()
+		os.Remove(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != "solid cube" || name != "cube.stl" {
+			t.Errorf("%s: fetched %q named %q", test.path, p, name)
+		}
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	ts, f := fetchServer(t)
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	wrong := "sha256:" + strings.Repeat("0", 64)
+
+	for _, test := range []struct {
+		url, checksum string
+		err           error
+	}{
+		{"http://[::1", "", errURL("")},
+		{"ftp://" + host + "/cube.stl", "", errURL("")},
+		{ts.URL + "/", "", errURL("")},
+		{ts.URL + "/cube.stl", "md5:abc", errChecksum("")},
+		{ts.URL + "/cube.stl", wrong, errChecksum("")},
+		{ts.URL + "/cube.stl", "sha1:" + strings.Repeat("0", 40), errChecksum("")},
+		{ts.URL + "/big.stl", "", errTooLarge(0)},
+		{ts.URL + "/stream.stl", "", errTooLarge(0)},
+		{"http://elsewhere.local/cube.stl", "", errHostNotAllowed("")},
+		{ts.URL + "/away.stl", "", errHostNotAllowed("")},
+	} {
+		file, _, err := f.Fetch(test.url, test.checksum)
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		if reflect.TypeOf(err) != reflect.TypeOf(test.err) {
+			t.Errorf("%s %s: error %T %v (expected %T)", test.url, test.checksum, err, err, test.err)
+		}
+	}
+}
+
+func TestCreateJobMeshURL(t *testing.T) {
+	ts, f := fetchServer(t)
+	defer ts.Close()
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		form string
+		code int
+	}{
+		{"mesh_url=" + url.QueryEscape(ts.URL+"/"), http.StatusBadRequest},
+		{"mesh_url=" + url.QueryEscape(ts.URL+"/cube.stl") + "&checksum=sha256:" + strings.Repeat("0", 64), http.StatusBadRequest},
+		{"mesh_url=" + url.QueryEscape(ts.URL+"/big.stl"), http.StatusRequestEntityTooLarge},
+		{"mesh_url=" + url.QueryEscape(ts.URL+"/away.stl"), http.StatusForbidden},
+		{"mesh_url=" + url.QueryEscape(ts.URL+"/missing.stl"), http.StatusBadGateway},
+	} {
+		srv.Fetcher = f
+		w := httptest.NewRecorder()
+		srv.CreateJob(w, newRequest("POST", "/slicer/jobs", "slicer=slic3r&preset=hq&"+test.form))
+		if w.Code != test.code {
+			t.Errorf("%s: status %d (expected %d) %s", test.form, w.Code, test.code, w.Body)
+		}
+	}
+
+	srv.Fetcher = nil
+	w := httptest.NewRecorder()
+	srv.CreateJob(w, newRequest("POST", "/slicer/jobs", "slicer=slic3r&preset=hq&mesh_url="+url.QueryEscape(ts.URL+"/cube.stl")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("fetching disabled: status %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package main
+
+import "os"
+
+// fileID is not supported on this platform.
+func fileID(info os.FileInfo) (id [2]uint64, ok bool) {
+	return id, false
+}
+
+// linked is not supported on this platform.
+func linked(info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,25 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies the file described by info by its device and inode so
+// that hard links to one file can be recognized.
+func fileID(info os.FileInfo) (id [2]uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, false
+	}
+	return [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}, true
+}
+
+// linked returns true if the file described by info has other hard links.
+func linked(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Nlink > 1
+}
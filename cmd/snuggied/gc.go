@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// Retention determines how long finished jobs and their files are kept.  A
+// zero value for any limit disables it.  Jobs which have not terminated are
+// never collected.
+type Retention struct {
+	// MaxAge is the age after which finished jobs and cached results are
+	// removed.
+	MaxAge time.Duration
+
+	// UploadTTL is the time after which an upload session that has not
+	// received any data is considered abandoned and removed.
+	UploadTTL time.Duration
+
+	// MaxDisk is the number of bytes the data directory may use before the
+	// oldest cached results, and then the oldest finished jobs, are removed.
+	MaxDisk int64
+
+	// KeepLast is the number of most recent jobs kept for each terminal
+	// status.
+	KeepLast int
+}
+
+// GCReport summarizes the work done by a collection.
+type GCReport struct {
+	Jobs      int   `json:"jobs"`
+	Results   int   `json:"results"`
+	Uploads   int   `json:"uploads"`
+	Freed     int64 `json:"freed"`
+	DiskUsage int64 `json:"disk_usage"`
+}
+
+// Collector removes jobs and files from a SnuggieServer according to a
+// retention policy.
+type Collector struct {
+	Srv       *SnuggieServer
+	Retention Retention
+	mut       sync.Mutex
+}
+
+// Run collects garbage every interval until the process exits.
+func (gc *Collector) Run(interval time.Duration) {
+	for {
+		report, err := gc.Collect()
+		if err != nil {
+			log.Printf("gc: %v", err)
+		} else {
+			logGCReport(report)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Collect removes expired jobs, cached results and abandoned uploads.
+func (gc *Collector) Collect() (*GCReport, error) {
+	gc.mut.Lock()
+	defer gc.mut.Unlock()
+
+	report := new(GCReport)
+	now := time.Now()
+	ret := gc.Retention
+
+	var jobs []*slicerjob.Job
+	err := ForEachJob(func(job *slicerjob.Job) error {
+		if job.Status.IsTerminal() {
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// jobs stored before creation times were recorded are dated now so that
+	// they expire MaxAge after an upgrade rather than at once.
+	for _, job := range jobs {
+		if job.Created.IsZero() {
+			job.Created = now
+			err := PutJob(job.ID, job)
+			if err != nil {
+				log.Printf("gc: job:%v: %v", job.ID, err)
+			}
+		}
+	}
+	sort.Sort(jobsByAge(jobs))
+
+	// expire jobs by age and by the number of newer jobs with the same status.
+	var keep []*slicerjob.Job
+	count := make(map[slicerjob.Status]int)
+	for _, job := range jobs {
+		count[job.Status]++
+		expired := ret.MaxAge > 0 && now.Sub(job.Created) > ret.MaxAge
+		if ret.KeepLast > 0 && count[job.Status] > ret.KeepLast {
+			expired = true
+		}
+		if !expired {
+			keep = append(keep, job)
+			continue
+		}
+		report.Freed += gc.removeJob(job)
+		report.Jobs++
+	}
+
+	var results []resultEntry
+	err = ForEachResult(func(key string, rec *resultRecord) error {
+		results = append(results, resultEntry{key, rec})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(resultsByAge(results))
+	var keepResults []resultEntry
+	for _, r := range results {
+		if ret.MaxAge > 0 && now.Sub(r.rec.Created) > ret.MaxAge {
+			report.Freed += gc.removeResult(r.key, r.rec)
+			report.Results++
+			continue
+		}
+		keepResults = append(keepResults, r)
+	}
+
+	var uploads []*slicerjob.Upload
+	err = ForEachUpload(func(upload *slicerjob.Upload) error {
+		uploads = append(uploads, upload)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, upload := range uploads {
+		// the upload file's modification time is that of the last chunk
+		// received.
+		stat, err := os.Stat(gc.Srv.uploadPath(upload.ID))
+		if err == nil && (ret.UploadTTL <= 0 || now.Sub(stat.ModTime()) <= ret.UploadTTL) {
+			continue
+		}
+		if err == nil {
+			report.Freed += stat.Size()
+		}
+		log.Printf("gc: removing upload:%v", upload.ID)
+		gc.Srv.removeUpload(upload.ID)
+		report.Uploads++
+	}
+
+	// when the disk limit is exceeded remove cached results first because
+	// they are only an optimization.  then remove the oldest jobs.
+	report.DiskUsage, err = diskUsage(gc.Srv.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	for ret.MaxDisk > 0 && report.DiskUsage > ret.MaxDisk && len(keepResults) > 0 {
+		r := keepResults[len(keepResults)-1]
+		keepResults = keepResults[:len(keepResults)-1]
+		freed := gc.removeResult(r.key, r.rec)
+		report.Freed += freed
+		report.DiskUsage -= freed
+		report.Results++
+	}
+	for ret.MaxDisk > 0 && report.DiskUsage > ret.MaxDisk && len(keep) > 0 {
+		job := keep[len(keep)-1]
+		keep = keep[:len(keep)-1]
+		freed := gc.removeJob(job)
+		report.Freed += freed
+		report.DiskUsage -= freed
+		report.Jobs++
+	}
+
+	gc.Srv.metrics.measuredDisk(report.DiskUsage, time.Now())
+	return report, nil
+}
+
+// removeJob deletes job from the database along with its G-code and its
+// reference to the stored mesh.  The number of bytes freed is returned.
+func (gc *Collector) removeJob(job *slicerjob.Job) (freed int64) {
+	log.Printf("gc: removing job:%v status:%v created:%v", job.ID, job.Status, job.Created.Format(time.RFC3339))
+	gcode, err := ViewGCodeFile(job.ID)
+	if err == nil && gcode != "" {
+		freed += removeFile(gcode)
+		freed += removeFile(gcode + ".gz")
+	}
+	err = DeleteGCodeFile(job.ID)
+	if err != nil {
+		log.Printf("gc: job:%v gcode: %v", job.ID, err)
+	}
+	orig, err := ViewOriginalGCodeFile(job.ID)
+	if err == nil && orig != "" {
+		freed += removeFile(orig)
+	}
+	err = DeleteOriginalGCodeFile(job.ID)
+	if err != nil {
+		log.Printf("gc: job:%v original gcode: %v", job.ID, err)
+	}
+	err = DeleteLayers(job.ID)
+	if err != nil {
+		log.Printf("gc: job:%v layers: %v", job.ID, err)
+	}
+	err = DeleteMeshFile(job.ID)
+	if err != nil {
+		log.Printf("gc: job:%v mesh: %v", job.ID, err)
+	}
+	if job.MeshSHA256 != "" {
+		rec, _ := ViewMesh(job.MeshSHA256)
+		err = ReleaseMesh(job.MeshSHA256)
+		if err != nil {
+			log.Printf("gc: job:%v mesh: %v", job.ID, err)
+		} else if rec != nil && rec.Refs == 1 {
+			freed += rec.Size
+		}
+	}
+	err = DeleteJob(job.ID)
+	if err != nil {
+		log.Printf("gc: job:%v: %v", job.ID, err)
+	}
+	return freed
+}
+
+// removeResult deletes a cached result and its G-code file.  Jobs which were
+// completed using the result have their own link to the G-code and keep it.
+func (gc *Collector) removeResult(key string, rec *resultRecord) (freed int64) {
+	log.Printf("gc: removing cached result:%v created:%v", key, rec.Created.Format(time.RFC3339))
+	err := DeleteResult(key)
+	if err != nil {
+		log.Printf("gc: result:%v: %v", key, err)
+		return 0
+	}
+	freed = removeFile(rec.Path) + removeFile(rec.Path+".gz")
+	if rec.Original != "" {
+		freed += removeFile(rec.Original)
+	}
+	return freed
+}
+
+// removeFile removes the file at path and returns the number of bytes freed,
+// which is zero if the file has other hard links.
+func removeFile(path string) int64 {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	err = os.Remove(path)
+	if err != nil {
+		log.Printf("gc: %v", err)
+		return 0
+	}
+	if linked(stat) {
+		return 0
+	}
+	return stat.Size()
+}
+
+// diskUsage returns the total size of the regular files in dir.  Files with
+// several hard links, like cached G-code, are counted once where the platform
+// allows it.
+func diskUsage(dir string) (int64, error) {
+	var total int64
+	seen := make(map[[2]uint64]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if id, ok := fileID(info); ok {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+func logGCReport(report *GCReport) {
+	log.Printf("gc: removed jobs:%d results:%d uploads:%d freed:%d disk:%d",
+		report.Jobs, report.Results, report.Uploads, report.Freed, report.DiskUsage)
+}
+
+// PostGC runs a collection and responds with its report.
+func (srv *SnuggieServer) PostGC(w http.ResponseWriter, r *http.Request) {
+	if srv.GC == nil {
+		http.Error(w, "garbage collection is not configured", http.StatusNotFound)
+		return
+	}
+	report, err := srv.GC.Collect()
+	if err != nil {
+		http.Error(w, "gc: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logGCReport(report)
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// jobsByAge sorts jobs from newest to oldest.
+type jobsByAge []*slicerjob.Job
+
+func (s jobsByAge) Len() int           { return len(s) }
+func (s jobsByAge) Less(i, j int) bool { return s[i].Created.After(s[j].Created) }
+func (s jobsByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type resultEntry struct {
+	key string
+	rec *resultRecord
+}
+
+// resultsByAge sorts cached results from newest to oldest.
+type resultsByAge []resultEntry
+
+func (s resultsByAge) Len() int           { return len(s) }
+func (s resultsByAge) Less(i, j int) bool { return s[i].rec.Created.After(s[j].rec.Created) }
+func (s resultsByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
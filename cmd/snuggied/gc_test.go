@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// jobExists returns true if job id is in the database.
+func jobExists(id string) bool {
+	job, err := ViewJob(id)
+	return err == nil && job != nil && job.ID == id
+}
+
+func TestCollectExpired(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	now := time.Now()
+	old := addTestJob(t, srv, slicerjob.Complete, now.Add(-2*time.Hour), 10)
+	recent := addTestJob(t, srv, slicerjob.Complete, now.Add(-time.Minute), 10)
+	running := addTestJob(t, srv, slicerjob.Processing, now.Add(-2*time.Hour), 10)
+	undated := addTestJob(t, srv, slicerjob.Failed, time.Time{}, 10)
+
+	gc := &Collector{Srv: srv, Retention: Retention{MaxAge: time.Hour}}
+	report, err := gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Jobs != 1 {
+		t.Errorf("removed %d jobs, want 1", report.Jobs)
+	}
+	if jobExists(old.ID) || exists(filepath.Join(srv.DataDir, old.ID+".gcode")) {
+		t.Errorf("expired job was kept")
+	}
+	for _, job := range []*slicerjob.Job{recent, running, undated} {
+		if !jobExists(job.ID) {
+			t.Errorf("%v job was removed", job.Status)
+		}
+	}
+	job, err := ViewJob(undated.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Created.IsZero() {
+		t.Errorf("undated job was not given a creation time")
+	}
+}
+
+func TestCollectUploads(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	var uploads []*slicerjob.Upload
+	for i := 0; i < 2; i++ {
+		upload := slicerjob.NewUpload("cube.stl", 10)
+		err := PutUpload(upload.ID, upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(srv.uploadPath(upload.ID), []byte("solid"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploads = append(uploads, upload)
+	}
+	idle := time.Now().Add(-2 * time.Hour)
+	err := os.Chtimes(srv.uploadPath(uploads[0].ID), idle, idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// uploads are not subject to the job age limit.
+	gc := &Collector{Srv: srv, Retention: Retention{MaxAge: time.Minute}}
+	report, err := gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Uploads != 0 {
+		t.Errorf("removed %d uploads without an upload ttl", report.Uploads)
+	}
+
+	gc.Retention = Retention{UploadTTL: time.Hour}
+	report, err = gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Uploads != 1 || report.Freed != 5 {
+		t.Errorf("removed %d uploads freeing %d bytes, want 1 and 5", report.Uploads, report.Freed)
+	}
+	_, err = ViewUpload(uploads[0].ID)
+	if err == nil || exists(srv.uploadPath(uploads[0].ID)) {
+		t.Errorf("abandoned upload was kept")
+	}
+	_, err = ViewUpload(uploads[1].ID)
+	if err != nil || !exists(srv.uploadPath(uploads[1].ID)) {
+		t.Errorf("active upload was removed: %v", err)
+	}
+}
+
+func TestCollectKeepLast(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	now := time.Now()
+	var complete []*slicerjob.Job
+	for i := 0; i < 3; i++ {
+		complete = append(complete, addTestJob(t, srv, slicerjob.Complete, now.Add(-time.Duration(i)*time.Minute), 10))
+	}
+	failed := addTestJob(t, srv, slicerjob.Failed, now.Add(-time.Hour), 10)
+
+	gc := &Collector{Srv: srv, Retention: Retention{KeepLast: 2}}
+	_, err := gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, job := range complete {
+		if want := i < 2; jobExists(job.ID) != want {
+			t.Errorf("complete job %d exists=%v, want %v", i, !want, want)
+		}
+	}
+	if !jobExists(failed.ID) {
+		t.Errorf("only failed job was removed")
+	}
+}
+
+func TestCollectDiskLimit(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	now := time.Now()
+	older := addTestJob(t, srv, slicerjob.Complete, now.Add(-2*time.Minute), 1000)
+	newer := addTestJob(t, srv, slicerjob.Complete, now.Add(-time.Minute), 1000)
+
+	// an unrelated cached result is removed before any job.
+	cached := filepath.Join(srv.DataDir, "cache", "key.gcode")
+	err := os.MkdirAll(filepath.Dir(cached), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(cached, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutResult("key", &resultRecord{Path: cached, Size: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := diskUsage(srv.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := &Collector{Srv: srv, Retention: Retention{MaxDisk: usage - 1500}}
+	report, err := gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Results != 1 || report.Jobs != 1 {
+		t.Errorf("removed %d results and %d jobs, want 1 and 1", report.Results, report.Jobs)
+	}
+	if exists(cached) {
+		t.Errorf("cached result was kept")
+	}
+	if jobExists(older.ID) || !jobExists(newer.ID) {
+		t.Errorf("the newer job was removed before the older")
+	}
+}
+
+func TestCollectCachedJob(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	// slice a job and cache its output.
+	first := slicerjob.New()
+	first.MeshSHA256 = "mesh"
+	first.Slicer = "slic3r"
+	first.Preset = "hq"
+	key, err := srv.resultKey(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.CacheKey = key
+	path := filepath.Join(srv.DataDir, "first.gcode")
+	err = ioutil.WriteFile(path, []byte(testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.cacheResult(first, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := slicerjob.New()
+	second.MeshSHA256 = first.MeshSHA256
+	second.Slicer = first.Slicer
+	second.Preset = first.Preset
+	second, err = srv.registerJob(second, filepath.Join(srv.DataDir, "mesh.stl"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Cached || second.Status != slicerjob.Complete {
+		t.Fatalf("job was not completed from the cache: %+v", second)
+	}
+	gcode, err := ViewGCodeFile(second.ID)
+	if err != nil || gcode != filepath.Join(srv.DataDir, second.ID+".gcode") {
+		t.Errorf("job gcode %q is not the job's own file: %v", gcode, err)
+	}
+
+	// expire the cached result.  the job completed from it keeps its
+	// G-code.
+	rec, err := ViewResult(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Created = time.Now().Add(-2 * time.Hour)
+	err = PutResult(key, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := &Collector{Srv: srv, Retention: Retention{MaxAge: time.Hour}}
+	report, err := gc.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Results != 1 || report.Jobs != 0 {
+		t.Errorf("removed %d results and %d jobs, want 1 and 0", report.Results, report.Jobs)
+	}
+	gcode, err = ViewGCodeFile(second.ID)
+	if err != nil || gcode == "" {
+		t.Fatalf("job has no gcode: %v", err)
+	}
+	p, err := ioutil.ReadFile(gcode)
+	if err != nil || string(p) != testGCode {
+		t.Errorf("job gcode lost with the cached result: %v", err)
+	}
+}
+func TestRemoveJobReleasesMesh(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	gc := &Collector{Srv: srv}
+
+	var jobs []*slicerjob.Job
+	var sum, path string
+	for i := 0; i < 2; i++ {
+		var err error
+		sum, path, err = srv.storeMesh(strings.NewReader("solid cube"), ".stl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 1)
+		job.MeshSHA256 = sum
+		err = PutJob(job.ID, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	freed := gc.removeJob(jobs[0])
+	if !exists(path) {
+		t.Errorf("mesh removed with a job still referencing it")
+	}
+	if freed != 1 {
+		t.Errorf("freed %d bytes (expected only the G-code)", freed)
+	}
+	freed = gc.removeJob(jobs[1])
+	if exists(path) {
+		t.Errorf("mesh remains after its last job was removed")
+	}
+	if expect := int64(1 + len("solid cube")); freed != expect {
+		t.Errorf("freed %d bytes (expected %d)", freed, expect)
+	}
+}
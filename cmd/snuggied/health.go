@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Readiness is the response to GET /readyz.  Checks maps the name of each
+// check to "ok" or "failed".  The reasons for failures are logged rather than
+// reported because the endpoint does not require an api key.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// errNoDiskFree is returned by diskFree on platforms where the free space of
+// a filesystem cannot be determined.
+var errNoDiskFree = errors.New("free disk space is unknown on this platform")
+
+// GetHealth reports that the process is up and serving requests.
+func (srv *SnuggieServer) GetHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// GetReady reports whether the server is able to accept and slice jobs.  The
+// response status is 503 Service Unavailable if any check fails.
+func (srv *SnuggieServer) GetReady(w http.ResponseWriter, r *http.Request) {
+	ready := srv.Readiness()
+	if !ready.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(ready)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// Readiness runs the server's readiness checks.  The slicer is only run once,
+// at startup, so probes check that its binary is still present and
+// executable without running it.
+func (srv *SnuggieServer) Readiness() *Readiness {
+	ready := &Readiness{
+		Ready:  true,
+		Checks: make(map[string]string),
+	}
+	failures := make(map[string]string)
+	check := func(name string, err error) {
+		if err != nil {
+			ready.Ready = false
+			ready.Checks[name] = "failed"
+			failures[name] = err.Error()
+			return
+		}
+		ready.Checks[name] = "ok"
+	}
+	check("database", checkDB())
+	if srv.Slic3rVersion == "" || srv.Slic3rVersion == unknownVersion {
+		check("slicer", fmt.Errorf("%s did not report its version at startup", srv.Slic3r))
+	} else {
+		check("slicer", checkExecutable(srv.Slic3r))
+	}
+	if len(srv.Slic3rPresets) == 0 {
+		check("presets", fmt.Errorf("no presets are loaded"))
+	} else {
+		check("presets", nil)
+	}
+	check("data_dir", srv.checkDataDir())
+	check("consumers", srv.checkConsumers(time.Now()))
+	srv.logReadiness(failures)
+	return ready
+}
+
+// logReadiness logs the reasons readiness checks fail when they change.
+func (srv *SnuggieServer) logReadiness(failures map[string]string) {
+	srv.readyMut.Lock()
+	defer srv.readyMut.Unlock()
+	for name, msg := range failures {
+		if srv.readyFailures[name] != msg {
+			log.Printf("readyz: %s: %s", name, msg)
+		}
+	}
+	for name := range srv.readyFailures {
+		if _, ok := failures[name]; !ok {
+			log.Printf("readyz: %s: ok", name)
+		}
+	}
+	srv.readyFailures = failures
+}
+
+// checkDB returns an error if the database cannot be read.
+func checkDB() error {
+	if DB == nil {
+		return fmt.Errorf("not open")
+	}
+	return DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(b(dbJobs)) == nil {
+			return fmt.Errorf("missing bucket %q", dbJobs)
+		}
+		return nil
+	})
+}
+
+// checkDataDir returns an error if files cannot be created in srv.DataDir or
+// it has less than srv.MinFree bytes of space available.
+func (srv *SnuggieServer) checkDataDir() error {
+	f, err := ioutil.TempFile(srv.DataDir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if srv.MinFree <= 0 {
+		return nil
+	}
+	free, err := diskFree(srv.DataDir)
+	if err == errNoDiskFree {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < srv.MinFree {
+		return fmt.Errorf("%d bytes free, need %d", free, srv.MinFree)
+	}
+	return nil
+}
+
+// checkExecutable returns an error if the slicer binary bin cannot be found
+// or is not an executable file.  An empty bin is looked up as "slic3r".
+func checkExecutable(bin string) error {
+	if bin == "" {
+		bin = "slic3r"
+	}
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	// windows has no execute permission bits.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// checkConsumers returns an error if no consumer is running or one has spent
+// longer than srv.MaxJobTime on its current job, which suggests the slicer is
+// hung.
+func (srv *SnuggieServer) checkConsumers(now time.Time) error {
+	if atomic.LoadInt32(&srv.consumers) == 0 {
+		return fmt.Errorf("no consumer is running")
+	}
+	if srv.MaxJobTime <= 0 {
+		return nil
+	}
+	srv.busyMut.Lock()
+	defer srv.busyMut.Unlock()
+	for id, start := range srv.busy {
+		if d := now.Sub(start); d > srv.MaxJobTime {
+			return fmt.Errorf("job %s has been running for %v", id, d)
+		}
+	}
+	return nil
+}
+
+// consumerBusy records that a consumer started job id at start.
+func (srv *SnuggieServer) consumerBusy(id string, start time.Time) {
+	srv.busyMut.Lock()
+	defer srv.busyMut.Unlock()
+	if srv.busy == nil {
+		srv.busy = make(map[string]time.Time)
+	}
+	srv.busy[id] = start
+}
+
+// consumerIdle records that a consumer finished job id.
+func (srv *SnuggieServer) consumerIdle(id string) {
+	srv.busyMut.Lock()
+	defer srv.busyMut.Unlock()
+	delete(srv.busy, id)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Slic3r = "/nonexistent/slic3r"
+	srv.Slic3rVersion = unknownVersion
+
+	ready := srv.Readiness()
+	if ready.Ready {
+		t.Errorf("ready without a slicer or consumers")
+	}
+	want := map[string]string{
+		"database":  "ok",
+		"slicer":    "failed",
+		"presets":   "ok",
+		"data_dir":  "ok",
+		"consumers": "failed",
+	}
+	for name, status := range want {
+		if ready.Checks[name] != status {
+			t.Errorf("check %s: %q, want %q", name, ready.Checks[name], status)
+		}
+	}
+
+	// the slicer reported its version at startup but has since been removed.
+	srv.Slic3rVersion = "1.2.9"
+	srv.consumers = 1
+	ready = srv.Readiness()
+	if ready.Checks["slicer"] != "failed" {
+		t.Errorf("check slicer: %q with a missing binary", ready.Checks["slicer"])
+	}
+
+	srv.Slic3r = filepath.Join(srv.DataDir, "slic3r")
+	err := ioutil.WriteFile(srv.Slic3r, []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready = srv.Readiness()
+	if !ready.Ready {
+		t.Errorf("not ready: %v", ready.Checks)
+	}
+}
+
+func TestCheckExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows has no execute permission bits")
+	}
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	bin := filepath.Join(srv.DataDir, "slic3r")
+	err := ioutil.WriteFile(bin, []byte("#!/bin/sh\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkExecutable(bin) == nil {
+		t.Errorf("file without execute permission accepted")
+	}
+	if checkExecutable(srv.DataDir) == nil {
+		t.Errorf("directory accepted")
+	}
+}
+
+func TestReadinessStuckConsumer(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.consumers = 1
+	srv.MaxJobTime = time.Hour
+	now := time.Now()
+
+	srv.consumerBusy("a", now.Add(-30*time.Minute))
+	if err := srv.checkConsumers(now); err != nil {
+		t.Errorf("job running for 30 minutes: %v", err)
+	}
+	srv.consumerBusy("b", now.Add(-2*time.Hour))
+	if err := srv.checkConsumers(now); err == nil {
+		t.Errorf("job running for 2 hours accepted")
+	}
+	srv.consumerIdle("b")
+	if err := srv.checkConsumers(now); err != nil {
+		t.Errorf("after the stuck job finished: %v", err)
+	}
+
+	srv.MaxJobTime = 0
+	srv.consumerBusy("b", now.Add(-2*time.Hour))
+	if err := srv.checkConsumers(now); err != nil {
+		t.Errorf("unchecked job time: %v", err)
+	}
+}
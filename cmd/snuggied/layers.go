@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+)
+
+// GetLayers responds with the layer index of the G-code for job id.
+func (srv *SnuggieServer) GetLayers(w http.ResponseWriter, r *http.Request, id string) {
+	layers, err := srv.lookupLayers(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = json.NewEncoder(w).Encode(layers)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// GetLayer responds with the G-code of a single layer.  Layers are numbered
+// from zero.  A layer number followed by ".svg" requests a drawing of the
+// layer.
+func (srv *SnuggieServer) GetLayer(w http.ResponseWriter, r *http.Request, id, n string) {
+	if strings.HasSuffix(n, ".svg") {
+		srv.GetLayerSVG(w, r, id, strings.TrimSuffix(n, ".svg"))
+		return
+	}
+	layer, f, err := srv.openLayer(id, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", time.Time{}, io.NewSectionReader(f, layer.Offset, layer.Length))
+}
+
+// GetLayerSVG responds with an SVG drawing of the toolpaths in a single layer.
+// Travel moves are drawn unless the query parameter "travel" is 0.  All layers
+// of a job are drawn at the same scale.
+func (srv *SnuggieServer) GetLayerSVG(w http.ResponseWriter, r *http.Request, id, n string) {
+	layer, f, err := srv.openLayer(id, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	opts := &gcode.SVGOptions{Travel: r.FormValue("travel") != "0"}
+	job, err := ViewJob(id)
+	if err == nil && job.Stats != nil {
+		opts.Extents = job.Stats.Extents
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	err = gcode.RenderLayerSVG(w, f, *layer, opts)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+func (srv *SnuggieServer) lookupLayers(id string) ([]gcode.Layer, error) {
+	layers, err := ViewLayers(id)
+	if err != nil {
+		return nil, err
+	}
+	if layers == nil {
+		return nil, errNoLayers
+	}
+	return layers, nil
+}
+
+// openLayer opens the G-code file for job id and returns layer n.  The caller
+// must close the returned file.
+func (srv *SnuggieServer) openLayer(id, n string) (*gcode.Layer, *os.File, error) {
+	i, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, nil, errUnknownLayer
+	}
+	layers, err := srv.lookupLayers(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if i < 0 || i >= len(layers) {
+		return nil, nil, errUnknownLayer
+	}
+	path, err := ViewGCodeFile(id)
+	if err != nil || path == "" {
+		return nil, nil, errNoLayers
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &layers[i], f, nil
+}
+
+var (
+	errNoLayers     = errors.New("no layer index for job")
+	errUnknownLayer = errors.New("unknown layer")
+)
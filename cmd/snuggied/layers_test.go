@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// addIndexedJob stores a job whose G-code is testGCode and has been analyzed
+// as when it completed.
+func addIndexedJob(t *testing.T, srv *SnuggieServer) *slicerjob.Job {
+	job := addGCodeJob(t, srv)
+	path, err := ViewGCodeFile(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.inspectGCode(job, path)
+	err = PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func getLayers(srv *SnuggieServer, id, sub string, header ...string) *httptest.ResponseRecorder {
+	r := newRequest("GET", "/slicer/gcodes/"+id+"/"+sub, "")
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	srv.GetGCode(w, r)
+	return w
+}
+
+func TestGetLayers(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addIndexedJob(t, srv)
+
+	w := getLayers(srv, job.ID, "layers")
+	if w.Code != http.StatusOK {
+		t.Fatalf("layers: status %d %s", w.Code, w.Body)
+	}
+	var layers []gcode.Layer
+	err := json.NewDecoder(w.Body).Decode(&layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 || layers[0].Z != 0.2 || layers[1].Z != 0.4 {
+		t.Fatalf("layers: %+v", layers)
+	}
+
+	for i, layer := range layers {
+		w = getLayers(srv, job.ID, "layers/"+strconv.Itoa(i))
+		expect := testGCode[layer.Offset : layer.Offset+layer.Length]
+		if w.Code != http.StatusOK || w.Body.String() != expect {
+			t.Errorf("layer %d: status %d %q (expected %q)", i, w.Code, w.Body, expect)
+		}
+	}
+	if w := getLayers(srv, job.ID, "layers/1"); !strings.Contains(w.Body.String(), "X20 Y20") {
+		t.Errorf("layer 1: %q", w.Body)
+	}
+
+	// layers are served as byte ranges of the G-code and support range
+	// requests.
+	w = getLayers(srv, job.ID, "layers/1", "Range", "bytes=0-3")
+	if w.Code != http.StatusPartialContent || w.Body.String() != testGCode[layers[1].Offset:layers[1].Offset+4] {
+		t.Errorf("layer range: status %d %q", w.Code, w.Body)
+	}
+}
+
+func TestGetLayerSVG(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addIndexedJob(t, srv)
+
+	w := getLayers(srv, job.ID, "layers/0.svg")
+	if w.Code != http.StatusOK {
+		t.Fatalf("svg: status %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "image/svg+xml" || !strings.Contains(w.Body.String(), "<svg") {
+		t.Errorf("svg: %s %q", w.Header().Get("Content-Type"), w.Body)
+	}
+	travel := w.Body.Len()
+	w = getLayers(srv, job.ID, "layers/0.svg?travel=0")
+	if w.Code != http.StatusOK || w.Body.Len() >= travel {
+		t.Errorf("svg without travel: status %d, %d bytes (with travel %d)", w.Code, w.Body.Len(), travel)
+	}
+}
+
+func TestGetLayerNotFound(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addIndexedJob(t, srv)
+	unindexed := addGCodeJob(t, srv)
+
+	for _, test := range []struct {
+		id, sub string
+	}{
+		{job.ID, "layers/2"},
+		{job.ID, "layers/-1"},
+		{job.ID, "layers/x"},
+		{job.ID, "layers/2.svg"},
+		{job.ID, "layers/x.svg"},
+		{unindexed.ID, "layers"},
+		{unindexed.ID, "layers/0"},
+		{"unknown", "layers"},
+	} {
+		w := getLayers(srv, test.id, test.sub)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s/%s: status %d (expected %d)", test.id, test.sub, w.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storeMesh writes the content of meshfile to the mesh store, where files are
+// named by the SHA-256 hash of their content.  If the content is already
+// stored the existing file is reused.  The caller holds a reference to the
+// mesh and must release it with ReleaseMesh when it is no longer needed.
+func (srv *SnuggieServer) storeMesh(meshfile io.Reader, ext string) (sum, path string, err error) {
+	dir := filepath.Join(srv.DataDir, "meshes")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", "", err
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return "", "", fmt.Errorf("create: %v", err)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), meshfile)
+	errclose := tmp.Close()
+	if err == nil {
+		err = errclose
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("write: %v", err)
+	}
+
+	sum = hex.EncodeToString(h.Sum(nil))
+	path = filepath.Join(dir, sum+strings.ToLower(ext))
+	path, err = PutMesh(sum, tmp.Name(), path, n)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return sum, path, nil
+}
+
+// derivedMeshFile returns the path of a file derived from the mesh at path,
+// such as a thumbnail, which is named by adding suffix to the mesh's name.  If
+// the file does not exist it is written by create.  Derived files are removed
+// with the mesh by ReleaseMesh.
+func derivedMeshFile(path, suffix string, create func(w io.Writer) error) (string, error) {
+	derived := path + "." + suffix
+	_, err := os.Stat(derived)
+	if err == nil {
+		return derived, nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return "", fmt.Errorf("create: %v", err)
+	}
+	err = create(tmp)
+	errclose := tmp.Close()
+	if err == nil {
+		err = errclose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), derived)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return derived, nil
+}
+
+// removeDerivedMeshFiles removes the files derived from the mesh at path.
+func removeDerivedMeshFiles(path string) {
+	derived, _ := filepath.Glob(path + ".*")
+	for _, p := range derived {
+		os.Remove(p)
+	}
+}
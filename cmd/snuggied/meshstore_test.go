@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// meshRefs returns the number of references to the stored mesh sum, or -1 if
+// it is not stored.
+func meshRefs(t *testing.T, sum string) int {
+	refs := -1
+	err := DB.View(func(tx *bolt.Tx) error {
+		p := tx.Bucket(b(dbMeshes)).Get(b(sum))
+		if p == nil {
+			return nil
+		}
+		var rec meshRecord
+		err := json.Unmarshal(p, &rec)
+		refs = rec.Refs
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+func TestStoreMeshDedup(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	sum, path, err := srv.storeMesh(strings.NewReader("solid cube"), ".STL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum2, path2, err := srv.storeMesh(strings.NewReader("solid cube"), ".stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum2 != sum || path2 != path {
+		t.Errorf("second store: %s %s (expected %s %s)", sum2, path2, sum, path)
+	}
+	if !strings.HasSuffix(path, sum+".stl") {
+		t.Errorf("path: %s", path)
+	}
+	if refs := meshRefs(t, sum); refs != 2 {
+		t.Errorf("refs: %d (expected 2)", refs)
+	}
+
+	other, _, err := srv.storeMesh(strings.NewReader("solid sphere"), ".stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == sum {
+		t.Errorf("different meshes have the same hash %s", sum)
+	}
+
+	_, err = AcquireMesh("0000")
+	if err == nil {
+		t.Errorf("acquired an unknown mesh")
+	}
+	_, err = AcquireMesh(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := meshRefs(t, sum); refs != 3 {
+		t.Errorf("refs after acquire: %d (expected 3)", refs)
+	}
+}
+
+func TestPutMeshRenameError(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	tmp := filepath.Join(srv.DataDir, "tmp-mesh")
+	err := ioutil.WriteFile(tmp, []byte("solid cube"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = PutMesh("acfe", tmp, filepath.Join(srv.DataDir, "missing", "acfe.stl"), 10)
+	if err == nil {
+		t.Fatalf("mesh stored in a missing directory")
+	}
+	if refs := meshRefs(t, "acfe"); refs != -1 {
+		t.Errorf("mesh which could not be stored was recorded with %d refs", refs)
+	}
+}
+
+func TestStoreMeshConcurrent(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	// meshes repeatedly stored and released concurrently must never be
+	// recorded without their file.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				sum, path, err := srv.storeMesh(strings.NewReader("solid cube"), ".stl")
+				if err == nil && !exists(path) {
+					err = fmt.Errorf("stored mesh %s does not exist", path)
+				}
+				if err == nil {
+					err = ReleaseMesh(sum)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(srv.DataDir, "meshes", "*"))
+	if len(files) != 0 {
+		t.Errorf("files remain after all meshes were released: %q", files)
+	}
+}
+
+func TestReleaseMesh(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	sum, path, err := srv.storeMesh(strings.NewReader("solid cube"), ".stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AcquireMesh(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := derivedMeshFile(path, "view.stl", func(w io.Writer) error {
+		_, err := io.WriteString(w, "solid cube")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ReleaseMesh(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(path) || !exists(derived) {
+		t.Errorf("mesh removed while referenced")
+	}
+	if refs := meshRefs(t, sum); refs != 1 {
+		t.Errorf("refs: %d (expected 1)", refs)
+	}
+
+	err = ReleaseMesh(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(path) || exists(derived) {
+		t.Errorf("unreferenced mesh files remain")
+	}
+	if refs := meshRefs(t, sum); refs != -1 {
+		t.Errorf("refs: %d (expected the mesh to be removed)", refs)
+	}
+	err = ReleaseMesh(sum)
+	if err != nil {
+		t.Errorf("release of removed mesh: %v", err)
+	}
+}
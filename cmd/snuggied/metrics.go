@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// QueueStats is implemented by schedulers which can report the number of
+// jobs they are running and holding in their queue.
+type QueueStats interface {
+	QueueStats() (running, queued int)
+}
+
+// Histogram bucket upper bounds for slice durations, in seconds, and upload
+// sizes, in bytes.
+var (
+	sliceDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+	uploadSizeBuckets    = []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}
+)
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	mut    sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe adds v to the histogram.
+func (h *histogram) Observe(v float64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatMetric(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatMetric(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// outcome identifies a counter of finished jobs.
+type outcome struct {
+	Status  string
+	Preset  string
+	Backend string
+}
+
+type outcomesByLabel []outcome
+
+func (s outcomesByLabel) Len() int { return len(s) }
+func (s outcomesByLabel) Less(i, j int) bool {
+	if s[i].Status != s[j].Status {
+		return s[i].Status < s[j].Status
+	}
+	if s[i].Preset != s[j].Preset {
+		return s[i].Preset < s[j].Preset
+	}
+	return s[i].Backend < s[j].Backend
+}
+func (s outcomesByLabel) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// serverMetrics records events which cannot be computed from the database
+// when metrics are collected.  A nil *serverMetrics records nothing.
+type serverMetrics struct {
+	SliceDuration *histogram
+	UploadSize    *histogram
+
+	mut      sync.Mutex
+	outcomes map[outcome]int64
+
+	// diskBytes is the size of the data directory measured at diskTime.
+	diskMut   sync.Mutex
+	diskBytes int64
+	diskTime  time.Time
+}
+
+// diskUsageMaxAge is how long a measurement of the data directory is reported
+// before the directory is walked again.
+const diskUsageMaxAge = time.Minute
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		SliceDuration: newHistogram(sliceDurationBuckets),
+		UploadSize:    newHistogram(uploadSizeBuckets),
+		outcomes:      make(map[outcome]int64),
+	}
+}
+
+// jobFinished counts a job which has terminated.
+func (m *serverMetrics) jobFinished(job *slicerjob.Job) {
+	if m == nil {
+		return
+	}
+	key := outcome{job.Status.String(), job.Preset, job.Slicer}
+	m.mut.Lock()
+	m.outcomes[key]++
+	m.mut.Unlock()
+}
+
+func (m *serverMetrics) sliced(seconds float64) {
+	if m != nil {
+		m.SliceDuration.Observe(seconds)
+	}
+}
+
+func (m *serverMetrics) uploaded(n int64) {
+	if m != nil {
+		m.UploadSize.Observe(float64(n))
+	}
+}
+
+// diskUsage returns the size of dir, walking it only if it was not measured
+// in the last diskUsageMaxAge.
+func (m *serverMetrics) diskUsage(dir string, now time.Time) (int64, error) {
+	if m == nil {
+		return diskUsage(dir)
+	}
+	m.diskMut.Lock()
+	defer m.diskMut.Unlock()
+	if !m.diskTime.IsZero() && now.Sub(m.diskTime) < diskUsageMaxAge {
+		return m.diskBytes, nil
+	}
+	n, err := diskUsage(dir)
+	if err != nil {
+		return 0, err
+	}
+	m.diskBytes, m.diskTime = n, now
+	return n, nil
+}
+
+// measuredDisk records n, the size of the data directory measured at now by
+// the garbage collector.
+func (m *serverMetrics) measuredDisk(n int64, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.diskMut.Lock()
+	m.diskBytes, m.diskTime = n, now
+	m.diskMut.Unlock()
+}
+
+func (m *serverMetrics) writeOutcomes(w io.Writer, name, help string) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	keys := make(outcomesByLabel, 0, len(m.outcomes))
+	for k := range m.outcomes {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{status=\"%s\",preset=\"%s\",backend=\"%s\"} %d\n", name,
+			escapeLabel(k.Status), escapeLabel(k.Preset), escapeLabel(k.Backend), m.outcomes[k])
+	}
+}
+
+// GetMetrics reports the server's metrics in the Prometheus text format.
+func (srv *SnuggieServer) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	metric := func(name, typ, help string, v float64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatMetric(v))
+	}
+
+	if q, ok := srv.S.(QueueStats); ok {
+		running, queued := q.QueueStats()
+		metric("snuggied_queue_depth", "gauge", "Number of jobs waiting to be sliced.", float64(queued))
+		metric("snuggied_jobs_running", "gauge", "Number of jobs being sliced.", float64(running))
+	}
+	if srv.metrics != nil {
+		srv.metrics.writeOutcomes(&buf, "snuggied_jobs_finished_total", "Number of jobs which have terminated, by status, preset and backend.")
+		srv.metrics.SliceDuration.write(&buf, "snuggied_slice_duration_seconds", "Time taken to slice and post-process meshes.")
+		srv.metrics.UploadSize.write(&buf, "snuggied_upload_size_bytes", "Size of mesh files received.")
+	}
+
+	stats, err := srv.CacheStats()
+	if err != nil {
+		log.Printf("metrics: cache: %v", err)
+	} else {
+		metric("snuggied_cache_hits_total", "counter", "Number of jobs completed from the result cache.", float64(stats.Hits))
+		metric("snuggied_cache_misses_total", "counter", "Number of jobs not found in the result cache.", float64(stats.Misses))
+		metric("snuggied_cache_bypassed_total", "counter", "Number of jobs which did not use the result cache.", float64(stats.Bypassed))
+		metric("snuggied_cache_hit_ratio", "gauge", "Fraction of cache lookups which were hits.", stats.HitRate)
+		metric("snuggied_cache_entries", "gauge", "Number of results in the cache.", float64(stats.Entries))
+		metric("snuggied_cache_bytes", "gauge", "Size of the results in the cache.", float64(stats.Bytes))
+	}
+
+	usage, err := srv.metrics.diskUsage(srv.DataDir, time.Now())
+	if err != nil {
+		log.Printf("metrics: disk usage: %v", err)
+	} else {
+		metric("snuggied_data_dir_bytes", "gauge", "Disk space used by the data directory.", float64(usage))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
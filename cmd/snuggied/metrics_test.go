@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+func queueStats(t *testing.T, q *MemQueue, running, queued int) {
+	r, n := q.QueueStats()
+	if r != running || n != queued {
+		t.Errorf("running:%d queued:%d (expected running:%d queued:%d)", r, n, running, queued)
+	}
+}
+
+func TestMemQueueStats(t *testing.T) {
+	q := MemoryQueue(nil)
+	for _, id := range []string{"a", "b", "c"} {
+		err := q.ScheduleSliceJob(id, "file:///mesh.stl", "slic3r", "hq", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	queueStats(t, q, 0, 3)
+
+	// a cancelled job leaves the queue immediately.
+	q.CancelSliceJob("a")
+	queueStats(t, q, 0, 2)
+
+	job, err := q.NextSliceJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "b" {
+		t.Errorf("next job %v (expected b)", job.ID)
+	}
+	queueStats(t, q, 1, 1)
+
+	// a running job which is cancelled runs until its consumer stops it.
+	q.CancelSliceJob("b")
+	q.CancelSliceJob("b")
+	queueStats(t, q, 1, 1)
+	job.Done("", fmt.Errorf("cancelled"))
+	queueStats(t, q, 0, 1)
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	h.Observe(0.5)
+	h.Observe(5)
+	h.Observe(50)
+	var buf bytes.Buffer
+	h.write(&buf, "x", "help")
+	expect := `# HELP x help
+# TYPE x histogram
+x_bucket{le="1"} 1
+x_bucket{le="10"} 2
+x_bucket{le="+Inf"} 3
+x_sum 55.5
+x_count 3
+`
+	if buf.String() != expect {
+		t.Errorf("histogram:\n%s\nexpected:\n%s", buf.String(), expect)
+	}
+}
+
+// finishedCount returns the number of jobs counted by m with status.
+func finishedCount(m *serverMetrics, status slicerjob.Status) int64 {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	var n int64
+	for k, v := range m.outcomes {
+		if k.Status == status.String() {
+			n += v
+		}
+	}
+	return n
+}
+
+func TestJobDoneCancelled(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.metrics = newServerMetrics()
+	srv.S = MemoryQueue(nil)
+
+	for _, done := range []error{nil, fmt.Errorf("slic3r failed")} {
+		job := addTestJob(t, srv, slicerjob.Processing, time.Now(), 10)
+		path, err := ViewGCodeFile(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		srv.DeleteJob(w, newRequest("DELETE", "/slicer/jobs/"+job.ID, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete: status %d %s", w.Code, w.Body)
+		}
+
+		// the consumer finishes the job after it was cancelled.
+		srv.JobDone(job.ID, path, done)
+		job, err = ViewJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != slicerjob.Cancelled {
+			t.Errorf("done:%v status %v (expected %v)", done, job.Status, slicerjob.Cancelled)
+		}
+
+		// cancelling again does not count the job twice.
+		w = httptest.NewRecorder()
+		srv.DeleteJob(w, newRequest("DELETE", "/slicer/jobs/"+job.ID, ""))
+	}
+	if n := finishedCount(srv.metrics, slicerjob.Cancelled); n != 2 {
+		t.Errorf("cancelled jobs counted %d times (expected 2)", n)
+	}
+	for _, status := range []slicerjob.Status{slicerjob.Complete, slicerjob.Failed} {
+		if n := finishedCount(srv.metrics, status); n != 0 {
+			t.Errorf("%v jobs counted %d times (expected 0)", status, n)
+		}
+	}
+}
+
+// metricValue returns the value of the sample named name in the metrics
+// returned by srv.
+func metricValue(t *testing.T, srv *SnuggieServer, name string) string {
+	w := httptest.NewRecorder()
+	srv.GetMetrics(w, newRequest("GET", "/metrics", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics: status %d", w.Code)
+	}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			return strings.TrimPrefix(line, name+" ")
+		}
+	}
+	t.Errorf("metrics: %s not found", name)
+	return ""
+}
+
+func TestGetMetrics(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.metrics = newServerMetrics()
+	q := MemoryQueue(nil)
+	srv.S = q
+	err := q.ScheduleSliceJob("a", "file:///mesh.stl", "slic3r", "hq", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.metrics.uploaded(2048)
+
+	if v := metricValue(t, srv, "snuggied_queue_depth"); v != "1" {
+		t.Errorf("queue depth: %s (expected 1)", v)
+	}
+	if v := metricValue(t, srv, "snuggied_jobs_running"); v != "0" {
+		t.Errorf("jobs running: %s (expected 0)", v)
+	}
+	if v := metricValue(t, srv, "snuggied_upload_size_bytes_count"); v != "1" {
+		t.Errorf("uploads: %s (expected 1)", v)
+	}
+
+	// the data directory is not walked on every request.
+	usage := metricValue(t, srv, "snuggied_data_dir_bytes")
+	err = ioutil.WriteFile(filepath.Join(srv.DataDir, "new.gcode"), make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := metricValue(t, srv, "snuggied_data_dir_bytes"); v != usage {
+		t.Errorf("data dir bytes: %s (expected cached %s)", v, usage)
+	}
+	srv.metrics.measuredDisk(12345, time.Now())
+	if v := metricValue(t, srv, "snuggied_data_dir_bytes"); v != "12345" {
+		t.Errorf("data dir bytes: %s (expected 12345)", v)
+	}
+	srv.metrics.measuredDisk(12345, time.Now().Add(-2*diskUsageMaxAge))
+	if v := metricValue(t, srv, "snuggied_data_dir_bytes"); v == "12345" {
+		t.Errorf("data dir bytes: stale measurement reported")
+	}
+}
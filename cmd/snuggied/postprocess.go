@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+)
+
+// parseProcessors parses post-processor specs given for a job.
+func parseProcessors(specs []string) ([]gcode.Processor, error) {
+	var procs []gcode.Processor
+	for _, spec := range specs {
+		proc, err := gcode.ParseProcessor(spec)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, proc)
+	}
+	return procs, nil
+}
+
+// postProcess runs the G-code at in through procs, in order, and writes the
+// result to out.  Intermediate results are written to temporary files in the
+// same directory as out.
+func postProcess(out, in string, procs []gcode.Processor) error {
+	src := in
+	for i, proc := range procs {
+		tmp, err := ioutil.TempFile(filepath.Dir(out), "postprocess-")
+		if err != nil {
+			return err
+		}
+		err = runProcessor(proc, tmp, src)
+		errclose := tmp.Close()
+		if err == nil {
+			err = errclose
+		}
+		if src != in {
+			os.Remove(src)
+		}
+		src = tmp.Name()
+		if err != nil {
+			os.Remove(src)
+			return fmt.Errorf("processor %d: %v", i, err)
+		}
+	}
+	if src == in {
+		return copyFile(out, in)
+	}
+	return os.Rename(src, out)
+}
+
+// reportProcessors records the results of processors which report them on
+// job id.
+func (srv *SnuggieServer) reportProcessors(id string, procs []gcode.Processor) {
+	var arcs *gcode.ArcStats
+	for _, proc := range procs {
+		if a, ok := proc.(*gcode.ArcFitter); ok {
+			stats := a.Stats
+			arcs = &stats
+		}
+	}
+	if arcs == nil {
+		return
+	}
+	job, err := ViewJob(id)
+	if err != nil {
+		log.Printf("postprocess job:%v err:%v", id, err)
+		return
+	}
+	job.ArcFit = arcs
+	err = PutJob(id, job)
+	if err != nil {
+		log.Printf("postprocess job:%v err:%v", id, err)
+	}
+}
+
+func runProcessor(proc gcode.Processor, w *os.File, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return proc.Process(w, f)
+}
+
+// GetOriginalGCode serves the G-code for job id as it was produced by the
+// slicer, before post-processing.
+func (srv *SnuggieServer) GetOriginalGCode(w http.ResponseWriter, r *http.Request, id string) {
+	path, err := ViewOriginalGCodeFile(id)
+	if err != nil || path == "" {
+		path, err = ViewGCodeFile(id)
+	}
+	if err != nil || path == "" {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCreateJobPostProcess(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	for _, spec := range []string{
+		"bogus",
+		"prepend=rm -rf /",
+		`append=M84\nshutdown now`,
+		"prepend=" + strings.Repeat("M117 hello\n", 400),
+	} {
+		w := httptest.NewRecorder()
+		form := "slicer=slic3r&preset=hq&mesh_sha256=acfe&postprocess=" + url.QueryEscape(spec)
+		srv.CreateJob(w, newRequest("POST", "/slicer/jobs", form))
+		if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Body.String(), "postprocess: ") {
+			t.Errorf("%.20q: status %d %s", spec, w.Code, w.Body)
+		}
+	}
+}
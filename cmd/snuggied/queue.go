@@ -7,10 +7,11 @@ import (
 )
 
 // Scheduler is the write-end of a job queue.  It takes a mesh file url, the
-// name of a slicer and a preset for that slicer.  Scheduler is responsible for
-// routing the job to a machine capable of servicing the request.
+// name of a slicer, a preset for that slicer and a list of post-processors to
+// run on the output.  Scheduler is responsible for routing the job to a
+// machine capable of servicing the request.
 type Scheduler interface {
-	ScheduleSliceJob(id, meshurl, slicer, preset string) error
+	ScheduleSliceJob(id, meshurl, slicer, preset string, post []string) error
 	CancelSliceJob(id string)
 }
 
@@ -28,6 +29,10 @@ type Job struct {
 	Slicer  string
 	Preset  string
 
+	// PostProcess contains specs for the processors run on the sliced
+	// G-code, in order.  See gcode.ParseProcessor.
+	PostProcess []string
+
 	// Cancel receives a value if the job has been cancelled by the scheduling
 	// process.
 	Cancel <-chan error
@@ -48,10 +53,12 @@ type MemQueue struct {
 	cond    sync.Cond
 	jobs    []*memJob
 	db      map[string]*memJob
+	running int
 }
 
 var _ Scheduler = new(MemQueue)
 var _ Consumer = new(MemQueue)
+var _ QueueStats = new(MemQueue)
 
 // MemoryQueue allocates and initializes a new MemQueue.  The function argument
 // is called when consumers finish work on a job.
@@ -66,20 +73,29 @@ func MemoryQueue(done func(id, path string, err error)) *MemQueue {
 func (q *MemQueue) jobTerminated(id string) {
 	q.cond.L.Lock()
 	delete(q.db, id)
-	qlen := len(q.jobs)
-	dblen := len(q.db)
+	q.running--
+	running, qlen := q.running, len(q.jobs)
 	q.cond.L.Unlock()
-	log.Printf("jobs running:%d queued:%d", dblen-qlen, qlen)
+	log.Printf("jobs running:%d queued:%d", running, qlen)
+}
+
+// QueueStats returns the number of jobs being processed by consumers and the
+// number of jobs waiting in q.
+func (q *MemQueue) QueueStats() (running, queued int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.running, len(q.jobs)
 }
 
 // ScheduleSliceJob enqueues a job in q.
-func (q *MemQueue) ScheduleSliceJob(id, meshurl, slicer, preset string) error {
+func (q *MemQueue) ScheduleSliceJob(id, meshurl, slicer, preset string, post []string) error {
 	j := &memJob{
 		ID:       id,
 		NodeID:   q.NodeID,
 		Location: meshurl,
 		Slicer:   slicer,
 		Preset:   preset,
+		Post:     post,
 		Cancel:   make(chan error, 1),
 		Done:     make(chan struct{}),
 		Fin: func(id, path string, err error) {
@@ -95,23 +111,27 @@ func (q *MemQueue) ScheduleSliceJob(id, meshurl, slicer, preset string) error {
 	q.cond.L.Lock()
 	q.jobs = append(q.jobs, j)
 	q.db[j.ID] = j
-	qlen := len(q.jobs)
-	dblen := len(q.db)
+	running, qlen := q.running, len(q.jobs)
 	q.cond.Signal()
 	q.cond.L.Unlock()
-	log.Printf("jobs running:%d queued:%d", dblen-qlen, qlen)
+	log.Printf("jobs running:%d queued:%d", running, qlen)
 
 	return nil
 }
 
-// BUG:
-// CancelSliceJob can temporarily skew the count of queued jobs because pending
-// jobs are not removed from the queue immediately on cancellation.
+// CancelSliceJob cancels job id.  A job waiting in q is removed from the
+// queue; a running job is stopped by its consumer.
 func (q *MemQueue) CancelSliceJob(id string) {
 	q.cond.L.Lock()
 	if j := q.db[id]; j != nil {
 		j.Cancel <- fmt.Errorf("the job was cancelled")
 		delete(q.db, id)
+		for i := range q.jobs {
+			if q.jobs[i] == j {
+				q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+				break
+			}
+		}
 	}
 	q.cond.L.Unlock()
 }
@@ -122,25 +142,20 @@ func (q *MemQueue) NextSliceJob() (*Job, error) {
 	for len(q.jobs) == 0 {
 		q.cond.Wait()
 	}
+	// cancelled jobs are removed from the queue so j will run.  the
+	// consumer stops j if it is cancelled while running.
 	j := q.jobs[0]
 	q.jobs = q.jobs[1:]
-	qlen := len(q.jobs)
-	dblen := len(q.db)
+	q.running++
+	running, qlen := q.running, len(q.jobs)
 	q.cond.L.Unlock()
 
-	select {
-	case <-j.Cancel:
-		// the job was cancelled previously get another job
-		return q.NextSliceJob()
-	default:
-	}
-
 	go func() {
 		if q.Started != nil {
 			q.Started(j.ID)
 		}
 	}()
-	log.Printf("jobs running:%d queued:%d", dblen-qlen, qlen)
+	log.Printf("jobs running:%d queued:%d", running, qlen)
 
 	return j.Job(), nil
 }
@@ -151,6 +166,7 @@ type memJob struct {
 	Location string
 	Slicer   string
 	Preset   string
+	Post     []string
 	Cancel   chan error
 	Done     chan struct{}
 	Fin      func(string, string, error)
@@ -164,6 +180,8 @@ func (m *memJob) Job() *Job {
 		Slicer:  m.Slicer,
 		Preset:  m.Preset,
 		Cancel:  m.Cancel,
+
+		PostProcess: m.Post,
 		Done: func(path string, err error) {
 			close(m.Done)
 			m.Fin(m.ID, path, err)
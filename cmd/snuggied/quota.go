@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// Quota limits the resources used by each api key.  A zero value for any
+// limit disables it.  Quotas are only enforced when authentication is
+// required, and never for admin keys.
+type Quota struct {
+	// QueuedJobs is the number of jobs a key may have waiting to be sliced
+	// or being sliced.
+	QueuedJobs int `json:"queued_jobs"`
+
+	// JobsPerHour is the number of jobs a key may create in any hour.
+	JobsPerHour int `json:"jobs_per_hour"`
+
+	// UploadBytesPerDay is the number of mesh file bytes a key may send to
+	// the server during a day (UTC).
+	UploadBytesPerDay int64 `json:"upload_bytes_per_day"`
+
+	// Storage is the number of bytes the meshes and G-code of a key's jobs
+	// may occupy.
+	Storage int64 `json:"storage_bytes"`
+}
+
+// QuotaUsage reports the resources used by an api key.
+type QuotaUsage struct {
+	QueuedJobs       int   `json:"queued_jobs"`
+	JobsLastHour     int   `json:"jobs_last_hour"`
+	UploadBytesToday int64 `json:"upload_bytes_today"`
+	Storage          int64 `json:"storage_bytes"`
+
+	// firstInHour is the creation time of the oldest job counted in
+	// JobsLastHour.  oldestFinished is the creation time of the oldest job
+	// which may be collected.
+	firstInHour    time.Time
+	oldestFinished time.Time
+}
+
+// QuotaReport is the response to GET /slicer/quota.
+type QuotaReport struct {
+	Key    string      `json:"key,omitempty"`
+	Limits Quota       `json:"limits"`
+	Usage  *QuotaUsage `json:"usage"`
+}
+
+// errQuota is returned when a request would exceed a key's quota.
+// RetryAfter is the time after which the request may succeed.
+type errQuota struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (err errQuota) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", err.Limit)
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// QuotaUsage computes the resources used by the jobs and uploads of owner.
+func (srv *SnuggieServer) QuotaUsage(owner string, now time.Time) (*QuotaUsage, error) {
+	var jobs []*slicerjob.Job
+	add := func(job *slicerjob.Job) error {
+		if job.Owner == owner {
+			jobs = append(jobs, job)
+		}
+		return nil
+	}
+	var err error
+	if owner != "" {
+		err = ForEachOwnerJob(owner, add)
+	} else {
+		// jobs created without authentication are not indexed.
+		err = ForEachJob(add)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	usage := new(QuotaUsage)
+	meshes := make(map[string]bool)
+	for _, job := range jobs {
+		switch job.Status {
+		case slicerjob.Accepted, slicerjob.Processing:
+			usage.QueuedJobs++
+		default:
+			if usage.oldestFinished.IsZero() || job.Created.Before(usage.oldestFinished) {
+				usage.oldestFinished = job.Created
+			}
+		}
+		if now.Sub(job.Created) < time.Hour {
+			usage.JobsLastHour++
+			if usage.firstInHour.IsZero() || job.Created.Before(usage.firstInHour) {
+				usage.firstInHour = job.Created
+			}
+		}
+		if path, err := ViewGCodeFile(job.ID); err == nil && path != "" {
+			usage.Storage += fileSize(path)
+		}
+		if path, err := ViewOriginalGCodeFile(job.ID); err == nil && path != "" {
+			usage.Storage += fileSize(path)
+		}
+		if job.MeshSHA256 != "" && !meshes[job.MeshSHA256] {
+			meshes[job.MeshSHA256] = true
+			rec, err := ViewMesh(job.MeshSHA256)
+			if err == nil && rec != nil {
+				usage.Storage += rec.Size
+			}
+		}
+	}
+
+	usage.UploadBytesToday, err = ViewUploadBytes(owner, quotaDay(now))
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// quotaKey returns the key whose quota applies to r.  If r is not subject to
+// quotas quotaKey returns nil.
+func (srv *SnuggieServer) quotaKey(r *http.Request) *APIKey {
+	if !srv.Auth {
+		return nil
+	}
+	key := srv.authenticate(r)
+	if key == nil || key.Has(ScopeAdmin) {
+		return nil
+	}
+	return key
+}
+
+// checkQuota returns an errQuota if creating a job (when job is true) and
+// receiving upload more bytes of mesh files would exceed the quota of owner,
+// including the jobs and bytes held for requests in progress.
+func (srv *SnuggieServer) checkQuota(owner string, hold *quotaHold, job bool, upload int64) error {
+	now := time.Now()
+	usage, err := srv.QuotaUsage(owner, now)
+	if err != nil {
+		return err
+	}
+	usage.QueuedJobs += hold.jobs
+	usage.JobsLastHour += hold.jobs
+	usage.UploadBytesToday += hold.bytes
+	usage.Storage += hold.bytes
+	q := srv.Quota
+	if job && q.QueuedJobs > 0 && usage.QueuedJobs >= q.QueuedJobs {
+		return errQuota{
+			Limit:      fmt.Sprintf("%d queued jobs", q.QueuedJobs),
+			RetryAfter: 30 * time.Second,
+		}
+	}
+	if job && q.JobsPerHour > 0 && usage.JobsLastHour >= q.JobsPerHour {
+		return errQuota{
+			Limit:      fmt.Sprintf("%d jobs per hour", q.JobsPerHour),
+			RetryAfter: usage.firstInHour.Add(time.Hour).Sub(now),
+		}
+	}
+	if upload > 0 && q.UploadBytesPerDay > 0 && usage.UploadBytesToday+upload > q.UploadBytesPerDay {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return errQuota{
+			Limit:      fmt.Sprintf("%d upload bytes per day", q.UploadBytesPerDay),
+			RetryAfter: midnight.Sub(now),
+		}
+	}
+	if q.Storage > 0 && usage.Storage+upload > q.Storage {
+		// storage is freed when the owner's oldest finished job is collected.
+		retry := time.Hour
+		if srv.GC != nil && srv.GC.Retention.MaxAge > 0 && !usage.oldestFinished.IsZero() {
+			retry = usage.oldestFinished.Add(srv.GC.Retention.MaxAge).Sub(now)
+		}
+		return errQuota{
+			Limit:      fmt.Sprintf("%d bytes of storage", q.Storage),
+			RetryAfter: retry,
+		}
+	}
+	return nil
+}
+
+// quotaHold serializes the quota checks of an api key and records the jobs
+// and upload bytes admitted by enforceQuota which have not yet been stored.
+// Without it concurrent requests could each pass the check before any of
+// them counted against the quota.
+type quotaHold struct {
+	sync.Mutex
+	jobs  int
+	bytes int64
+}
+
+func (srv *SnuggieServer) quotaHold(id string) *quotaHold {
+	srv.quotaMut.Lock()
+	defer srv.quotaMut.Unlock()
+	if srv.quotaHolds == nil {
+		srv.quotaHolds = make(map[string]*quotaHold)
+	}
+	hold := srv.quotaHolds[id]
+	if hold == nil {
+		hold = new(quotaHold)
+		srv.quotaHolds[id] = hold
+	}
+	return hold
+}
+
+// enforceQuota writes an error response and returns false if the request r
+// would exceed the quota of its api key by creating a job (when job is true)
+// or uploading upload bytes.  When the request is allowed the job and bytes
+// are held against the quota until the returned release function is called,
+// which the caller must do after storing them.
+func (srv *SnuggieServer) enforceQuota(w http.ResponseWriter, r *http.Request, job bool, upload int64) (release func(), ok bool) {
+	release = func() {}
+	key := srv.quotaKey(r)
+	if key == nil {
+		return release, true
+	}
+	hold := srv.quotaHold(key.ID)
+	hold.Lock()
+	defer hold.Unlock()
+	err := srv.checkQuota(key.ID, hold, job, upload)
+	switch err := err.(type) {
+	case nil:
+		njobs := 0
+		if job {
+			njobs = 1
+		}
+		hold.jobs += njobs
+		hold.bytes += upload
+		release = func() {
+			hold.Lock()
+			hold.jobs -= njobs
+			hold.bytes -= upload
+			hold.Unlock()
+		}
+		return release, true
+	case errQuota:
+		retry := int64(err.RetryAfter/time.Second) + 1
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return release, false
+	default:
+		http.Error(w, "quota: "+err.Error(), http.StatusInternalServerError)
+		return release, false
+	}
+}
+
+// countUpload adds n bytes to the daily upload total of the api key used to
+// make r.
+func (srv *SnuggieServer) countUpload(r *http.Request, n int64) {
+	key := srv.quotaKey(r)
+	if key == nil {
+		return
+	}
+	err := AddUploadBytes(key.ID, quotaDay(time.Now()), n)
+	if err != nil {
+		log.Printf("quota: key:%v %v", key.ID, err)
+	}
+}
+
+// GetQuota reports the caller's quota and current usage.
+func (srv *SnuggieServer) GetQuota(w http.ResponseWriter, r *http.Request) {
+	report := &QuotaReport{Limits: srv.Quota}
+	owner := srv.owner(r)
+	if srv.Auth {
+		report.Key = owner
+	}
+	var err error
+	report.Usage, err = srv.QuotaUsage(owner, time.Now())
+	if err != nil {
+		http.Error(w, "quota: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+func fileSize(path string) int64 {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// addOwnedJob stores a job of owner like addTestJob.
+func addOwnedJob(t *testing.T, srv *SnuggieServer, owner string, status slicerjob.Status, created time.Time, size int) *slicerjob.Job {
+	job := addTestJob(t, srv, status, created, size)
+	job.Owner = owner
+	err := PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestQuotaUsage(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	now := time.Now()
+
+	addOwnedJob(t, srv, "alice", slicerjob.Accepted, now.Add(-10*time.Minute), 100)
+	addOwnedJob(t, srv, "alice", slicerjob.Complete, now.Add(-2*time.Hour), 50)
+	addOwnedJob(t, srv, "bob", slicerjob.Processing, now, 1000)
+	err := AddUploadBytes("alice", quotaDay(now), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := srv.QuotaUsage("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.QueuedJobs != 1 || usage.JobsLastHour != 1 || usage.UploadBytesToday != 30 || usage.Storage != 150 {
+		t.Errorf("usage: %+v", usage)
+	}
+}
+
+// retryAfter checks that enforceQuota rejects a request by key creating a job
+// (if job is true) and uploading upload bytes, and returns the Retry-After
+// header in seconds.
+func retryAfter(t *testing.T, srv *SnuggieServer, secret string, job bool, upload int64) int64 {
+	w := httptest.NewRecorder()
+	if _, ok := srv.enforceQuota(w, keyRequest("POST", "/slicer/jobs", "", secret), job, upload); ok {
+		t.Errorf("job:%v upload:%d allowed", job, upload)
+		return 0
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("job:%v upload:%d status %d (expected %d)", job, upload, w.Code, http.StatusTooManyRequests)
+	}
+	retry, err := strconv.ParseInt(w.Header().Get("Retry-After"), 10, 64)
+	if err != nil {
+		t.Errorf("job:%v upload:%d Retry-After: %v", job, upload, err)
+	}
+	return retry
+}
+
+func allowed(srv *SnuggieServer, secret string, job bool, upload int64) bool {
+	w := httptest.NewRecorder()
+	release, ok := srv.enforceQuota(w, keyRequest("POST", "/slicer/jobs", "", secret), job, upload)
+	release()
+	return ok
+}
+
+func TestQuotaLimits(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	srv.GC = &Collector{Srv: srv, Retention: Retention{MaxAge: 24 * time.Hour}}
+	alice, key := testKey(t, ScopeSubmit)
+	admin, _ := testKey(t, ScopeAdmin)
+	now := time.Now()
+
+	addOwnedJob(t, srv, key.ID, slicerjob.Accepted, now.Add(-10*time.Minute), 100)
+	addOwnedJob(t, srv, key.ID, slicerjob.Complete, now.Add(-2*time.Hour), 50)
+	err := AddUploadBytes(key.ID, quotaDay(now), 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Quota = Quota{QueuedJobs: 1}
+	if retry := retryAfter(t, srv, alice, true, 0); retry != 31 {
+		t.Errorf("queued jobs: Retry-After %d (expected 31)", retry)
+	}
+	if !allowed(srv, alice, false, 1000) {
+		t.Errorf("queued jobs: upload rejected")
+	}
+
+	srv.Quota = Quota{JobsPerHour: 1}
+	if retry := retryAfter(t, srv, alice, true, 0); retry < 49*60 || retry > 50*60+1 {
+		t.Errorf("jobs per hour: Retry-After %d (expected 50 minutes)", retry)
+	}
+
+	srv.Quota = Quota{UploadBytesPerDay: 100}
+	if !allowed(srv, alice, true, 70) {
+		t.Errorf("upload bytes: 70 bytes rejected")
+	}
+	if retry := retryAfter(t, srv, alice, true, 71); retry < 1 || retry > 24*60*60+1 {
+		t.Errorf("upload bytes: Retry-After %d (expected before midnight)", retry)
+	}
+
+	srv.Quota = Quota{Storage: 200}
+	if !allowed(srv, alice, false, 50) {
+		t.Errorf("storage: 50 bytes rejected")
+	}
+	if retry := retryAfter(t, srv, alice, false, 51); retry < 22*60*60-1 || retry > 22*60*60+1 {
+		t.Errorf("storage: Retry-After %d (expected 22 hours)", retry)
+	}
+
+	// admins and servers without authentication have no quota.
+	srv.Quota = Quota{QueuedJobs: 1, UploadBytesPerDay: 1}
+	if !allowed(srv, admin, true, 1000) {
+		t.Errorf("admin key rejected")
+	}
+	srv.Auth = false
+	if !allowed(srv, "", true, 1000) {
+		t.Errorf("request without authentication rejected")
+	}
+}
+
+func TestQuotaCountUpload(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	alice, key := testKey(t, ScopeSubmit)
+	srv.Quota = Quota{UploadBytesPerDay: 100}
+
+	w := httptest.NewRecorder()
+	srv.CreateUpload(w, keyRequest("POST", "/slicer/uploads", "filename=cube.stl&size=60", alice))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d %s", w.Code, w.Body)
+	}
+	n, err := ViewUploadBytes(key.ID, quotaDay(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 60 {
+		t.Errorf("upload bytes: %d (expected 60)", n)
+	}
+
+	w = httptest.NewRecorder()
+	srv.CreateUpload(w, keyRequest("POST", "/slicer/uploads", "filename=cube.stl&size=60", alice))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("second upload: status %d (expected %d)", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestQuotaHold(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	alice, _ := testKey(t, ScopeSubmit)
+	srv.Quota = Quota{QueuedJobs: 1, UploadBytesPerDay: 100}
+
+	// a request which passed the check holds its job and bytes until it
+	// releases them.
+	w := httptest.NewRecorder()
+	release, ok := srv.enforceQuota(w, keyRequest("POST", "/slicer/jobs", "", alice), true, 60)
+	if !ok {
+		t.Fatalf("first job rejected: status %d", w.Code)
+	}
+	retryAfter(t, srv, alice, true, 0)
+	retryAfter(t, srv, alice, false, 60)
+	if !allowed(srv, alice, false, 40) {
+		t.Errorf("40 bytes rejected while 60 are held")
+	}
+	release()
+	if !allowed(srv, alice, true, 100) {
+		t.Errorf("released job and bytes still held")
+	}
+}
+
+func TestFailInterruptedJobs(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	now := time.Now()
+	accepted := addOwnedJob(t, srv, "alice", slicerjob.Accepted, now, 10)
+	processing := addOwnedJob(t, srv, "alice", slicerjob.Processing, now, 10)
+	complete := addOwnedJob(t, srv, "alice", slicerjob.Complete, now, 10)
+
+	err := srv.FailInterruptedJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		id     string
+		status slicerjob.Status
+	}{
+		{accepted.ID, slicerjob.Failed},
+		{processing.ID, slicerjob.Failed},
+		{complete.ID, slicerjob.Complete},
+	} {
+		job, err := ViewJob(test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != test.status {
+			t.Errorf("job %v: status %v (expected %v)", test.id, job.Status, test.status)
+		}
+	}
+	usage, err := srv.QuotaUsage("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.QueuedJobs != 0 {
+		t.Errorf("queued jobs: %d (expected 0)", usage.QueuedJobs)
+	}
+}
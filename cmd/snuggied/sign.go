@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// signature computes the HMAC of a url path and its expiration time.
+func (srv *SnuggieServer) signature(path string, expires int64) []byte {
+	mac := hmac.New(sha256.New, srv.SignKey)
+	mac.Write([]byte(path))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
+
+// signedURL returns the url of the resource at pathquery with a signature
+// allowing it to be retrieved without an api key until expires.
+func (srv *SnuggieServer) signedURL(pathquery string, expires time.Time) string {
+	exp := expires.Unix()
+	sig := srv.signature(srv.route(pathquery), exp)
+	query := url.Values{
+		"expires": {strconv.FormatInt(exp, 10)},
+		"sig":     {hex.EncodeToString(sig)},
+	}
+	return srv.url(pathquery) + "?" + query.Encode()
+}
+
+// validSignature returns true if r is for a path signed by srv.signedURL
+// which has not expired.
+func (srv *SnuggieServer) validSignature(r *http.Request) bool {
+	if len(srv.SignKey) == 0 {
+		return false
+	}
+	query := r.URL.Query()
+	exp, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(sig, srv.signature(r.URL.Path, exp))
+}
+
+// signJobURLs replaces the G-code and mesh urls of job with signed urls
+// which expire after srv.SignTTL.  Jobs are unchanged if srv.SignKey is
+// empty.
+func (srv *SnuggieServer) signJobURLs(job *slicerjob.Job) {
+	if len(srv.SignKey) == 0 {
+		return
+	}
+	expires := time.Now().Add(srv.SignTTL)
+	if job.GCodeURL != "" {
+		job.GCodeURL = srv.signedURL("/gcodes/"+job.ID, expires)
+	}
+	if job.MeshURL != "" {
+		job.MeshURL = srv.signedURL("/meshes/"+job.ID, expires)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+func TestValidSignature(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.SignKey = []byte("secret")
+	signed := srv.signedURL("/gcodes/1234", time.Now().Add(time.Hour))
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+
+	// tamper returns signed after replacing the value of a query field.
+	tamper := func(field, value string) string {
+		q := u.Query()
+		q.Set(field, value)
+		return u.Path + "?" + q.Encode()
+	}
+	sig := query.Get("sig")
+	flipped := "0"
+	if sig[0] == '0' {
+		flipped = "1"
+	}
+
+	for _, test := range []struct {
+		name string
+		url  string
+		ok   bool
+	}{
+		{"signed", signed, true},
+		{"other path", strings.Replace(signed, "1234", "1235", 1), false},
+		{"other resource", strings.Replace(signed, "/gcodes/", "/meshes/", 1), false},
+		{"extended", tamper("expires", "9999999999"), false},
+		{"modified signature", tamper("sig", flipped+sig[1:]), false},
+		{"invalid signature", tamper("sig", "zz"), false},
+		{"missing signature", u.Path + "?expires=" + query.Get("expires"), false},
+		{"unsigned", u.Path, false},
+		{"expired", srv.signedURL("/gcodes/1234", time.Now().Add(-time.Second)), false},
+	} {
+		r := keyRequest("GET", test.url, "", "")
+		if ok := srv.validSignature(r); ok != test.ok {
+			t.Errorf("%s: valid %v (expected %v)", test.name, ok, test.ok)
+		}
+	}
+
+	r := keyRequest("GET", signed, "", "")
+	srv.SignKey = []byte("other")
+	if srv.validSignature(r) {
+		t.Errorf("signature valid with another key")
+	}
+	srv.SignKey = nil
+	if srv.validSignature(r) {
+		t.Errorf("signature valid with signing disabled")
+	}
+}
+
+func TestSignedDownload(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	srv.SignKey = []byte("secret")
+	srv.SignTTL = time.Hour
+	h := srv.RegisterHandlers(http.NewServeMux())
+
+	job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 10)
+	job.GCodeURL = srv.url("/gcodes/" + job.ID)
+	srv.signJobURLs(job)
+	if !strings.Contains(job.GCodeURL, "sig=") {
+		t.Fatalf("unsigned gcode_url %s", job.GCodeURL)
+	}
+	if job.MeshURL != "" {
+		t.Errorf("mesh_url signed for a job without a mesh: %s", job.MeshURL)
+	}
+
+	for _, test := range []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", job.GCodeURL, http.StatusOK},
+		{"GET", "/slicer/gcodes/" + job.ID, http.StatusUnauthorized},
+		{"GET", strings.Replace(job.GCodeURL, "/gcodes/", "/jobs/", 1), http.StatusUnauthorized},
+		{"DELETE", strings.Replace(job.GCodeURL, "/gcodes/", "/jobs/", 1), http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, keyRequest(test.method, test.url, "", ""))
+		if w.Code != test.code {
+			t.Errorf("%s %s: status %d (expected %d)", test.method, test.url, w.Code, test.code)
+		}
+	}
+}
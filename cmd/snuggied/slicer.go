@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -67,6 +68,49 @@ func ReadPresetsDirSlic3r(dir string) (map[string]string, error) {
 	return m, nil
 }
 
+// ReadConfigSlic3r reads the settings in a slic3r configuration file.
+func ReadConfigSlic3r(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pieces := strings.SplitN(line, "=", 2)
+		if len(pieces) != 2 {
+			continue
+		}
+		config[strings.TrimSpace(pieces[0])] = strings.TrimSpace(pieces[1])
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return config, nil
+}
+
+// unknownVersion is the slicer version recorded when the slicer does not
+// report one.
+const unknownVersion = "unknown"
+
+// Slic3rVersion runs the slic3r executable bin and returns the version it
+// reports.
+func Slic3rVersion(bin string) (string, error) {
+	if bin == "" {
+		bin = "slic3r"
+	}
+	out, err := exec.Command(bin, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", bin, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 type Slic3r struct {
 	Bin        string
 	ConfigPath string
@@ -17,58 +17,236 @@ Call snuggied with the -h flag to see available command line configuration.
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"image"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"flag"
 
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/mesh"
 	"github.com/gophergala/matching-snuggies/slicerjob"
 )
 
 type SnuggieServer struct {
 	Config map[string]string
 
+	// NodeID is the name of the machine, recorded on the jobs it schedules.
+	NodeID string
+
 	// Prefix should not end in a slash '/'.
 	BaseURL       string
 	Prefix        string
 	Slic3r        string
+	Slic3rVersion string
 	Slic3rPresets map[string]string
 	DataDir       string
 
+	// Filament is the filament assumed when analyzing G-code.  Presets may
+	// override its diameter.
+	Filament gcode.Filament
+
+	// Printer describes the motion limits used to estimate print times.
+	Printer gcode.Profile
+
+	// Validation is the validation mode for completed G-code: ValidateOff,
+	// ValidateWarn or ValidateStrict.  Limits are the printer limits checked,
+	// unless a preset gives its own bed size or maximum height.
+	Validation string
+	Limits     gcode.Limits
+
+	// Auth requires requests to be made with an api key granting the scope
+	// needed by each handler.
+	Auth bool
+
+	// WorkerScopes are the scopes granted to requests made with a verified
+	// client certificate on the worker listener.
+	WorkerScopes []string
+
+	// Quota limits the jobs, uploads and storage of each api key when Auth
+	// is true.
+	Quota Quota
+
+	// MinFree is the number of bytes which must be available in DataDir for
+	// the server to be ready.
+	MinFree int64
+
+	// MaxJobTime is the time a consumer may spend on one job before the
+	// server is reported not ready.  If MaxJobTime is zero it is unchecked.
+	MaxJobTime time.Duration
+
+	// SignKey is the secret used to sign G-code and mesh urls given to
+	// clients, which may retrieve them without an api key for SignTTL.  If
+	// SignKey is empty urls are not signed.
+	SignKey []byte
+	SignTTL time.Duration
+
+	// Fetcher retrieves mesh files for jobs created with a mesh_url.  If
+	// Fetcher is nil mesh urls are not accepted.
+	Fetcher *MeshFetcher
+
+	// GC removes old jobs and files.  If GC is nil nothing is removed.
+	GC *Collector
+
+	// Thumbnails lists the sizes of the preview images embedded in G-code.
+	// ThumbnailView is the direction from which meshes are rendered.
+	Thumbnails    []image.Point
+	ThumbnailView mesh.View
+
 	LocalConsumer bool
 	S             Scheduler
 	C             Consumer
+
+	uploadMut  sync.Mutex
+	uploadBusy map[string]bool
+	quotaMut   sync.Mutex
+	quotaHolds map[string]*quotaHold
+	cache      cacheCounters
+	metrics    *serverMetrics
+	consumers  int32
+
+	readyMut      sync.Mutex
+	readyFailures map[string]string
+
+	// busy maps the jobs being sliced by consumers to the time they started.
+	busyMut sync.Mutex
+	busy    map[string]time.Time
 }
 
 func (srv *SnuggieServer) RegisterHandlers(mux *http.ServeMux) http.Handler {
+	srv.registerJobHandlers(mux)
+
+	mux.HandleFunc(srv.route("/admin/gc"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			srv.authorize(ScopeAdmin, srv.PostGC)(w, r)
+		default:
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc(srv.route("/"), func(w http.ResponseWriter, r *http.Request) {
+		// the route matches every path under the prefix which has no other
+		// handler.
+		if r.URL.Path != srv.route("/") {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			srv.GetUI(w, r)
+		default:
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/healthz", srv.GetHealth)
+	mux.HandleFunc("/readyz", srv.GetReady)
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.authorize(ScopeRead, srv.GetMetrics)(w, r)
+		default:
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc(srv.route("/admin/dashboard"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.GetDashboard(w, r)
+		default:
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(srv.route("/admin/status"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.authorize(ScopeAdmin, srv.GetClusterStatus)(w, r)
+		default:
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(srv.route("/admin/jobs/"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			srv.authorize(ScopeAdmin, srv.PostAdminJob)(w, r)
+		default:
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc(srv.route("/admin/keys"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.authorize(ScopeAdmin, srv.GetAPIKeys)(w, r)
+		case "POST":
+			srv.authorize(ScopeAdmin, srv.CreateAPIKey)(w, r)
+		default:
+			http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(srv.route("/admin/keys/"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "DELETE":
+			srv.authorize(ScopeAdmin, srv.DeleteAPIKey)(w, r)
+		default:
+			http.Error(w, "only DELETE is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	return mux
+}
+
+// RegisterWorkerHandlers registers on mux the handlers used by worker nodes
+// to submit jobs and retrieve their results, and returns a handler which
+// serves them only to requests made with a verified client certificate.  It
+// is served on the -tls.clientaddr listener, where the certificate takes the
+// place of an api key.
+func (srv *SnuggieServer) RegisterWorkerHandlers(mux *http.ServeMux) http.Handler {
+	srv.registerJobHandlers(mux)
+	return requireCert(mux)
+}
+
+// registerJobHandlers registers the handlers for jobs and their files, which
+// are served to both api clients and worker nodes.
+func (srv *SnuggieServer) registerJobHandlers(mux *http.ServeMux) {
 	mux.HandleFunc(srv.route("/jobs"), func(w http.ResponseWriter, r *http.Request) {
 		// the request does not have an ID suffix on the url path so we are
 		// either creating or listing jobs.
 		switch r.Method {
 		case "POST":
-			srv.CreateJob(w, r)
-		// TODO:
-		// GET handler (index)
+			srv.authorize(ScopeSubmit, srv.CreateJob)(w, r)
+		case "GET":
+			srv.authorize(ScopeRead, srv.ListJobs)(w, r)
 		default:
-			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
 		}
 	})
 	mux.HandleFunc(srv.route("/jobs/"), func(w http.ResponseWriter, r *http.Request) {
 		// the request has an ID suffix on the url path so we are showing a
-		// single job resource.
-		switch r.Method {
-		case "GET":
-			srv.GetJob(w, r)
-		case "DELETE":
-			srv.DeleteJob(w, r)
+		// single job resource.  The viewer page holds no job data and so
+		// needs no authorization.
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/view"):
+			srv.GetJobViewer(w, r)
+		case r.Method == "GET":
+			srv.authorize(ScopeRead, srv.GetJob)(w, r)
+		case r.Method == "DELETE":
+			srv.authorize(ScopeCancel, srv.DeleteJob)(w, r)
 		default:
 			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
 		}
@@ -78,7 +256,7 @@ func (srv *SnuggieServer) RegisterHandlers(mux *http.ServeMux) http.Handler {
 		// content for a job.
 		switch r.Method {
 		case "GET":
-			srv.GetGCode(w, r)
+			srv.authorize(ScopeRead, srv.GetGCode)(w, r)
 		default:
 			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
 		}
@@ -86,22 +264,59 @@ func (srv *SnuggieServer) RegisterHandlers(mux *http.ServeMux) http.Handler {
 	mux.HandleFunc(srv.route("/meshes/"), func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			srv.GetMesh(w, r)
+			srv.authorize(ScopeRead, srv.GetMesh)(w, r)
 		default:
 			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	mux.HandleFunc(srv.route("/presets/"), func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(srv.route("/uploads"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			srv.authorize(ScopeSubmit, srv.CreateUpload)(w, r)
+		default:
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(srv.route("/uploads/"), func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			srv.GetPresets(w, r)
+			srv.authorize(ScopeSubmit, srv.GetUpload)(w, r)
+		case "PUT":
+			srv.authorize(ScopeSubmit, srv.PutUploadChunk)(w, r)
+		case "DELETE":
+			srv.authorize(ScopeSubmit, srv.DeleteUpload)(w, r)
+		default:
+			http.Error(w, "only GET, PUT and DELETE are allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc(srv.route("/cache"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.authorize(ScopeRead, srv.GetCacheStats)(w, r)
 		default:
 			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
-	return mux
+	mux.HandleFunc(srv.route("/quota"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.authorize(ScopeRead, srv.GetQuota)(w, r)
+		default:
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc(srv.route("/presets/"), func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			srv.authorize(ScopeRead, srv.GetPresets)(w, r)
+		default:
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		}
+	})
 }
 
 // path is a simple helper for constructing url paths by appending suffix to
@@ -125,30 +340,84 @@ func (srv *SnuggieServer) trimPath(path, route string) (suffix, prefix string) {
 	return suffix, prefix
 }
 
+// splitID splits the suffix of a resource path into the resource id and the
+// path of a subresource.
+func splitID(suffix string) (id, sub string) {
+	pieces := strings.SplitN(suffix, "/", 2)
+	if len(pieces) == 1 {
+		return pieces[0], ""
+	}
+	return pieces[0], pieces[1]
+}
+
 func (srv *SnuggieServer) GetGCode(w http.ResponseWriter, r *http.Request) {
-	id, _ := srv.trimPath(r.URL.Path, "/gcodes/")
+	suffix, _ := srv.trimPath(r.URL.Path, "/gcodes/")
+	id, sub := splitID(suffix)
+	if !srv.authorizeJob(w, r, id) {
+		return
+	}
+	switch sub {
+	case "":
+	case "stats":
+		srv.GetGCodeStats(w, r, id)
+		return
+	case "layers":
+		srv.GetLayers(w, r, id)
+		return
+	case "toolpaths":
+		srv.GetToolpaths(w, r, id)
+		return
+	case "original":
+		srv.GetOriginalGCode(w, r, id)
+		return
+	default:
+		if strings.HasPrefix(sub, "layers/") {
+			srv.GetLayer(w, r, id, strings.TrimPrefix(sub, "layers/"))
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
 	path, err := ViewGCodeFile(id)
-	if err != nil {
+	if err != nil || path == "" {
 		http.Error(w, "unknown id", http.StatusNotFound)
 		return
 	}
-	http.ServeFile(w, r, path)
+	srv.serveGCode(w, r, id, path)
 }
 
 func (srv *SnuggieServer) GetMesh(w http.ResponseWriter, r *http.Request) {
-	id, _ := srv.trimPath(r.URL.Path, "/meshes/")
-	path, err := ViewGCodeFile(id)
-	if err != nil {
+	suffix, _ := srv.trimPath(r.URL.Path, "/meshes/")
+	id, sub := splitID(suffix)
+	if !srv.authorizeJob(w, r, id) {
+		return
+	}
+	switch sub {
+	case "":
+	case "thumbnail.png":
+		srv.GetThumbnail(w, r, id)
+		return
+	case "mesh.stl":
+		srv.GetMeshSTL(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	path, err := ViewMeshFile(id)
+	if err != nil || path == "" {
 		http.Error(w, "unknown id", http.StatusNotFound)
 		return
 	}
 	http.ServeFile(w, r, path)
 }
 
+// GetPresets lists the presets of the backend named in the request path.  If
+// no backend is named every backend is listed with its presets.
 func (srv *SnuggieServer) GetPresets(w http.ResponseWriter, r *http.Request) {
 	id, _ := srv.trimPath(r.URL.Path, "/presets/")
 	log.Println(id)
-	if id != "slic3r" {
+	if id != "" && id != "slic3r" {
 		http.Error(w, "only slic3r is supported at this time", http.StatusNotFound)
 		return
 	}
@@ -156,11 +425,16 @@ func (srv *SnuggieServer) GetPresets(w http.ResponseWriter, r *http.Request) {
 	for k := range srv.Slic3rPresets {
 		presetKeys = append(presetKeys, k)
 	}
+	sort.Strings(presetKeys)
 	presets := &slicerjob.SlicerPreset{
 		Slicer:  "slic3r",
 		Presets: presetKeys,
 	}
-	jsonPresets, err := json.Marshal(presets)
+	var v interface{} = presets
+	if id == "" {
+		v = []*slicerjob.SlicerPreset{presets}
+	}
+	jsonPresets, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, "slic3r presets json error", http.StatusInternalServerError)
 		return
@@ -175,12 +449,39 @@ func (srv *SnuggieServer) GetJob(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "lookup: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !srv.canAccessJob(r, job) {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	srv.signJobURLs(job)
 	err = json.NewEncoder(w).Encode(job)
 	if err != nil {
 		log.Printf("http response: %v", err)
 	}
 }
 
+// ListJobs lists the jobs owned by the caller, newest first.  Admins are
+// shown every job.
+func (srv *SnuggieServer) ListJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := jobsByAge{}
+	err := ForEachJob(func(job *slicerjob.Job) error {
+		if srv.canAccessJob(r, job) {
+			srv.signJobURLs(job)
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "jobs: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Sort(jobs)
+	err = json.NewEncoder(w).Encode(jobs)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
 func (srv *SnuggieServer) CreateJob(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -204,56 +505,234 @@ func (srv *SnuggieServer) CreateJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO make sure meshfile is at least .stl
-	meshfile, fileheader, err := r.FormFile("meshfile")
+	post := r.Form["postprocess"]
+	_, err := parseProcessors(post)
 	if err != nil {
-		http.Error(w, "bad meshfile, or 'meshfile' field not present", http.StatusBadRequest)
+		http.Error(w, "postprocess: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the mesh is either sent in the request body, was previously sent using
+	// a resumable upload session, must be fetched from a remote server, or is
+	// already stored on the server and identified by its hash.
+	var meshfile io.Reader
+	var filename string
+	var sum, path string
+	uploadID := r.FormValue("upload")
+	meshURL := r.FormValue("mesh_url")
+	meshSHA256 := strings.ToLower(r.FormValue("mesh_sha256"))
+
+	// meshes sent in resumable uploads were counted when the upload was
+	// created.  the size of a fetched mesh is not known until it has been
+	// fetched.
+	var upload int64
+	if meshSHA256 == "" && uploadID == "" {
+		upload = r.ContentLength
+		if upload <= 0 || meshURL != "" {
+			upload = 1
+		}
+	}
+	release, ok := srv.enforceQuota(w, r, true, upload)
+	if !ok {
 		return
 	}
+	defer release()
+
+	if meshSHA256 != "" {
+		ok, err := srv.canUseMesh(r, meshSHA256)
+		if err != nil {
+			http.Error(w, "mesh_sha256: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "mesh_sha256: unknown mesh "+meshSHA256, http.StatusNotFound)
+			return
+		}
+		path, err = AcquireMesh(meshSHA256)
+		if err != nil {
+			http.Error(w, "mesh_sha256: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		sum = meshSHA256
+	} else if meshURL != "" {
+		if srv.Fetcher == nil {
+			http.Error(w, "mesh_url is not enabled on this server", http.StatusBadRequest)
+			return
+		}
+		f, name, err := srv.Fetcher.Fetch(meshURL, r.FormValue("checksum"))
+		switch err.(type) {
+		case nil:
+		case errHostNotAllowed:
+			http.Error(w, "mesh_url: "+err.Error(), http.StatusForbidden)
+			return
+		case errTooLarge:
+			http.Error(w, "mesh_url: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case errURL, errChecksum:
+			http.Error(w, "mesh_url: "+err.Error(), http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, "mesh_url: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		meshfile, filename = f, name
+	} else if uploadID != "" {
+		upload, err := srv.lookupUpload(r, uploadID)
+		if err != nil {
+			http.Error(w, "upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !upload.Complete() {
+			http.Error(w, "upload is incomplete", http.StatusConflict)
+			return
+		}
+		f, err := os.Open(srv.uploadPath(uploadID))
+		if err != nil {
+			http.Error(w, "upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		meshfile, filename = f, upload.Filename
+	} else {
+		//TODO make sure meshfile is at least .stl
+		f, fileheader, err := r.FormFile("meshfile")
+		if err != nil {
+			http.Error(w, "bad meshfile, or 'meshfile' field not present", http.StatusBadRequest)
+			return
+		}
+		meshfile, filename = f, fileheader.Filename
+	}
 
-	job, err := srv.registerJob(meshfile, fileheader, slicerBackend, preset)
+	if meshfile != nil {
+		sum, path, err = srv.storeMesh(meshfile, filepath.Ext(filename))
+		if err != nil {
+			http.Error(w, "meshfile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// resumable uploads were counted when they were created.
+		size := fileSize(path)
+		if uploadID == "" {
+			srv.countUpload(r, size)
+		}
+		srv.metrics.uploaded(size)
+	}
+
+	job := slicerjob.New()
+	job.MeshSHA256 = sum
+	job.Slicer = slicerBackend
+	job.Preset = preset
+	job.PostProcess = post
+	job.Owner = srv.owner(r)
+	nocache := r.FormValue("nocache") == "1"
+	job, err = srv.registerJob(job, path, nocache)
 	if err != nil {
+		ReleaseMesh(sum)
 		// TODO: distinguish unknown preset (Bad Request) from backend failure.
 		http.Error(w, "registration failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	srv.signJobURLs(job)
 	jsonJob, err := json.Marshal(job)
 	if err != nil {
 		http.Error(w, "json didn't encode properly...Derp?\n"+err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if uploadID != "" {
+		srv.removeUpload(uploadID)
+	}
+
 	w.WriteHeader(http.StatusAccepted)
 	w.Write(jsonJob)
 }
 
-func (srv *SnuggieServer) registerJob(meshfile multipart.File, header *multipart.FileHeader, slicerBackend string, preset string) (*slicerjob.Job, error) {
-	job := slicerjob.New()
-
+// registerJob stores job, which slices the mesh at path, and schedules it.
+// The job's mesh hash, slicer, preset and post-processors must be set.  The
+// caller must hold a reference to the mesh.  Unless nocache is true a job
+// whose output is in the result cache completes immediately without being
+// scheduled.
+func (srv *SnuggieServer) registerJob(job *slicerjob.Job, path string, nocache bool) (*slicerjob.Job, error) {
 	//do stuff to the job.
 	job.Status = slicerjob.Accepted
 	job.Progress = 0.0
 	job.URL = srv.url("/jobs/" + job.ID)
+	job.Node = srv.NodeID
+	job.MeshURL = srv.url("/meshes/" + job.ID)
 
-	//if location flag not set, default temp file location is used
-	ext := filepath.Ext(header.Filename)
-	path := filepath.Join(srv.DataDir, job.ID+ext)
-	f, err := os.Create(path)
-	if err != nil {
-		return nil, fmt.Errorf("meshfile create: %v", err)
-	}
-	_, err = io.Copy(f, meshfile)
-	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("meshfile write: %v", err)
+	if srv.cacheEnabled() {
+		key, err := srv.resultKey(job)
+		if err != nil {
+			return nil, fmt.Errorf("cache key: %v", err)
+		}
+		job.CacheKey = key
 	}
 
-	err = PutMeshFile(job.ID, path)
+	err := PutMeshFile(job.ID, path)
 	if err != nil {
 		return nil, fmt.Errorf("meshfile: %v", err)
 	}
 
+	if nocache || job.CacheKey == "" {
+		atomic.AddInt64(&srv.cache.bypassed, 1)
+	} else if rec, ok := srv.cachedResult(job.CacheKey); ok {
+		atomic.AddInt64(&srv.cache.hits, 1)
+		cached := filepath.Join(srv.DataDir, job.ID+".gcode")
+		err = linkGCode(cached, rec.Path)
+		if err != nil {
+			DeleteMeshFile(job.ID)
+			return nil, fmt.Errorf("cached gcode: %v", err)
+		}
+		err = PutGCodeFile(job.ID, cached)
+		if err != nil {
+			os.Remove(cached)
+			os.Remove(cached + ".gz")
+			DeleteMeshFile(job.ID)
+			return nil, err
+		}
+		if rec.Original != "" {
+			orig := filepath.Join(srv.DataDir, job.ID+".orig.gcode")
+			err = linkFile(orig, rec.Original)
+			if err == nil {
+				err = PutOriginalGCodeFile(job.ID, orig)
+			}
+			if err != nil {
+				log.Printf("cached original gcode job:%v err:%v", job.ID, err)
+			}
+		}
+		job.Status = slicerjob.Complete
+		job.Progress = 1.0
+		job.GCodeURL = srv.url("/gcodes/" + job.ID)
+		job.Cached = true
+		job.ArcFit = rec.ArcFit
+		srv.inspectGCode(job, cached)
+		failed := srv.validationFailed(job)
+		if failed {
+			job.GCodeURL = ""
+		}
+		err = PutJob(job.ID, job)
+		if err != nil {
+			os.Remove(cached)
+			os.Remove(cached + ".gz")
+			os.Remove(filepath.Join(srv.DataDir, job.ID+".orig.gcode"))
+			DeleteOriginalGCodeFile(job.ID)
+			DeleteGCodeFile(job.ID)
+			DeleteMeshFile(job.ID)
+			return nil, err
+		}
+		srv.metrics.jobFinished(job)
+		if failed {
+			log.Printf("failed job:%v err:%v (cached %v)", job.ID, job.Error, rec.Path)
+			return job, nil
+		}
+		log.Printf("completed job:%v gcode:%v (cached %v)", job.ID, cached, rec.Path)
+		return job, nil
+	} else {
+		atomic.AddInt64(&srv.cache.misses, 1)
+	}
+
 	err = PutJob(job.ID, job)
 	if err != nil {
 		return nil, err
@@ -263,10 +742,9 @@ func (srv *SnuggieServer) registerJob(meshfile multipart.File, header *multipart
 	if srv.LocalConsumer {
 		url = "file://" + path
 	}
-	err = srv.S.ScheduleSliceJob(job.ID, url, slicerBackend, preset)
+	err = srv.S.ScheduleSliceJob(job.ID, url, job.Slicer, job.Preset, job.PostProcess)
 	if err != nil {
-		os.Remove(path)
-		DeleteGCodeFile(job.ID)
+		DeleteMeshFile(job.ID)
 		DeleteJob(job.ID)
 		return nil, err
 	}
@@ -290,16 +768,24 @@ func (srv *SnuggieServer) lookupJob(id string) (*slicerjob.Job, error) {
 
 func (srv *SnuggieServer) DeleteJob(w http.ResponseWriter, r *http.Request) {
 	id, _ := srv.trimPath(r.URL.Path, "/jobs/")
-	_, err := srv.lookupJob(id)
+	job, err := srv.lookupJob(id)
 	if err != nil {
 		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
 		return
 	}
+	if !srv.canAccessJob(r, job) {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
 	srv.S.CancelSliceJob(id)
-	CancelJob(id)
-
+	prev, err := CancelJob(id)
 	if err != nil {
-		log.Printf("http response: %v", err)
+		http.Error(w, "cancel: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if prev == slicerjob.Accepted || prev == slicerjob.Processing {
+		job.Status = slicerjob.Cancelled
+		srv.metrics.jobFinished(job)
 	}
 }
 
@@ -307,10 +793,14 @@ func (srv *SnuggieServer) url(pathquery string) string {
 	return srv.BaseURL + srv.Prefix + pathquery
 }
 
+// errJobCancelled is returned by functions passed to UpdateJob when a job
+// which finished had already been cancelled.
+var errJobCancelled = fmt.Errorf("the job was cancelled")
+
 // JobDone stores the location of the successful output g-code for job id
 func (srv *SnuggieServer) JobDone(id, path string, err error) {
 	if err != nil {
-		log.Printf("FIXME -- failed job:%v err:%v", id, err)
+		srv.jobFailed(id, err)
 		return
 	}
 
@@ -324,28 +814,139 @@ func (srv *SnuggieServer) JobDone(id, path string, err error) {
 		log.Printf("Can't view job from database:%v err:%v", id, err)
 		return
 	}
+	if job.Status == slicerjob.Cancelled {
+		log.Printf("cancelled job:%v finished", id)
+		return
+	}
 	job.Status = slicerjob.Complete
-	job.GCodeURL = srv.url("/gcodes/" + id)
 	job.Progress = 1.0
+	srv.inspectGCode(job, path)
+	// G-code rejected by validation is kept for inspection but is not
+	// offered to clients or cached.
+	failed := srv.validationFailed(job)
+	if !failed {
+		job.GCodeURL = srv.url("/gcodes/" + id)
+	}
+	err = compressGCode(path)
+	if err != nil {
+		log.Printf("compress job:%v err:%v", id, err)
+	}
 
-	err = PutJob(id, job)
+	// the job may have been cancelled while its G-code was inspected.
+	err = UpdateJob(id, func(stored *slicerjob.Job) error {
+		if stored.Status == slicerjob.Cancelled {
+			return errJobCancelled
+		}
+		*stored = *job
+		return nil
+	})
+	if err == errJobCancelled {
+		log.Printf("cancelled job:%v finished", id)
+		return
+	}
 	if err != nil {
 		log.Printf("Can't put job to database:%v err:%v", id, err)
 	}
 
+	if job.CacheKey != "" && !failed {
+		err = srv.cacheResult(job, path)
+		if err != nil {
+			log.Printf("cache job:%v err:%v", id, err)
+		}
+	}
+
+	srv.metrics.jobFinished(job)
+	if failed {
+		log.Printf("failed job:%v err:%v", id, job.Error)
+		return
+	}
 	log.Printf("completed job:%v gcode:%v", id, path)
 }
 
+// jobFailed marks job id as Failed.  Jobs which were cancelled keep their
+// status.
+func (srv *SnuggieServer) jobFailed(id string, failure error) {
+	log.Printf("failed job:%v err:%v", id, failure)
+	var job *slicerjob.Job
+	err := UpdateJob(id, func(stored *slicerjob.Job) error {
+		if stored.Status == slicerjob.Cancelled {
+			return errJobCancelled
+		}
+		stored.Status = slicerjob.Failed
+		stored.Error = failure.Error()
+		job = stored
+		return nil
+	})
+	if err == errJobCancelled {
+		return
+	}
+	if err != nil {
+		log.Printf("Can't put job to database:%v err:%v", id, err)
+		return
+	}
+	srv.metrics.jobFinished(job)
+}
+
+// FailInterruptedJobs marks jobs which were Accepted or Processing when the
+// server last stopped as Failed.  The in-memory queue does not survive a
+// restart so these jobs would never finish, and they would count against
+// their owner's queued job quota forever.
+func (srv *SnuggieServer) FailInterruptedJobs() error {
+	var ids []string
+	err := ForEachJob(func(job *slicerjob.Job) error {
+		if job.Status == slicerjob.Accepted || job.Status == slicerjob.Processing {
+			ids = append(ids, job.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		srv.jobFailed(id, fmt.Errorf("interrupted by a server restart"))
+	}
+	return nil
+}
+
+// jobStarted marks job as Processing.  Jobs which were cancelled keep their
+// status.
+func (srv *SnuggieServer) jobStarted(job *Job) {
+	sjob, err := ViewJob(job.ID)
+	if err != nil {
+		log.Printf("Can't view job from database:%v err:%v", job.ID, err)
+		return
+	}
+	if sjob.Status != slicerjob.Accepted {
+		return
+	}
+	sjob.Status = slicerjob.Processing
+	if sjob.Node == "" {
+		sjob.Node = job.NodeID
+	}
+	err = PutJob(job.ID, sjob)
+	if err != nil {
+		log.Printf("Can't put job to database:%v err:%v", job.ID, err)
+	}
+}
+
 // RunConsumers pops jobs off the queue, fetches remote mesh files, slices
 // them, and makes the resulting gcode accessible over HTTP,
 func (srv *SnuggieServer) RunConsumer() {
+	atomic.AddInt32(&srv.consumers, 1)
+	defer atomic.AddInt32(&srv.consumers, -1)
 	for {
 		job, err := srv.C.NextSliceJob()
 		if err != nil {
 			log.Printf("consumer: %v", err)
 			return
 		}
-		job.Done(srv.runConsumerJob(job))
+		srv.jobStarted(job)
+		start := time.Now()
+		srv.consumerBusy(job.ID, start)
+		path, err := srv.runConsumerJob(job)
+		srv.consumerIdle(job.ID)
+		srv.metrics.sliced(time.Since(start).Seconds())
+		job.Done(path, err)
 	}
 }
 
@@ -354,7 +955,18 @@ func (srv *SnuggieServer) runConsumerJob(job *Job) (path string, err error) {
 		return "", fmt.Errorf("consumer cannot process: %v", job.MeshURL)
 	}
 
-	gcode := filepath.Join(srv.DataDir, job.ID+".gcode")
+	procs, err := parseProcessors(job.PostProcess)
+	if err != nil {
+		return "", fmt.Errorf("consumer: %v", err)
+	}
+
+	// when the output is post-processed the slicer's output is kept alongside
+	// the final G-code.
+	out := filepath.Join(srv.DataDir, job.ID+".gcode")
+	sliced := out
+	if len(procs) > 0 {
+		sliced = filepath.Join(srv.DataDir, job.ID+".orig.gcode")
+	}
 	configPath := srv.Slic3rPresets[job.Preset]
 	if configPath == "" {
 		return "", fmt.Errorf("consumer: unknown preset")
@@ -363,7 +975,7 @@ func (srv *SnuggieServer) runConsumerJob(job *Job) (path string, err error) {
 		Bin:        srv.Slic3r,
 		ConfigPath: configPath,
 		InPath:     strings.TrimPrefix(job.MeshURL, "file://"),
-		OutPath:    gcode,
+		OutPath:    sliced,
 	}
 	err = Run(slic3r, job.Cancel)
 	if err != nil {
@@ -373,7 +985,32 @@ func (srv *SnuggieServer) runConsumerJob(job *Job) (path string, err error) {
 	if err != nil {
 		return "", fmt.Errorf("stat gcode: %v", err)
 	}
-	return gcode, nil
+
+	// thumbnails are part of the slicer's output, before any processors
+	// given for the job.
+	thumbs, err := srv.thumbnailProcessor(slic3r.InPath)
+	if err != nil {
+		log.Printf("thumbnails job:%v err:%v", job.ID, err)
+	} else if thumbs != nil {
+		err = postProcess(sliced, sliced, []gcode.Processor{thumbs})
+		if err != nil {
+			return "", fmt.Errorf("thumbnails: %v", err)
+		}
+	}
+	if len(procs) == 0 {
+		return out, nil
+	}
+
+	err = PutOriginalGCodeFile(job.ID, sliced)
+	if err != nil {
+		return "", fmt.Errorf("original gcode: %v", err)
+	}
+	err = postProcess(out, sliced, procs)
+	if err != nil {
+		return "", fmt.Errorf("postprocess: %v", err)
+	}
+	srv.reportProcessors(job.ID, procs)
+	return out, nil
 }
 
 func main() {
@@ -383,6 +1020,40 @@ func main() {
 	dataDir := flag.String("data", "/tmp", "location for database, .stl, .gcode")
 	httpAddr := flag.String("http", ":8888", "address to serve traffic")
 	baseURL := flag.String("baseurl", "", "links and redirection go to the specified base url")
+	signSecret := flag.String("sign.secret", "", "secret used to sign gcode and mesh urls so they may be downloaded without an api key (empty disables signing)")
+	signTTL := flag.Duration("sign.ttl", 24*time.Hour, "lifetime of signed urls")
+	tlsCert := flag.String("tls.cert", "", "PEM certificate file used to serve https (requires -tls.key)")
+	tlsKey := flag.String("tls.key", "", "PEM private key file for -tls.cert")
+	tlsClientCA := flag.String("tls.clientca", "", "PEM file of certificate authorities; clients of -tls.clientaddr must present a certificate signed by one of them")
+	tlsClientAddr := flag.String("tls.clientaddr", "", "additional address serving https to worker nodes which present a client certificate (requires -tls.clientca)")
+	tlsClientScopes := flag.String("tls.clientscopes", "submit,read,cancel", "comma separated scopes granted to worker nodes by their client certificate when -auth is given")
+	fetchHosts := flag.String("fetch.hosts", "", "comma separated list of hosts from which mesh_url files may be fetched")
+	fetchMaxSize := flag.Int64("fetch.maxsize", 256<<20, "maximum size in bytes of a fetched mesh file")
+	fetchTimeout := flag.Duration("fetch.timeout", time.Minute, "time limit for fetching a mesh file")
+	retainAge := flag.Duration("retain.maxage", 0, "remove finished jobs and their files after this long (0 keeps them forever)")
+	retainDisk := flag.Int64("retain.maxdisk", 0, "remove the oldest files when the data directory exceeds this many bytes (0 is unlimited)")
+	retainKeep := flag.Int("retain.keep", 0, "keep only the most recent N jobs of each finished status (0 is unlimited)")
+	retainUploads := flag.Duration("retain.uploads", 24*time.Hour, "remove upload sessions which have received no data for this long (0 keeps them forever)")
+	quotaQueued := flag.Int("quota.queued", 10, "maximum number of queued jobs for each api key (0 is unlimited)")
+	quotaHourly := flag.Int("quota.hourly", 120, "maximum number of jobs each api key may create per hour (0 is unlimited)")
+	quotaUpload := flag.Int64("quota.upload", 1<<30, "maximum number of mesh bytes each api key may upload per day (0 is unlimited)")
+	quotaStorage := flag.Int64("quota.storage", 0, "maximum number of bytes used by the meshes and gcode of each api key's jobs (0 is unlimited)")
+	filamentDiameter := flag.Float64("filament.diameter", 1.75, "filament diameter in mm for presets which do not specify one")
+	filamentDensity := flag.Float64("filament.density", 1.24, "filament density in g/cm^3 used to estimate print weight")
+	printerProfile := flag.String("printer", "", "JSON printer profile with motion limits used to estimate print times")
+	minFree := flag.Int64("ready.minfree", 100<<20, "bytes which must be free in the data directory for the server to be ready (0 is unchecked)")
+	maxJobTime := flag.Duration("ready.maxjob", 30*time.Minute, "time a consumer may spend slicing one job before the server is not ready (0 is unchecked)")
+	gcInterval := flag.Duration("gc.interval", time.Hour, "interval between garbage collections")
+	auth := flag.Bool("auth", false, "require api keys for all requests")
+	newKey := flag.String("newkey", "", "create an api key with the given name, print it and exit")
+	newKeyScopes := flag.String("newkey.scopes", "submit,read,cancel", "comma separated scopes of the key created by -newkey: submit, read, cancel, admin")
+	validate := flag.String("validate", ValidateWarn, "validation of completed gcode: off, warn (report problems on jobs) or strict (fail jobs with problems)")
+	validateMaxZ := flag.Float64("validate.maxz", 0, "maximum print height in mm for presets which do not specify max_print_height (0 is unchecked)")
+	validateMaxHotend := flag.Float64("validate.maxhotend", 280, "maximum hotend temperature in degrees Celsius (0 is unchecked)")
+	validateMaxBed := flag.Float64("validate.maxbed", 120, "maximum bed temperature in degrees Celsius (0 is unchecked)")
+	thumbnails := flag.String("thumbnails", "16x16,220x124", "comma separated sizes of preview images embedded in gcode (empty disables them)")
+	thumbnailAzimuth := flag.Float64("thumbnail.azimuth", mesh.DefaultView().Azimuth, "rotation of meshes about the vertical axis in thumbnails, in degrees")
+	thumbnailElevation := flag.Float64("thumbnail.elevation", mesh.DefaultView().Elevation, "angle in degrees above the build plate from which thumbnails are rendered")
 	flag.Parse()
 
 	pathPrefix := "/slicer"
@@ -397,7 +1068,11 @@ func main() {
 		if strings.HasPrefix(urlHostPort, ":") {
 			urlHostPort = "localhost" + urlHostPort
 		}
-		*baseURL = "http://" + urlHostPort
+		scheme := "http://"
+		if *tlsCert != "" {
+			scheme = "https://"
+		}
+		*baseURL = scheme + urlHostPort
 	}
 
 	// make sure that dataDir is a directory and that it's path is absolute.
@@ -411,6 +1086,48 @@ func main() {
 		log.Fatalf("data directory is not an absolute path: %v", *dataDir)
 	}
 
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("tls: both -tls.cert and -tls.key must be given")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		log.Fatalf("tls: -tls.clientca requires -tls.cert and -tls.key")
+	}
+	if (*tlsClientCA == "") != (*tlsClientAddr == "") {
+		log.Fatalf("tls: both -tls.clientca and -tls.clientaddr must be given")
+	}
+	var tlsConfig, clientTLSConfig *tls.Config
+	if *tlsCert != "" {
+		tlsConfig, err = loadTLSConfig(*tlsCert, *tlsKey, "")
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+	}
+	if *tlsClientCA != "" {
+		clientTLSConfig, err = loadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+	}
+	workerScopes, err := parseScopes(*tlsClientScopes)
+	if err != nil {
+		log.Fatalf("tls.clientscopes: %v", err)
+	}
+
+	if *newKey != "" {
+		scopes, err := parseScopes(*newKeyScopes)
+		if err != nil {
+			log.Fatalf("newkey: %v", err)
+		}
+		DB = loadDB(filepath.Join(*dataDir, "snuggied.boltdb"))
+		secret, key, err := CreateAPIKey(*newKey, scopes)
+		if err != nil {
+			log.Fatalf("newkey: %v", err)
+		}
+		log.Printf("created api key:%v name:%q scopes:%v", key.ID, key.Name, key.Scopes)
+		fmt.Println(secret)
+		return
+	}
+
 	slic3rPresets, err := ReadPresetsDirSlic3r(*slic3rConfigDir)
 	if err != nil {
 		log.Fatalf("slic3r configs: %v", err)
@@ -419,14 +1136,103 @@ func main() {
 		log.Fatalf("slic3r configs: no presets found")
 	}
 
+	printer := gcode.DefaultProfile()
+	if *printerProfile != "" {
+		printer, err = gcode.ReadProfile(*printerProfile)
+		if err != nil {
+			log.Fatalf("printer profile: %v", err)
+		}
+	}
+
+	validation, err := parseValidation(*validate)
+	if err != nil {
+		log.Fatalf("validate: %v", err)
+	}
+
+	thumbnailSizes, err := parseSizes(*thumbnails)
+	if err != nil {
+		log.Fatalf("thumbnails: %v", err)
+	}
+	thumbnailView := mesh.DefaultView()
+	thumbnailView.Azimuth = *thumbnailAzimuth
+	thumbnailView.Elevation = *thumbnailElevation
+
+	slic3rVersion, err := Slic3rVersion(*slic3rBin)
+	if err != nil {
+		log.Printf("slic3r version: %v (result cache disabled)", err)
+		slic3rVersion = unknownVersion
+	}
+
 	DB = loadDB(filepath.Join(*dataDir, "snuggied.boltdb"))
 
 	srv := &SnuggieServer{
+		NodeID:        *machineID,
 		BaseURL:       *baseURL,
 		Prefix:        pathPrefix,
 		DataDir:       *dataDir,
 		Slic3r:        *slic3rBin,
+		Slic3rVersion: slic3rVersion,
+		Filament: gcode.Filament{
+			Diameter: *filamentDiameter,
+			Density:  *filamentDensity,
+		},
+		Printer:       printer,
 		Slic3rPresets: slic3rPresets,
+		Thumbnails:    thumbnailSizes,
+		ThumbnailView: thumbnailView,
+		Validation:    validation,
+		Auth:          *auth,
+		WorkerScopes:  workerScopes,
+		metrics:       newServerMetrics(),
+		MinFree:       *minFree,
+		MaxJobTime:    *maxJobTime,
+		SignKey:       []byte(*signSecret),
+		SignTTL:       *signTTL,
+		Quota: Quota{
+			QueuedJobs:        *quotaQueued,
+			JobsPerHour:       *quotaHourly,
+			UploadBytesPerDay: *quotaUpload,
+			Storage:           *quotaStorage,
+		},
+		Limits: gcode.Limits{
+			MaxZ:      *validateMaxZ,
+			MaxHotend: *validateMaxHotend,
+			MaxBed:    *validateMaxBed,
+		},
+	}
+	if hosts := parseHosts(*fetchHosts); len(hosts) > 0 {
+		srv.Fetcher = &MeshFetcher{
+			Hosts:   hosts,
+			MaxSize: *fetchMaxSize,
+			Timeout: *fetchTimeout,
+			TempDir: *dataDir,
+		}
+	}
+
+	srv.GC = &Collector{
+		Srv: srv,
+		Retention: Retention{
+			MaxAge:    *retainAge,
+			MaxDisk:   *retainDisk,
+			KeepLast:  *retainKeep,
+			UploadTTL: *retainUploads,
+		},
+	}
+
+	if srv.Auth {
+		nkeys := 0
+		ForEachAPIKey(func(string, *APIKey) error {
+			nkeys++
+			return nil
+		})
+		if nkeys == 0 {
+			log.Printf("auth: no api keys exist; create an admin key with -newkey=NAME -newkey.scopes=admin")
+		}
+	}
+
+	err = srv.FailInterruptedJobs()
+	if err != nil {
+		log.Fatalf("interrupted jobs: %v", err)
 	}
 
 	// register http handlers
@@ -435,6 +1241,7 @@ func main() {
 	// the scheduler/consumer for the server are implemented using an in-memory
 	// queue.
 	memq := MemoryQueue(srv.JobDone)
+	memq.NodeID = srv.NodeID
 	srv.S, srv.C = memq, memq
 	srv.LocalConsumer = true // use file:// locations instead of http://
 
@@ -444,7 +1251,23 @@ func main() {
 	// capable of serving the result. this would be most problematic if binding
 	// the address fails.
 	go srv.RunConsumer()
+	if *gcInterval > 0 {
+		go srv.GC.Run(*gcInterval)
+	}
+	if clientTLSConfig != nil {
+		log.Printf("machine %s binding to %s for worker nodes", *machineID, *tlsClientAddr)
+		server := &http.Server{
+			Addr:      *tlsClientAddr,
+			Handler:   srv.RegisterWorkerHandlers(http.NewServeMux()),
+			TLSConfig: clientTLSConfig,
+		}
+		go func() { log.Fatal(server.ListenAndServeTLS("", "")) }()
+	}
 	log.Printf("machine %s binding to %s", *machineID, *httpAddr)
+	if tlsConfig != nil {
+		server := &http.Server{Addr: *httpAddr, TLSConfig: tlsConfig}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Fatal(http.ListenAndServe(*httpAddr, nil))
 }
 
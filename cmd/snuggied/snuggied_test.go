@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// testServer returns a server using a temporary database and data directory
+// with a single slic3r preset named "hq" and a known slic3r version.  The
+// returned function removes them.
+func testServer(t *testing.T) (*SnuggieServer, func()) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "hq.ini")
+	err = ioutil.WriteFile(config, []byte("layer_height = 0.2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB = loadDB(filepath.Join(dir, "snuggied.boltdb"))
+	srv := &SnuggieServer{
+		Prefix:        "/slicer",
+		DataDir:       dir,
+		Slic3rPresets: map[string]string{"hq": config},
+		Slic3rVersion: "1.2.9",
+		Validation:    ValidateOff,
+	}
+	return srv, func() {
+		DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// newRequest returns a request with the given body.  The body of a POST
+// request is a url encoded form.
+func newRequest(method, url, body string) *http.Request {
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	if method == "POST" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r
+}
+
+// testGCode is a small G-code file with two layers.
+const testGCode = `G21
+G90
+M82
+G92 E0
+G1 Z0.2 F7800
+G1 X10 Y10
+G1 X20 Y10 E1 F1800
+G1 Z0.4 F7800
+G1 X20 Y20 E2 F1800
+`
+
+// addTestJob stores a job with the given status and creation time whose
+// G-code is a file of size bytes in srv.DataDir.
+func addTestJob(t *testing.T, srv *SnuggieServer, status slicerjob.Status, created time.Time, size int) *slicerjob.Job {
+	job := slicerjob.New()
+	job.Status = status
+	job.Created = created
+	path := filepath.Join(srv.DataDir, job.ID+".gcode")
+	err := ioutil.WriteFile(path, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutGCodeFile(job.ID, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// exists returns true if the file at path exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// addGCodeJob stores a complete job whose G-code is testGCode.
+func addGCodeJob(t *testing.T, srv *SnuggieServer) *slicerjob.Job {
+	job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 0)
+	path, err := ViewGCodeFile(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// testSTL is an ASCII STL file of a single triangle.
+const testSTL = `solid triangle
+facet normal 0 0 1
+outer loop
+vertex 0 0 0
+vertex 10 0 0
+vertex 0 10 5
+endloop
+endfacet
+endsolid triangle
+`
+
+// addSTLJob stores a complete job whose mesh is testSTL.
+func addSTLJob(t *testing.T, srv *SnuggieServer) *slicerjob.Job {
+	sum, path, err := srv.storeMesh(strings.NewReader(testSTL), ".stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := addTestJob(t, srv, slicerjob.Complete, time.Now(), 10)
+	job.MeshSHA256 = sum
+	err = PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutMeshFile(job.ID, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
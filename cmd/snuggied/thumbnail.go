@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/mesh"
+)
+
+// maxThumbnailSize limits the dimensions of thumbnails.
+const maxThumbnailSize = 1024
+
+// parseSizes parses a comma separated list of image sizes like "16x16,220x124".
+func parseSizes(s string) ([]image.Point, error) {
+	var sizes []image.Point
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		size, err := parseSize(field)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func parseSize(s string) (image.Point, error) {
+	pieces := strings.SplitN(s, "x", 2)
+	if len(pieces) != 2 {
+		return image.Point{}, fmt.Errorf("invalid size %q", s)
+	}
+	w, errw := strconv.Atoi(pieces[0])
+	h, errh := strconv.Atoi(pieces[1])
+	if errw != nil || errh != nil || w <= 0 || h <= 0 || w > maxThumbnailSize || h > maxThumbnailSize {
+		return image.Point{}, fmt.Errorf("invalid size %q", s)
+	}
+	return image.Pt(w, h), nil
+}
+
+// thumbnails returns PNG images of the mesh at path at each of the given
+// sizes.  Images are cached alongside the mesh, which is only read when an
+// image is missing.
+func (srv *SnuggieServer) thumbnails(path string, sizes []image.Point) ([][]byte, error) {
+	var m *mesh.Mesh
+	var images [][]byte
+	for _, size := range sizes {
+		size := size
+		view := srv.ThumbnailView
+		suffix := fmt.Sprintf("thumb-%dx%d-%g-%g.png", size.X, size.Y, view.Azimuth, view.Elevation)
+		thumb, err := derivedMeshFile(path, suffix, func(w io.Writer) error {
+			if m == nil {
+				var err error
+				m, err = mesh.ReadFile(path)
+				if err != nil {
+					return err
+				}
+			}
+			return png.Encode(w, mesh.Render(m, size.X, size.Y, view))
+		})
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(thumb)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, data)
+	}
+	return images, nil
+}
+
+// thumbnailProcessor returns a processor which embeds thumbnails of the mesh
+// at path in G-code.  If no thumbnail sizes are configured it returns nil.
+func (srv *SnuggieServer) thumbnailProcessor(path string) (gcode.Processor, error) {
+	if len(srv.Thumbnails) == 0 {
+		return nil, nil
+	}
+	images, err := srv.thumbnails(path, srv.Thumbnails)
+	if err != nil {
+		return nil, err
+	}
+	p := new(gcode.EmbedThumbnails)
+	for i, size := range srv.Thumbnails {
+		p.Thumbnails = append(p.Thumbnails, gcode.Thumbnail{
+			Width:  size.X,
+			Height: size.Y,
+			PNG:    images[i],
+		})
+	}
+	return p, nil
+}
+
+// thumbnailSizes returns the sizes served by GetThumbnail, the largest last.
+func (srv *SnuggieServer) thumbnailSizes() []image.Point {
+	if len(srv.Thumbnails) == 0 {
+		return []image.Point{image.Pt(220, 124)}
+	}
+	return srv.Thumbnails
+}
+
+// GetThumbnail responds with a PNG image of the mesh for job id.  The query
+// parameter "size" selects one of the sizes listed by -thumbnails; only those
+// sizes are rendered, and each is rendered once per mesh.
+func (srv *SnuggieServer) GetThumbnail(w http.ResponseWriter, r *http.Request, id string) {
+	path, err := ViewMeshFile(id)
+	if err != nil || path == "" {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	sizes := srv.thumbnailSizes()
+	size := sizes[len(sizes)-1]
+	if s := r.FormValue("size"); s != "" {
+		size, err = parseSize(s)
+		if err != nil {
+			http.Error(w, "size: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !containsSize(sizes, size) {
+			var names []string
+			for _, s := range sizes {
+				names = append(names, fmt.Sprintf("%dx%d", s.X, s.Y))
+			}
+			http.Error(w, "size: must be one of ["+strings.Join(names, " ")+"]", http.StatusBadRequest)
+			return
+		}
+	}
+	images, err := srv.thumbnails(path, []image.Point{size})
+	if err != nil {
+		http.Error(w, "render: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, err = w.Write(images[0])
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+func containsSize(sizes []image.Point, size image.Point) bool {
+	for _, s := range sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getThumbnail(srv *SnuggieServer, id, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	srv.GetMesh(w, newRequest("GET", "/slicer/meshes/"+id+"/thumbnail.png"+query, ""))
+	return w
+}
+
+// thumbnailSize decodes the PNG image in w and returns its size.
+func thumbnailSize(t *testing.T, w *httptest.ResponseRecorder) image.Point {
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img.Bounds().Size()
+}
+
+func TestGetThumbnailSizes(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addSTLJob(t, srv)
+
+	// without -thumbnails the only size is 220x124.
+	if size := thumbnailSize(t, getThumbnail(srv, job.ID, "")); size != image.Pt(220, 124) {
+		t.Errorf("default size %v", size)
+	}
+	if size := thumbnailSize(t, getThumbnail(srv, job.ID, "?size=220x124")); size != image.Pt(220, 124) {
+		t.Errorf("size 220x124: %v", size)
+	}
+	if w := getThumbnail(srv, job.ID, "?size=16x16"); w.Code != http.StatusBadRequest {
+		t.Errorf("size 16x16: status %d (expected %d)", w.Code, http.StatusBadRequest)
+	}
+
+	// the largest configured size is the default.
+	srv.Thumbnails = []image.Point{image.Pt(16, 16), image.Pt(64, 48)}
+	if size := thumbnailSize(t, getThumbnail(srv, job.ID, "")); size != image.Pt(64, 48) {
+		t.Errorf("default size %v", size)
+	}
+	if size := thumbnailSize(t, getThumbnail(srv, job.ID, "?size=16x16")); size != image.Pt(16, 16) {
+		t.Errorf("size 16x16: %v", size)
+	}
+	w := getThumbnail(srv, job.ID, "?size=220x124")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "[16x16 64x48]") {
+		t.Errorf("size 220x124: status %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGetThumbnailInvalid(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addSTLJob(t, srv)
+
+	for _, size := range []string{"x", "16", "0x16", "-16x16", "2000x2000", "16x16x16"} {
+		w := getThumbnail(srv, job.ID, "?size="+size)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("size %q: status %d (expected %d)", size, w.Code, http.StatusBadRequest)
+		}
+	}
+	// rejected sizes are never rendered.
+	path, err := ViewMeshFile(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbs, err := filepath.Glob(path + ".thumb-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumbs) != 0 {
+		t.Errorf("thumbnails rendered: %v", thumbs)
+	}
+
+	if w := getThumbnail(srv, "unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+}
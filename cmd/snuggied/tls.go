@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// loadTLSConfig returns the configuration for serving HTTPS with the
+// certificate and private key in the given PEM files.  If clientCA is not
+// empty clients must present a certificate signed by one of the authorities
+// in the PEM file clientCA.  Such a configuration is only used for the
+// listener given to worker nodes so browsers and api key users are not
+// required to hold a certificate.
+func loadTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool reads the PEM encoded certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// clientCert returns the verified certificate presented by the client making
+// r, or nil if r was not made with one.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// requireCert wraps h so that it only serves requests made with a verified
+// client certificate.
+func requireCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientCert(r) == nil {
+			http.Error(w, "a client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// certKey returns the key which authenticates a request made with a verified
+// client certificate, or nil if r was not made with one.  The key is named
+// after the certificate's common name, so a renewed certificate keeps access
+// to the jobs of the one it replaced, and grants srv.WorkerScopes.
+func (srv *SnuggieServer) certKey(r *http.Request) *APIKey {
+	cert := clientCert(r)
+	if cert == nil {
+		return nil
+	}
+	return &APIKey{
+		ID:      "cert:" + cert.Subject.CommonName,
+		Name:    cert.Subject.CommonName,
+		Scopes:  srv.WorkerScopes,
+		Created: cert.NotBefore,
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCerts are the PEM files of a certificate authority and the server and
+// client certificates it signed.
+type testCerts struct {
+	CA                    string
+	ServerCert, ServerKey string
+	ClientCert, ClientKey string
+}
+
+// writeTestCerts writes a certificate authority, a server certificate for
+// 127.0.0.1 and a client certificate named client to PEM files in dir.
+func writeTestCerts(t *testing.T, dir, client string) *testCerts {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := &testCerts{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server.key"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+	writePEM(t, certs.CA, "CERTIFICATE", caDER)
+	sign := func(serial int64, name string, usage x509.ExtKeyUsage, certFile, keyFile string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	}
+	sign(2, "127.0.0.1", x509.ExtKeyUsageServerAuth, certs.ServerCert, certs.ServerKey)
+	sign(3, client, x509.ExtKeyUsageClientAuth, certs.ClientCert, certs.ClientKey)
+	return certs
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: typ, Bytes: der})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testTLSClient returns a client trusting the certificate authority in certs
+// which presents the client certificate when withCert is true.
+func testTLSClient(t *testing.T, certs *testCerts, withCert bool) *http.Client {
+	pool, err := loadCertPool(certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{RootCAs: pool}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(certs.ClientCert, certs.ClientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	certs := writeTestCerts(t, srv.DataDir, "worker1")
+
+	config, err := loadTLSConfig(certs.ServerCert, certs.ServerKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Errorf("client auth without a ca: %v", config.ClientAuth)
+	}
+	config, err = loadTLSConfig(certs.ServerCert, certs.ServerKey, certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("client auth with a ca: %v", config.ClientAuth)
+	}
+	_, err = loadTLSConfig(certs.ServerCert, certs.ServerKey, certs.ServerKey)
+	if err == nil {
+		t.Errorf("ca file without certificates accepted")
+	}
+}
+
+func TestWorkerTLS(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	srv.WorkerScopes = []string{ScopeRead}
+	certs := writeTestCerts(t, srv.DataDir, "worker1")
+
+	config, err := loadTLSConfig(certs.ServerCert, certs.ServerKey, certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(srv.RegisterWorkerHandlers(http.NewServeMux()))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the certificate authenticates the worker without an api key.
+	client := testTLSClient(t, certs, true)
+	resp, err := client.Get(ts.URL + "/slicer/quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := new(QuotaReport)
+	err = json.NewDecoder(resp.Body).Decode(report)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || report.Key != "cert:worker1" {
+		t.Errorf("quota: status %d key %q", resp.StatusCode, report.Key)
+	}
+
+	// the certificate grants only the worker scopes and admin routes are not
+	// served to workers.
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/slicer/jobs", http.StatusForbidden},
+		{"GET", "/slicer/admin/keys", http.StatusNotFound},
+		{"GET", "/metrics", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest(test.method, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s %s: status %d (expected %d)", test.method, test.path, resp.StatusCode, test.code)
+		}
+	}
+
+	// a client without a certificate fails the handshake.
+	resp, err = testTLSClient(t, certs, false).Get(ts.URL + "/slicer/quota")
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("request without a client certificate: status %d", resp.StatusCode)
+	}
+}
+
+func TestRequireCert(t *testing.T) {
+	h := requireCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("GET", "/slicer/jobs", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d (expected %d)", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+)
+
+// GetUI serves a web page for slicing mesh files in a browser.  The page uses
+// only the REST API, with the api key entered by the user.
+func (srv *SnuggieServer) GetUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := io.WriteString(w, uiHTML)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+// uiHTML is the page served at /slicer/.  Requests are made relative to the
+// page so it works under any path prefix.
+const uiHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>snuggied</title>
+<style>
+body { font-family: sans-serif; margin: 1em auto; max-width: 40em; color: #222; }
+h1 { font-size: 1.4em; }
+label { display: inline-block; width: 5em; }
+p { margin: 0.6em 0; }
+#drop { border: 2px dashed #aaa; border-radius: 6px; padding: 2em; text-align: center; color: #666; margin: 1em 0; }
+#drop.over { border-color: #4a90e2; background: #f0f6fd; }
+#file { display: none; }
+.progress { width: 100%; height: 1em; background: #eee; margin: 0.4em 0; }
+.progress div { height: 100%; width: 0; background: #4a90e2; }
+.error { color: #b00; }
+#jobs .job { border-top: 1px solid #ddd; padding: 0.6em 0; }
+#jobs .name { font-weight: bold; }
+#jobs a { margin-left: 0.6em; }
+</style>
+</head>
+<body>
+<h1>snuggied</h1>
+<p><label for="key">API key</label> <input id="key" type="password" size="40"></p>
+<p><label for="backend">Backend</label> <select id="backend"></select></p>
+<p><label for="preset">Preset</label> <select id="preset"></select></p>
+<div id="drop">Drag an STL or AMF file here or <a href="#" id="choose">choose a file</a>.</div>
+<input id="file" type="file" accept=".stl,.amf">
+<p id="status"></p>
+<div id="jobs"></div>
+
+<script>
+(function() {
+	var keyInput = document.getElementById("key");
+	var backendSelect = document.getElementById("backend");
+	var presetSelect = document.getElementById("preset");
+	var drop = document.getElementById("drop");
+	var fileInput = document.getElementById("file");
+	var backends = [];
+
+	keyInput.value = localStorage.getItem("snuggies_api_key") || "";
+	keyInput.onchange = function() {
+		localStorage.setItem("snuggies_api_key", keyInput.value);
+		loadPresets();
+	};
+
+	function request(method, path, done, progress) {
+		var xhr = new XMLHttpRequest();
+		xhr.open(method, path);
+		if (keyInput.value) {
+			xhr.setRequestHeader("Authorization", "Bearer " + keyInput.value);
+		}
+		if (progress) {
+			xhr.upload.onprogress = progress;
+		}
+		xhr.onload = function() {
+			if (xhr.status >= 400) {
+				done(null, method + " " + path + ": " + xhr.status + " " + xhr.responseText);
+				return;
+			}
+			done(xhr, null);
+		};
+		xhr.onerror = function() {
+			done(null, method + " " + path + ": connection failed");
+		};
+		return xhr;
+	}
+
+	function setStatus(msg, isError) {
+		var el = document.getElementById("status");
+		el.textContent = msg;
+		el.className = isError ? "error" : "";
+	}
+
+	function option(select, value) {
+		var opt = document.createElement("option");
+		opt.value = value;
+		opt.textContent = value;
+		select.appendChild(opt);
+	}
+
+	function fillPresets() {
+		while (presetSelect.firstChild) {
+			presetSelect.removeChild(presetSelect.firstChild);
+		}
+		for (var i = 0; i < backends.length; i++) {
+			if (backends[i].slicer !== backendSelect.value) {
+				continue;
+			}
+			for (var j = 0; j < backends[i].presets.length; j++) {
+				option(presetSelect, backends[i].presets[j]);
+			}
+		}
+	}
+	backendSelect.onchange = fillPresets;
+
+	function loadPresets() {
+		request("GET", "presets/", function(xhr, err) {
+			if (err) {
+				setStatus(err, true);
+				return;
+			}
+			backends = JSON.parse(xhr.responseText);
+			while (backendSelect.firstChild) {
+				backendSelect.removeChild(backendSelect.firstChild);
+			}
+			for (var i = 0; i < backends.length; i++) {
+				option(backendSelect, backends[i].slicer);
+			}
+			fillPresets();
+			setStatus("", false);
+		}).send();
+	}
+
+	function element(parent, tag, className, text) {
+		var el = document.createElement(tag);
+		if (className) {
+			el.className = className;
+		}
+		if (text) {
+			el.textContent = text;
+		}
+		parent.appendChild(el);
+		return el;
+	}
+
+	function formatTime(seconds) {
+		var h = Math.floor(seconds / 3600);
+		var m = Math.floor(seconds % 3600 / 60);
+		return (h > 0 ? h + "h " : "") + m + "m";
+	}
+
+	// download retrieves the G-code with the api key and saves it under the
+	// mesh file's name.
+	function download(job, name) {
+		var xhr = request("GET", "gcodes/" + job.id, function(xhr, err) {
+			if (err) {
+				setStatus(err, true);
+				return;
+			}
+			var a = document.createElement("a");
+			a.href = URL.createObjectURL(xhr.response);
+			a.download = name.replace(/\.[^.]*$/, "") + ".gcode";
+			document.body.appendChild(a);
+			a.click();
+			document.body.removeChild(a);
+		});
+		xhr.responseType = "blob";
+		xhr.send();
+	}
+
+	function watch(job, name, view) {
+		request("GET", "jobs/" + job.id, function(xhr, err) {
+			if (err) {
+				view.status.textContent = err;
+				view.status.className = "error";
+				return;
+			}
+			job = JSON.parse(xhr.responseText);
+			view.bar.style.width = Math.round(job.progress * 100) + "%";
+			view.status.textContent = job.status + (job.cached ? " (cached)" : "");
+			if (job.status === "accepted" || job.status === "processing") {
+				setTimeout(function() { watch(job, name, view); }, 1000);
+				return;
+			}
+			if (job.status === "failed") {
+				view.status.textContent = "failed: " + job.error;
+				view.status.className = "error";
+				return;
+			}
+			if (job.status !== "complete") {
+				return;
+			}
+			var details = [];
+			if (job.stats) {
+				details.push(job.stats.layers + " layers");
+				details.push((job.stats.filament_length / 1000).toFixed(2) + " m filament");
+			}
+			if (job.estimate) {
+				details.push(formatTime(job.estimate.total));
+			}
+			if (details.length > 0) {
+				view.status.textContent += ": " + details.join(", ");
+			}
+			var b = element(view.job, "button", "", "Download G-code");
+			b.onclick = function() { download(job, name); };
+			var a = element(view.job, "a", "", "View");
+			a.href = "jobs/" + job.id + "/view";
+			a.target = "_blank";
+		}).send();
+	}
+
+	function slice(file) {
+		var view = {};
+		view.job = element(document.getElementById("jobs"), "div", "job");
+		element(view.job, "div", "name", file.name + " (" + backendSelect.value + "/" + presetSelect.value + ")");
+		var bar = element(view.job, "div", "progress");
+		view.bar = element(bar, "div");
+		view.status = element(view.job, "div", "", "uploading");
+
+		var form = new FormData();
+		form.append("slicer", backendSelect.value);
+		form.append("preset", presetSelect.value);
+		form.append("meshfile", file);
+		request("POST", "jobs", function(xhr, err) {
+			if (err) {
+				view.status.textContent = err;
+				view.status.className = "error";
+				return;
+			}
+			view.bar.style.width = "0";
+			watch(JSON.parse(xhr.responseText), file.name, view);
+		}, function(e) {
+			if (e.lengthComputable) {
+				view.bar.style.width = Math.round(e.loaded / e.total * 100) + "%";
+			}
+		}).send(form);
+	}
+
+	document.getElementById("choose").onclick = function(e) {
+		e.preventDefault();
+		fileInput.click();
+	};
+	fileInput.onchange = function() {
+		for (var i = 0; i < fileInput.files.length; i++) {
+			slice(fileInput.files[i]);
+		}
+		fileInput.value = "";
+	};
+	drop.ondragover = function(e) {
+		e.preventDefault();
+		drop.className = "over";
+	};
+	drop.ondragleave = function() {
+		drop.className = "";
+	};
+	drop.ondrop = function(e) {
+		e.preventDefault();
+		drop.className = "";
+		for (var i = 0; i < e.dataTransfer.files.length; i++) {
+			slice(e.dataTransfer.files[i]);
+		}
+	};
+
+	loadPresets();
+})();
+</script>
+</body>
+</html>
+`
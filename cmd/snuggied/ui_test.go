@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUIRoutes(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	h := srv.RegisterHandlers(http.NewServeMux())
+
+	// the page holds no data and is served without an api key.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("GET", "/slicer/", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ui: status %d %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "<title>snuggied</title>") {
+		t.Errorf("ui: %s %.60q", w.Header().Get("Content-Type"), w.Body)
+	}
+	// requests are relative to the page so it works under any prefix.
+	if strings.Contains(w.Body.String(), `"/slicer`) {
+		t.Errorf("ui: page contains an absolute /slicer path")
+	}
+
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/slicer/unknown", http.StatusNotFound},
+		{"GET", "/slicer/index.html", http.StatusNotFound},
+		{"POST", "/slicer/", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(test.method, test.path, ""))
+		if w.Code != test.code {
+			t.Errorf("%s %s: status %d (expected %d)", test.method, test.path, w.Code, test.code)
+		}
+	}
+}
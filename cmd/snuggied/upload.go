@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// CreateUpload begins a resumable upload session.  The request form must
+// contain the mesh file's name and its total size in bytes.
+func (srv *SnuggieServer) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	filename := filepath.Base(r.FormValue("filename"))
+	if filename == "." || filename == "/" {
+		http.Error(w, "missing filename", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	release, ok := srv.enforceQuota(w, r, false, size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	upload := slicerjob.NewUpload(filename, size)
+	upload.URL = srv.url("/uploads/" + upload.ID)
+	upload.Owner = srv.owner(r)
+	f, err := os.Create(srv.uploadPath(upload.ID))
+	if err != nil {
+		http.Error(w, "upload create: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	err = PutUpload(upload.ID, upload)
+	if err != nil {
+		os.Remove(srv.uploadPath(upload.ID))
+		http.Error(w, "upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	srv.countUpload(r, size)
+	srv.metrics.uploaded(size)
+
+	w.Header().Set("Location", upload.URL)
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(upload)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// GetUpload reports the number of bytes received for an upload session.
+// Clients use the reported offset to resume an interrupted upload.
+func (srv *SnuggieServer) GetUpload(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.trimPath(r.URL.Path, "/uploads/")
+	upload, err := srv.lookupUpload(r, id)
+	if err != nil {
+		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	err = json.NewEncoder(w).Encode(upload)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// PutUploadChunk appends a chunk of the mesh file to an upload session.  The
+// chunk is located using the Content-Range header and must begin at the
+// current offset of the upload.  If the offset does not match the response is
+// 409 Conflict and the body contains the upload as it exists on the server.
+func (srv *SnuggieServer) PutUploadChunk(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	id, _ := srv.trimPath(r.URL.Path, "/uploads/")
+	if !srv.reserveUpload(id) {
+		http.Error(w, "upload in progress", http.StatusConflict)
+		return
+	}
+	defer srv.releaseUpload(id)
+
+	upload, err := srv.lookupUpload(r, id)
+	if err != nil {
+		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, "content-range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if total != upload.Size || end >= upload.Size {
+		http.Error(w, "content-range: does not match upload size", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if start != upload.Offset {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(upload)
+		return
+	}
+
+	// bytes are appended to the file as they arrive so that a connection
+	// dropped mid-chunk still advances the offset.
+	f, err := os.OpenFile(srv.uploadPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		http.Error(w, "upload open: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, end-start+1))
+	errclose := f.Close()
+	if err == nil {
+		err = errclose
+	}
+	upload.Offset += n
+	if err != nil {
+		http.Error(w, "upload write: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n != end-start+1 {
+		http.Error(w, "upload write: short chunk", http.StatusBadRequest)
+		return
+	}
+	err = json.NewEncoder(w).Encode(upload)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// DeleteUpload abandons an upload session and discards any received bytes.
+func (srv *SnuggieServer) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.trimPath(r.URL.Path, "/uploads/")
+	_, err := srv.lookupUpload(r, id)
+	if err != nil {
+		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	srv.removeUpload(id)
+}
+
+// lookupUpload retrieves the upload with the given id and computes its offset
+// from the data that has been written to disk.  Uploads belonging to other
+// users are reported as not found so their existence is not revealed.
+func (srv *SnuggieServer) lookupUpload(r *http.Request, id string) (*slicerjob.Upload, error) {
+	upload, err := ViewUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.isOwner(r, upload.Owner) {
+		return nil, fmt.Errorf("upload not found: %v", id)
+	}
+	stat, err := os.Stat(srv.uploadPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("upload data: %v", err)
+	}
+	upload.Offset = stat.Size()
+	return upload, nil
+}
+
+func (srv *SnuggieServer) removeUpload(id string) {
+	err := DeleteUpload(id)
+	if err != nil {
+		log.Printf("upload %v: %v", id, err)
+	}
+	err = os.Remove(srv.uploadPath(id))
+	if err != nil {
+		log.Printf("upload %v: %v", id, err)
+	}
+}
+
+func (srv *SnuggieServer) uploadPath(id string) string {
+	return filepath.Join(srv.DataDir, id+".upload")
+}
+
+// reserveUpload prevents concurrent writes to the upload with the given id.
+// If reserveUpload returns true the caller must call releaseUpload when
+// writing is complete.
+func (srv *SnuggieServer) reserveUpload(id string) bool {
+	srv.uploadMut.Lock()
+	defer srv.uploadMut.Unlock()
+	if srv.uploadBusy == nil {
+		srv.uploadBusy = make(map[string]bool)
+	}
+	if srv.uploadBusy[id] {
+		return false
+	}
+	srv.uploadBusy[id] = true
+	return true
+}
+
+func (srv *SnuggieServer) releaseUpload(id string) {
+	srv.uploadMut.Lock()
+	delete(srv.uploadBusy, id)
+	srv.uploadMut.Unlock()
+}
+
+// parseContentRange parses a header of the form "bytes start-end/total".
+func parseContentRange(header string) (start, end, total int64, err error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("missing or invalid unit")
+	}
+	spec := strings.TrimPrefix(header, "bytes ")
+	slash := strings.Index(spec, "/")
+	dash := strings.Index(spec, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+	start, err = strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid start")
+	}
+	end, err = strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid end")
+	}
+	total, err = strconv.ParseInt(spec[slash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid total")
+	}
+	if start < 0 || end < start || total <= end {
+		return 0, 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+	return start, end, total, nil
+}
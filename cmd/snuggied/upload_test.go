@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+func TestParseContentRange(t *testing.T) {
+	for _, test := range []struct {
+		header            string
+		start, end, total int64
+		ok                bool
+	}{
+		{"bytes 0-9/10", 0, 9, 10, true},
+		{"bytes 4-4/5", 4, 4, 5, true},
+		{"bytes 0-9/*", 0, 0, 0, false},
+		{"bytes 5-4/10", 0, 0, 0, false},
+		{"bytes 0-10/10", 0, 0, 0, false},
+		{"bytes -1-4/10", 0, 0, 0, false},
+		{"bytes 0-4", 0, 0, 0, false},
+		{"items 0-4/10", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	} {
+		start, end, total, err := parseContentRange(test.header)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v", test.header, err)
+			continue
+		}
+		if start != test.start || end != test.end || total != test.total {
+			t.Errorf("%q: %d-%d/%d (expected %d-%d/%d)", test.header, start, end, total, test.start, test.end, test.total)
+		}
+	}
+}
+
+// putChunk sends body as the bytes of upload id given by contentRange and
+// returns the response status and the upload in the response body.
+func putChunk(t *testing.T, srv *SnuggieServer, id, contentRange, body string) (int, *slicerjob.Upload) {
+	w := httptest.NewRecorder()
+	r := newRequest("PUT", "/slicer/uploads/"+id, body)
+	r.Header.Set("Content-Range", contentRange)
+	srv.PutUploadChunk(w, r)
+	upload := new(slicerjob.Upload)
+	if w.Code == http.StatusOK || w.Code == http.StatusConflict {
+		err := json.NewDecoder(w.Body).Decode(upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, upload
+}
+
+func TestUploadResume(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	srv.CreateUpload(w, newRequest("POST", "/slicer/uploads", "filename=cube.stl&size=10"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d %s", w.Code, w.Body)
+	}
+	upload := new(slicerjob.Upload)
+	err := json.NewDecoder(w.Body).Decode(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := upload.ID
+
+	code, upload := putChunk(t, srv, id, "bytes 0-3/10", "soli")
+	if code != http.StatusOK || upload.Offset != 4 {
+		t.Fatalf("first chunk: status %d offset %d", code, upload.Offset)
+	}
+
+	// a chunk sent again after a lost response conflicts and reports the
+	// offset to continue from.
+	code, upload = putChunk(t, srv, id, "bytes 0-3/10", "soli")
+	if code != http.StatusConflict || upload.Offset != 4 {
+		t.Errorf("repeated chunk: status %d offset %d (expected %d offset 4)", code, upload.Offset, http.StatusConflict)
+	}
+	code, _ = putChunk(t, srv, id, "bytes 4-9/11", "d cube")
+	if code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("wrong total: status %d (expected %d)", code, http.StatusRequestedRangeNotSatisfiable)
+	}
+
+	// bytes of an interrupted chunk are kept.
+	code, _ = putChunk(t, srv, id, "bytes 4-9/10", "d c")
+	if code != http.StatusBadRequest {
+		t.Errorf("short chunk: status %d (expected %d)", code, http.StatusBadRequest)
+	}
+	w = httptest.NewRecorder()
+	srv.GetUpload(w, newRequest("GET", "/slicer/uploads/"+id, ""))
+	err = json.NewDecoder(w.Body).Decode(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Offset != 7 {
+		t.Errorf("offset after short chunk: %d (expected 7)", upload.Offset)
+	}
+
+	code, upload = putChunk(t, srv, id, "bytes 7-9/10", "ube")
+	if code != http.StatusOK || !upload.Complete() {
+		t.Fatalf("last chunk: status %d offset %d", code, upload.Offset)
+	}
+	p, err := ioutil.ReadFile(srv.uploadPath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "solid cube" {
+		t.Errorf("upload data: %q", p)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// Validation modes.  In warn mode problems found in G-code are reported on
+// the job.  In strict mode they also fail the job.
+const (
+	ValidateOff    = "off"
+	ValidateWarn   = "warn"
+	ValidateStrict = "strict"
+)
+
+func parseValidation(mode string) (string, error) {
+	switch mode {
+	case ValidateOff, ValidateWarn, ValidateStrict:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown validation mode %q", mode)
+}
+
+// limits returns the printer limits for preset.  The bed size and maximum
+// print height are read from the preset configuration if they are present.
+func (srv *SnuggieServer) limits(preset string) gcode.Limits {
+	limits := srv.Limits
+	config, err := ReadConfigSlic3r(srv.Slic3rPresets[preset])
+	if err != nil {
+		return limits
+	}
+	size := strings.Split(config["bed_size"], ",")
+	if len(size) == 2 {
+		x, errx := strconv.ParseFloat(strings.TrimSpace(size[0]), 64)
+		y, erry := strconv.ParseFloat(strings.TrimSpace(size[1]), 64)
+		if errx == nil && erry == nil && x > 0 && y > 0 {
+			limits.BedSize = [2]float64{x, y}
+		}
+	}
+	z, err := strconv.ParseFloat(config["max_print_height"], 64)
+	if err == nil && z > 0 {
+		limits.MaxZ = z
+	}
+	return limits
+}
+
+// validationFailed marks job as Failed if validation is strict and its G-code
+// has problems.  It returns true if the job failed.
+func (srv *SnuggieServer) validationFailed(job *slicerjob.Job) bool {
+	if srv.Validation != ValidateStrict || len(job.Warnings) == 0 {
+		return false
+	}
+	msgs := make([]string, len(job.Warnings))
+	for i, issue := range job.Warnings {
+		msgs[i] = issue.String()
+	}
+	job.Status = slicerjob.Failed
+	job.Error = "validation: " + strings.Join(msgs, "; ")
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+func TestJobDoneStrictValidation(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Validation = ValidateStrict
+	srv.Limits = gcode.Limits{MaxZ: 0.3}
+
+	job := slicerjob.New()
+	job.Status = slicerjob.Processing
+	job.MeshSHA256 = "mesh"
+	job.Slicer = "slic3r"
+	job.Preset = "hq"
+	key, err := srv.resultKey(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.CacheKey = key
+	err = PutJob(job.ID, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(srv.DataDir, job.ID+".gcode")
+	err = ioutil.WriteFile(path, []byte(testGCode), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.JobDone(job.ID, path, nil)
+	job, err = ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != slicerjob.Failed {
+		t.Errorf("status %v, want failed", job.Status)
+	}
+	if job.GCodeURL != "" {
+		t.Errorf("rejected job has gcode url %q", job.GCodeURL)
+	}
+	rec, err := ViewResult(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec != nil {
+		t.Errorf("rejected gcode was cached")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+	"github.com/gophergala/matching-snuggies/mesh"
+)
+
+var viewerTemplate = template.Must(template.New("viewer").Parse(viewerHTML))
+
+// GetJobViewer serves a page which draws the mesh and toolpaths of the job in
+// the request path.  Like the dashboard the page contains no job data; it is
+// fetched with the api key entered by the user.
+func (srv *SnuggieServer) GetJobViewer(w http.ResponseWriter, r *http.Request) {
+	suffix, _ := srv.trimPath(r.URL.Path, "/jobs/")
+	id := strings.TrimSuffix(suffix, "/view")
+	data := struct {
+		ID     string
+		Colors map[string]string
+	}{id, gcode.FeatureColors}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := viewerTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
+
+// GetMeshSTL responds with the mesh for job id as binary STL, whatever the
+// format it was uploaded in.  The conversion is kept alongside the mesh.
+func (srv *SnuggieServer) GetMeshSTL(w http.ResponseWriter, r *http.Request, id string) {
+	path, err := ViewMeshFile(id)
+	if err != nil || path == "" {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	stl, err := derivedMeshFile(path, "view.stl", func(w io.Writer) error {
+		m, err := mesh.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return mesh.WriteSTL(w, m)
+	})
+	if err != nil {
+		http.Error(w, "mesh: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "model/stl")
+	http.ServeFile(w, r, stl)
+}
+
+// GetToolpaths responds with the toolpaths of every layer of the G-code for
+// job id.  Travel moves are included if the query parameter "travel" is 1.
+func (srv *SnuggieServer) GetToolpaths(w http.ResponseWriter, r *http.Request, id string) {
+	layers, err := srv.lookupLayers(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	path, err := ViewGCodeFile(id)
+	if err != nil || path == "" {
+		http.Error(w, errNoLayers.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "gcode: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	paths, err := gcode.Toolpaths(f, layers, r.FormValue("travel") == "1")
+	if err != nil {
+		http.Error(w, "gcode: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(paths)
+	if err != nil {
+		log.Printf("http response: %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+// viewerHTML is the template for the page served at /slicer/jobs/:id/view.
+// The mesh and toolpaths are requested relative to the page so it works under
+// any path prefix.  The mesh is moved to sit on the bed under the toolpaths,
+// as the slicer does when it places a model.
+const viewerHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>snuggied job {{.ID}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+#bar { padding: 0.5em 1em; border-bottom: 1px solid #ddd; }
+#bar label { margin-right: 1em; }
+#layer { width: 20em; vertical-align: middle; }
+#legend span { display: inline-block; margin-right: 1em; font-size: 0.8em; }
+#legend i { display: inline-block; width: 0.8em; height: 0.8em; margin-right: 0.3em; }
+#status { color: #888; font-size: 0.8em; }
+.error { color: #b00; }
+canvas { display: block; cursor: move; }
+</style>
+</head>
+<body>
+<div id="bar">
+<p>
+API key <input id="key" type="password" size="30">
+<button id="save">Load</button>
+<span id="status"></span>
+</p>
+<p>
+<label><input id="showmesh" type="checkbox" checked> Mesh</label>
+<label><input id="showpaths" type="checkbox" checked> Toolpaths</label>
+<label><input id="showtravel" type="checkbox"> Travel</label>
+Layer <input id="layer" type="range" min="0" max="0" value="0"> <span id="layerinfo"></span>
+</p>
+<p id="legend"></p>
+</div>
+<canvas id="view"></canvas>
+
+<script>
+(function() {
+	var jobID = {{.ID}};
+	var colors = {{.Colors}};
+	var keyInput = document.getElementById("key");
+	var slider = document.getElementById("layer");
+	var canvas = document.getElementById("view");
+	var ctx = canvas.getContext("2d");
+
+	var triangles = null; // flat array of 9 coordinates per triangle
+	var layers = null;    // toolpaths, as returned by gcodes/:id/toolpaths
+	var offset = [0, 0, 0];
+	var center = [0, 0, 0];
+	var radius = 1;
+	var azimuth = -Math.PI / 4;
+	var elevation = Math.PI / 6;
+	var zoom = 1;
+
+	keyInput.value = localStorage.getItem("snuggies_api_key") || "";
+	document.getElementById("save").onclick = function() {
+		localStorage.setItem("snuggies_api_key", keyInput.value);
+		load();
+	};
+
+	function setStatus(msg, isError) {
+		var el = document.getElementById("status");
+		el.textContent = msg;
+		el.className = isError ? "error" : "";
+	}
+
+	function request(path, type, done) {
+		var xhr = new XMLHttpRequest();
+		xhr.open("GET", path);
+		xhr.responseType = type;
+		if (keyInput.value) {
+			xhr.setRequestHeader("Authorization", "Bearer " + keyInput.value);
+		}
+		xhr.onload = function() {
+			if (xhr.status >= 400) {
+				done(null, "GET " + path + ": " + xhr.status);
+				return;
+			}
+			done(xhr.response, null);
+		};
+		xhr.onerror = function() {
+			done(null, "GET " + path + ": connection failed");
+		};
+		xhr.send();
+	}
+
+	// parseSTL reads the binary STL written by snuggied.
+	function parseSTL(buf) {
+		var dv = new DataView(buf);
+		var n = dv.getUint32(80, true);
+		var tris = new Float32Array(9 * n);
+		for (var i = 0; i < n; i++) {
+			for (var k = 0; k < 9; k++) {
+				tris[9 * i + k] = dv.getFloat32(84 + 50 * i + 12 + 4 * k, true);
+			}
+		}
+		return tris;
+	}
+
+	function meshBounds() {
+		var min = [Infinity, Infinity, Infinity];
+		var max = [-Infinity, -Infinity, -Infinity];
+		for (var i = 0; i < triangles.length; i++) {
+			var k = i % 3;
+			min[k] = Math.min(min[k], triangles[i]);
+			max[k] = Math.max(max[k], triangles[i]);
+		}
+		return [min, max];
+	}
+
+	function pathBounds() {
+		var min = [Infinity, Infinity, 0];
+		var max = [-Infinity, -Infinity, 0];
+		for (var i = 0; i < layers.length; i++) {
+			var paths = layers[i].paths;
+			for (var j = 0; j < paths.length; j++) {
+				if (paths[j].feature === "travel") {
+					continue;
+				}
+				var p = paths[j].points;
+				for (var k = 0; k < p.length; k += 2) {
+					min[0] = Math.min(min[0], p[k]);
+					max[0] = Math.max(max[0], p[k]);
+					min[1] = Math.min(min[1], p[k + 1]);
+					max[1] = Math.max(max[1], p[k + 1]);
+				}
+			}
+			max[2] = Math.max(max[2], layers[i].z);
+		}
+		return [min, max];
+	}
+
+	// fit centers the view on whatever has been loaded and places the mesh
+	// under the toolpaths.
+	function fit() {
+		var b = null;
+		if (layers && layers.length > 0) {
+			b = pathBounds();
+			if (!isFinite(b[0][0])) {
+				b = null;
+			}
+		}
+		if (triangles && triangles.length > 0) {
+			var m = meshBounds();
+			if (b) {
+				offset = [
+					(b[0][0] + b[1][0] - m[0][0] - m[1][0]) / 2,
+					(b[0][1] + b[1][1] - m[0][1] - m[1][1]) / 2,
+					-m[0][2]
+				];
+			} else {
+				offset = [0, 0, 0];
+				b = m;
+			}
+		}
+		if (!b) {
+			return;
+		}
+		center = [(b[0][0] + b[1][0]) / 2, (b[0][1] + b[1][1]) / 2, (b[0][2] + b[1][2]) / 2];
+		radius = Math.max(b[1][0] - b[0][0], b[1][1] - b[0][1], b[1][2] - b[0][2], 1) * 0.9;
+	}
+
+	// project maps a point to canvas coordinates and a depth, larger values
+	// being nearer the viewer.  Z is up.
+	function project(x, y, z) {
+		x -= center[0];
+		y -= center[1];
+		z -= center[2];
+		var ca = Math.cos(azimuth), sa = Math.sin(azimuth);
+		var ce = Math.cos(elevation), se = Math.sin(elevation);
+		var u = x * ca - y * sa;
+		var v = x * sa + y * ca;
+		var h = z * ce + v * se;
+		var d = z * se - v * ce;
+		var s = zoom * Math.min(canvas.width, canvas.height) / (2 * radius);
+		return [canvas.width / 2 + u * s, canvas.height / 2 - h * s, d];
+	}
+
+	function drawMesh(alpha) {
+		// faces are lit from the viewer's direction.
+		var ce = Math.cos(elevation);
+		var eye = [-ce * Math.sin(azimuth), -ce * Math.cos(azimuth), Math.sin(elevation)];
+		var faces = [];
+		for (var i = 0; i < triangles.length; i += 9) {
+			var a = [triangles[i] + offset[0], triangles[i + 1] + offset[1], triangles[i + 2] + offset[2]];
+			var b = [triangles[i + 3] + offset[0], triangles[i + 4] + offset[1], triangles[i + 5] + offset[2]];
+			var c = [triangles[i + 6] + offset[0], triangles[i + 7] + offset[1], triangles[i + 8] + offset[2]];
+			var pa = project(a[0], a[1], a[2]);
+			var pb = project(b[0], b[1], b[2]);
+			var pc = project(c[0], c[1], c[2]);
+			var ux = b[0] - a[0], uy = b[1] - a[1], uz = b[2] - a[2];
+			var vx = c[0] - a[0], vy = c[1] - a[1], vz = c[2] - a[2];
+			var nx = uy * vz - uz * vy, ny = uz * vx - ux * vz, nz = ux * vy - uy * vx;
+			var len = Math.sqrt(nx * nx + ny * ny + nz * nz) || 1;
+			faces.push({
+				p: [pa, pb, pc],
+				depth: (pa[2] + pb[2] + pc[2]) / 3,
+				light: Math.abs(nx * eye[0] + ny * eye[1] + nz * eye[2]) / len
+			});
+		}
+		faces.sort(function(f, g) { return f.depth - g.depth; });
+		ctx.globalAlpha = alpha;
+		for (var j = 0; j < faces.length; j++) {
+			var f = faces[j];
+			var g = Math.round(80 + 150 * f.light);
+			ctx.fillStyle = "rgb(" + g + "," + g + "," + Math.min(255, g + 20) + ")";
+			ctx.beginPath();
+			ctx.moveTo(f.p[0][0], f.p[0][1]);
+			ctx.lineTo(f.p[1][0], f.p[1][1]);
+			ctx.lineTo(f.p[2][0], f.p[2][1]);
+			ctx.closePath();
+			ctx.fill();
+			ctx.strokeStyle = ctx.fillStyle;
+			ctx.stroke();
+		}
+		ctx.globalAlpha = 1;
+	}
+
+	function drawLayer(layer, alpha, showTravel) {
+		ctx.globalAlpha = alpha;
+		for (var i = 0; i < layer.paths.length; i++) {
+			var path = layer.paths[i];
+			if (path.feature === "travel" && !showTravel) {
+				continue;
+			}
+			ctx.strokeStyle = colors[path.feature] || "#000";
+			ctx.beginPath();
+			for (var k = 0; k < path.points.length; k += 2) {
+				var p = project(path.points[k], path.points[k + 1], layer.z);
+				if (k === 0) {
+					ctx.moveTo(p[0], p[1]);
+				} else {
+					ctx.lineTo(p[0], p[1]);
+				}
+			}
+			ctx.stroke();
+		}
+		ctx.globalAlpha = 1;
+	}
+
+	function draw() {
+		canvas.width = window.innerWidth;
+		canvas.height = Math.max(200, window.innerHeight - document.getElementById("bar").offsetHeight);
+		ctx.clearRect(0, 0, canvas.width, canvas.height);
+		ctx.lineJoin = "round";
+		var showPaths = document.getElementById("showpaths").checked && layers && layers.length > 0;
+		if (triangles && document.getElementById("showmesh").checked) {
+			drawMesh(showPaths ? 0.25 : 1);
+		}
+		if (!showPaths) {
+			document.getElementById("layerinfo").textContent = "";
+			return;
+		}
+		var n = parseInt(slider.value, 10);
+		var showTravel = document.getElementById("showtravel").checked;
+		ctx.lineWidth = 1;
+		for (var i = 0; i < n; i++) {
+			drawLayer(layers[i], 0.35, false);
+		}
+		ctx.lineWidth = 2;
+		drawLayer(layers[n], 1, showTravel);
+		document.getElementById("layerinfo").textContent =
+			(n + 1) + " / " + layers.length + " (z " + layers[n].z.toFixed(2) + " mm)";
+	}
+
+	function legend() {
+		var el = document.getElementById("legend");
+		var names = Object.keys(colors).sort();
+		for (var i = 0; i < names.length; i++) {
+			var span = document.createElement("span");
+			var swatch = document.createElement("i");
+			swatch.style.background = colors[names[i]];
+			span.appendChild(swatch);
+			span.appendChild(document.createTextNode(names[i].replace(/_/g, " ")));
+			el.appendChild(span);
+		}
+	}
+
+	function loadPaths() {
+		var travel = document.getElementById("showtravel").checked ? "?travel=1" : "";
+		request("../../gcodes/" + jobID + "/toolpaths" + travel, "json", function(data, err) {
+			if (err) {
+				setStatus("no toolpaths: " + err, true);
+				return;
+			}
+			var first = layers === null;
+			layers = data;
+			slider.max = Math.max(0, layers.length - 1);
+			if (first) {
+				slider.value = slider.max;
+			}
+			fit();
+			draw();
+		});
+	}
+
+	function load() {
+		setStatus("loading", false);
+		request("../" + jobID, "json", function(job, err) {
+			if (err) {
+				setStatus(err, true);
+				return;
+			}
+			setStatus(job.slicer + "/" + job.preset + ": " + job.status, false);
+			if (job.status === "complete") {
+				loadPaths();
+			}
+		});
+		request("../../meshes/" + jobID + "/mesh.stl", "arraybuffer", function(data, err) {
+			if (err) {
+				setStatus("no mesh: " + err, true);
+				return;
+			}
+			triangles = parseSTL(data);
+			fit();
+			draw();
+		});
+	}
+
+	var drag = null;
+	canvas.onmousedown = function(e) {
+		drag = [e.clientX, e.clientY];
+	};
+	window.onmouseup = function() {
+		drag = null;
+	};
+	window.onmousemove = function(e) {
+		if (!drag) {
+			return;
+		}
+		azimuth -= (e.clientX - drag[0]) * 0.01;
+		elevation += (e.clientY - drag[1]) * 0.01;
+		elevation = Math.max(-Math.PI / 2, Math.min(Math.PI / 2, elevation));
+		drag = [e.clientX, e.clientY];
+		draw();
+	};
+	canvas.onwheel = function(e) {
+		e.preventDefault();
+		zoom *= e.deltaY < 0 ? 1.1 : 1 / 1.1;
+		draw();
+	};
+	document.onkeydown = function(e) {
+		if (e.target.tagName === "INPUT") {
+			return;
+		}
+		if (e.key === "ArrowUp" || e.key === "ArrowDown") {
+			e.preventDefault();
+			var n = parseInt(slider.value, 10) + (e.key === "ArrowUp" ? 1 : -1);
+			slider.value = Math.max(0, Math.min(parseInt(slider.max, 10), n));
+			draw();
+		}
+	};
+	slider.oninput = draw;
+	document.getElementById("showmesh").onchange = draw;
+	document.getElementById("showpaths").onchange = draw;
+	document.getElementById("showtravel").onchange = loadPaths;
+	window.onresize = draw;
+
+	legend();
+	load();
+})();
+</script>
+</body>
+</html>
+`
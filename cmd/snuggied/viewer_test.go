@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gophergala/matching-snuggies/gcode"
+)
+
+func TestGetJobViewer(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	srv.Auth = true
+	h := srv.RegisterHandlers(http.NewServeMux())
+
+	// the page holds no job data and is served without an api key.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("GET", "/slicer/jobs/abc-123/view", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("viewer: status %d %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), `var jobID = "abc-123";`) {
+		t.Errorf("viewer: %s %q", w.Header().Get("Content-Type"), w.Body)
+	}
+
+	// the id in the path is escaped.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("GET", "/slicer/jobs/%3C%2Fscript%3E%3Cscript%3Ealert(1)/view", ""))
+	if strings.Contains(w.Body.String(), "<script>alert") {
+		t.Errorf("viewer: unescaped id in %q", w.Body)
+	}
+
+	// the job itself still requires an api key.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest("GET", "/slicer/jobs/abc-123", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("job: status %d (expected %d)", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGetMeshSTL(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addSTLJob(t, srv)
+
+	w := httptest.NewRecorder()
+	srv.GetMesh(w, newRequest("GET", "/slicer/meshes/"+job.ID+"/mesh.stl", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("mesh.stl: status %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Content-Type") != "model/stl" {
+		t.Errorf("mesh.stl: Content-Type %q", w.Header().Get("Content-Type"))
+	}
+	// binary STL is an 80 byte header, a triangle count and 50 bytes per
+	// triangle.
+	p := w.Body.Bytes()
+	if len(p) != 84+50 || binary.LittleEndian.Uint32(p[80:84]) != 1 {
+		t.Errorf("mesh.stl: %d bytes", len(p))
+	}
+	path, err := ViewMeshFile(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(path + ".view.stl") {
+		t.Errorf("mesh.stl: conversion not kept")
+	}
+
+	w = httptest.NewRecorder()
+	srv.GetMesh(w, newRequest("GET", "/slicer/meshes/unknown/mesh.stl", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+}
+
+func getToolpaths(t *testing.T, srv *SnuggieServer, id, query string) []gcode.LayerPaths {
+	w := httptest.NewRecorder()
+	srv.GetGCode(w, newRequest("GET", "/slicer/gcodes/"+id+"/toolpaths"+query, ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("toolpaths%s: status %d %s", query, w.Code, w.Body)
+	}
+	var layers []gcode.LayerPaths
+	err := json.NewDecoder(w.Body).Decode(&layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layers
+}
+
+// countFeature returns the number of paths of feature in layers.
+func countFeature(layers []gcode.LayerPaths, feature string) int {
+	n := 0
+	for _, layer := range layers {
+		for _, path := range layer.Paths {
+			if path.Feature == feature {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestGetToolpaths(t *testing.T) {
+	srv, cleanup := testServer(t)
+	defer cleanup()
+	job := addIndexedJob(t, srv)
+
+	layers := getToolpaths(t, srv, job.ID, "")
+	if len(layers) != 2 || layers[0].Z != 0.2 || layers[1].Z != 0.4 {
+		t.Fatalf("toolpaths: %+v", layers)
+	}
+	if countFeature(layers, gcode.FeatureTravel) != 0 {
+		t.Errorf("toolpaths: travel moves without travel=1")
+	}
+	if countFeature(getToolpaths(t, srv, job.ID, "?travel=1"), gcode.FeatureTravel) == 0 {
+		t.Errorf("toolpaths: no travel moves with travel=1")
+	}
+
+	unindexed := addGCodeJob(t, srv)
+	w := httptest.NewRecorder()
+	srv.GetGCode(w, newRequest("GET", "/slicer/gcodes/"+unindexed.ID+"/toolpaths", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unindexed job: status %d (expected %d)", w.Code, http.StatusNotFound)
+	}
+}
@@ -11,6 +11,8 @@ Call snuggier with the -h flag to see available command line configuration.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -19,6 +21,7 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -35,16 +38,44 @@ func main() {
 	slicerPreset := flag.String("preset", "hq", "specify a configuration preset for the backend")
 	presets := flag.Bool("L", false, "get list of available configuration presets for Slic3r")
 	gcodeDest := flag.String("o", "", "specify an output gcode filename")
+	format := flag.String("format", "", "download gcode in an alternative format: meatpack or bgcode")
+	chunkSize := flag.Int64("chunk", 1<<20, "mesh files larger than this many bytes are sent using resumable chunked uploads")
+	retries := flag.Int("retries", 10, "number of times to retry a failed upload chunk")
+	useHTTPS := flag.Bool("https", false, "connect to the server using https")
+	caFile := flag.String("ca", "", "PEM file of certificate authorities trusted to sign the server's certificate (default system roots)")
+	certFile := flag.String("cert", "", "PEM client certificate presented to servers requiring mutual tls (requires -key)")
+	keyFile := flag.String("key", "", "PEM private key file for -cert")
+	apiKey := flag.String("apikey", "", "API key sent to servers that require authentication (default $SNUGGIES_API_KEY)")
 	flag.Parse()
 
+	// the key is not the flag's default so that it is not printed in the
+	// usage message.
+	if *apiKey == "" {
+		*apiKey = os.Getenv("SNUGGIES_API_KEY")
+	}
+
 	client := &Client{
 		ServerAddr: *server,
+		HTTPS:      *useHTTPS,
+		APIKey:     *apiKey,
+		ChunkSize:  *chunkSize,
+		Retries:    *retries,
+	}
+	if *caFile != "" || *certFile != "" || *keyFile != "" {
+		if !*useHTTPS {
+			log.Fatalf("tls: -ca, -cert and -key require -https")
+		}
+		var err error
+		client.Client, err = tlsClient(*caFile, *certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("tls: %v", err)
+		}
 	}
 
 	if *presets == true {
 		presets, err := client.SlicerPresets()
 		if err != nil {
-			fmt.Errorf("something bad happened: %v", err)
+			log.Fatalf("presets: %v", err)
 		}
 		for i := range presets {
 			fmt.Println(presets[i])
@@ -95,6 +126,9 @@ func main() {
 				// continue polling up to some reasonable time limit.
 				log.Fatalf("waiting: %v", err)
 			}
+			if job.Status == slicerjob.Failed {
+				log.Fatalf("slicing failed: %v", job.Error)
+			}
 
 			if currentTick < maxTick {
 				currentTick *= 2
@@ -108,10 +142,13 @@ func main() {
 	// stop intercepting signals because it because much more difficult to stop
 	// gracefully while reading gcode from the server.
 	signal.Stop(sig)
+	for _, issue := range job.Warnings {
+		log.Printf("warning: %v", issue)
+	}
 
 	// download gcode from the slicer and write to the specified file.
 	log.Printf("retreiving gcode file")
-	r, err := client.GCode(job)
+	r, err := client.GCode(job, *format)
 	if err != nil {
 		log.Fatalf("gcode: %v", err)
 	}
@@ -141,6 +178,17 @@ type Client struct {
 	Client     *http.Client
 	ServerAddr string
 	HTTPS      bool
+
+	// APIKey is sent as a bearer token with each request when non-empty.
+	APIKey string
+
+	// ChunkSize is the size of chunks in resumable uploads.  Mesh files
+	// larger than ChunkSize are sent using resumable uploads.
+	ChunkSize int64
+
+	// Retries is the number of consecutive failures tolerated when sending
+	// an upload chunk.
+	Retries int
 }
 
 // SliceFiles tells the server to slice the specified paths.
@@ -155,6 +203,13 @@ func (c *Client) SliceFile(backend, preset string, path string) (*slicerjob.Job,
 		return nil, err
 	}
 	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() > c.chunkSize() {
+		return c.sliceUpload(backend, preset, path)
+	}
 
 	// write the multipart form out to a temporary file.  the temporary
 	// file is closed and unlinked when the function terminates.
@@ -171,15 +226,36 @@ func (c *Client) SliceFile(backend, preset string, path string) (*slicerjob.Job,
 	}
 
 	// seek back to the beginning of the form and POST it to the slicer
-	// server.  decode a slicerjob.Job from successful responses.
-	var job *slicerjob.Job
+	// server.
 	_, err = tmp.Seek(0, 0)
 	if err != nil {
 		return nil, fmt.Errorf("tempfile: %v", err)
 	}
+	return c.postJob(bodyw.FormDataContentType(), tmp)
+}
+
+// sliceUpload sends the file at path using a resumable upload and tells the
+// server to slice the uploaded file.
+func (c *Client) sliceUpload(backend, preset string, path string) (*slicerjob.Job, error) {
+	upload, err := c.UploadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"slicer": {backend},
+		"preset": {preset},
+		"upload": {upload.ID},
+	}
+	return c.postJob("application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+}
+
+// postJob POSTs a job creation form to the slicer server and decodes a
+// slicerjob.Job from successful responses.
+func (c *Client) postJob(contentType string, body io.Reader) (*slicerjob.Job, error) {
+	var job *slicerjob.Job
 	url := c.url("/slicer/jobs")
 	log.Printf("POST %v", url)
-	resp, err := c.client().Post(url, bodyw.FormDataContentType(), tmp)
+	resp, err := c.client().Post(url, contentType, body)
 	if err != nil {
 		return nil, fmt.Errorf("POST /slicer/jobs: %v", err)
 	}
@@ -279,9 +355,14 @@ func (c *Client) SlicerStatus(job *slicerjob.Job) (*slicerjob.Job, error) {
 	return jobcurr, nil
 }
 
-// GCode requests the gcode for job.
-func (c *Client) GCode(job *slicerjob.Job) (io.ReadCloser, error) {
+// GCode requests the gcode for job.  If format is not empty the gcode is
+// requested in that format.  Plain gcode is transferred with gzip compression
+// when the server supports it.
+func (c *Client) GCode(job *slicerjob.Job, format string) (io.ReadCloser, error) {
 	url := c.url("/slicer/gcodes/" + job.ID)
+	if format != "" {
+		url += "?format=" + format
+	}
 	log.Printf("GET %v", url)
 	resp, err := c.client().Get(url)
 	if err != nil {
@@ -294,10 +375,39 @@ func (c *Client) GCode(job *slicerjob.Job) (io.ReadCloser, error) {
 }
 
 func (c *Client) client() *http.Client {
-	if c.Client == nil {
-		return http.DefaultClient
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c.APIKey == "" {
+		return client
 	}
-	return c.Client
+	keyed := *client
+	keyed.Transport = &keyTransport{Key: c.APIKey, Transport: client.Transport}
+	return &keyed
+}
+
+// keyTransport adds an API key to the Authorization header of requests
+// before sending them with Transport.
+type keyTransport struct {
+	Key       string
+	Transport http.RoundTripper
+}
+
+func (t *keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it is given.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+t.Key)
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(r)
 }
 
 func (c *Client) url(pathquery string) string {
@@ -309,6 +419,49 @@ func (c *Client) url(pathquery string) string {
 	return scheme + "://" + c.ServerAddr + "/" + pathquery
 }
 
+// tlsConfig returns the configuration for connecting to a server whose
+// certificate is signed by an authority in the PEM file caFile.  If caFile is
+// empty the system's roots are trusted.  If certFile is not empty the
+// certificate and private key in certFile and keyFile are presented to the
+// server.
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := new(tls.Config)
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tlsClient returns an http client which connects to servers using the
+// configuration returned by tlsConfig.
+func tlsClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	config, err := tlsConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+	return client, nil
+}
+
 var meshExts = map[string]bool{
 	".stl": true,
 	".amf": true,
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// testCerts are the PEM files of a certificate authority and the server and
+// client certificates it signed.
+type testCerts struct {
+	CA                    string
+	ServerCert, ServerKey string
+	ClientCert, ClientKey string
+}
+
+// writeTestCerts writes a certificate authority, a server certificate for
+// 127.0.0.1 and a client certificate named client to PEM files in dir.
+func writeTestCerts(t *testing.T, dir, client string) *testCerts {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err = x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := &testCerts{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server.key"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+	writePEM(t, certs.CA, "CERTIFICATE", caDER)
+	sign := func(serial int64, name string, usage x509.ExtKeyUsage, certFile, keyFile string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	}
+	sign(2, "127.0.0.1", x509.ExtKeyUsageServerAuth, certs.ServerCert, certs.ServerKey)
+	sign(3, client, x509.ExtKeyUsageClientAuth, certs.ClientCert, certs.ClientKey)
+	return certs
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: typ, Bytes: der})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTLSClient connects to a server requiring mutual tls as with the flags
+// -https -ca=ca.pem -cert=client.pem -key=client.key.
+func TestTLSClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggier-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := writeTestCerts(t, dir, "worker1")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slicer/presets/slic3r" || len(r.TLS.PeerCertificates) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&slicerjob.SlicerPreset{Presets: []string{r.TLS.PeerCertificates[0].Subject.CommonName}})
+	}))
+	cert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	caPEM, err := ioutil.ReadFile(certs.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.AppendCertsFromPEM(caPEM)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	client := &Client{ServerAddr: strings.TrimPrefix(ts.URL, "https://"), HTTPS: true}
+	client.Client, err = tlsClient(certs.CA, certs.ClientCert, certs.ClientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	presets, err := client.SlicerPresets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 1 || presets[0] != "worker1" {
+		t.Errorf("presets: %q", presets)
+	}
+
+	// without -cert the server rejects the handshake, and without -ca the
+	// server's certificate is not trusted.
+	client.Client, err = tlsClient(certs.CA, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SlicerPresets(); err == nil {
+		t.Errorf("request without a client certificate succeeded")
+	}
+	client.Client, err = tlsClient("", certs.ClientCert, certs.ClientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SlicerPresets(); err == nil {
+		t.Errorf("request to an untrusted server succeeded")
+	}
+
+	_, err = tlsClient(certs.ClientKey, "", "")
+	if err == nil {
+		t.Errorf("ca file without certificates accepted")
+	}
+	_, err = tlsClient("", certs.ClientCert, "")
+	if err == nil {
+		t.Errorf("-cert without -key accepted")
+	}
+}
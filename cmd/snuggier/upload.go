@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// UploadFile sends the file at path to the server using a resumable upload
+// session and returns the completed upload.  Chunks that fail to send are
+// retried after querying the server for the amount of data it has received.
+// The session is recorded in a state file so that an interrupted snuggier
+// process resumes the upload when it is run again for the same file.
+func (c *Client) UploadFile(path string) (*slicerjob.Upload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := c.uploadStatePath(path, stat)
+	upload := c.resumeUpload(statePath, stat.Size())
+	if upload == nil {
+		upload, err = c.CreateUpload(filepath.Base(path), stat.Size())
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(statePath, []byte(upload.ID), 0600)
+		if err != nil {
+			log.Printf("upload state: %v", err)
+		}
+	} else {
+		log.Printf("resuming upload %v at byte %d of %d", upload.ID, upload.Offset, upload.Size)
+	}
+
+	chunk := make([]byte, c.chunkSize())
+	failures := 0
+	backoff := 500 * time.Millisecond
+	for !upload.Complete() {
+		n, err := f.ReadAt(chunk, upload.Offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		next, err := c.PutChunk(upload, chunk[:n])
+		if err == nil {
+			upload = next
+			failures = 0
+			backoff = 500 * time.Millisecond
+			continue
+		}
+
+		// the chunk may have been partially received.  wait and ask the
+		// server where to continue from.
+		failures++
+		if failures > c.retries() {
+			return nil, fmt.Errorf("upload %v: %v", upload.ID, err)
+		}
+		log.Printf("upload chunk: %v (retrying in %v)", err, backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+		next, errstat := c.UploadStatus(upload)
+		if errstat != nil {
+			log.Printf("upload status: %v", errstat)
+			continue
+		}
+		upload = next
+	}
+
+	os.Remove(statePath)
+	return upload, nil
+}
+
+// resumeUpload returns the upload recorded in the state file at statePath.
+// If there is no such upload or it cannot be resumed nil is returned.
+func (c *Client) resumeUpload(statePath string, size int64) *slicerjob.Upload {
+	id, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+	upload, err := c.UploadStatus(&slicerjob.Upload{ID: string(id)})
+	if err != nil {
+		log.Printf("cannot resume upload %s: %v", id, err)
+		os.Remove(statePath)
+		return nil
+	}
+	if upload.Size != size {
+		os.Remove(statePath)
+		return nil
+	}
+	return upload
+}
+
+// uploadStatePath returns the location of the state file for an upload of the
+// file at path.  The location changes if the file is modified.
+func (c *Client) uploadStatePath(path string, stat os.FileInfo) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n%d", c.ServerAddr, abs, stat.Size(), stat.ModTime().UnixNano())
+	return filepath.Join(os.TempDir(), "snuggier-upload-"+hex.EncodeToString(h.Sum(nil)))
+}
+
+// CreateUpload begins an upload session for a file with the given name and
+// size.
+func (c *Client) CreateUpload(filename string, size int64) (*slicerjob.Upload, error) {
+	form := url.Values{
+		"filename": {filename},
+		"size":     {strconv.FormatInt(size, 10)},
+	}
+	url := c.url("/slicer/uploads")
+	log.Printf("POST %v", url)
+	resp, err := c.client().PostForm(url, form)
+	if err != nil {
+		return nil, fmt.Errorf("POST /slicer/uploads: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, httpStatusError(resp)
+	}
+	var upload *slicerjob.Upload
+	err = json.NewDecoder(resp.Body).Decode(&upload)
+	if err != nil {
+		return nil, fmt.Errorf("response: %v", err)
+	}
+	return upload, nil
+}
+
+// PutChunk sends p to the server as the bytes of the file starting at
+// upload.Offset.  If the server has received a different amount of data the
+// current state of the upload is returned along with a nil error so that the
+// caller may continue from the server's offset.
+func (c *Client) PutChunk(upload *slicerjob.Upload, p []byte) (*slicerjob.Upload, error) {
+	url := c.url("/slicer/uploads/" + upload.ID)
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(p))
+	if err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+	end := upload.Offset + int64(len(p)) - 1
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", upload.Offset, end, upload.Size))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("PUT /slicer/uploads/: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return nil, httpStatusError(resp)
+	}
+	var next *slicerjob.Upload
+	err = json.NewDecoder(resp.Body).Decode(&next)
+	if err != nil {
+		return nil, fmt.Errorf("response: %v", err)
+	}
+	return next, nil
+}
+
+// UploadStatus returns a current copy of the provided upload.
+func (c *Client) UploadStatus(upload *slicerjob.Upload) (*slicerjob.Upload, error) {
+	url := c.url("/slicer/uploads/" + upload.ID)
+	resp, err := c.client().Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("GET /slicer/uploads/: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(resp)
+	}
+	var curr *slicerjob.Upload
+	err = json.NewDecoder(resp.Body).Decode(&curr)
+	if err != nil {
+		return nil, fmt.Errorf("response: %v", err)
+	}
+	return curr, nil
+}
+
+func (c *Client) chunkSize() int64 {
+	if c.ChunkSize <= 0 {
+		return 1 << 20
+	}
+	return c.ChunkSize
+}
+
+func (c *Client) retries() int {
+	if c.Retries <= 0 {
+		return 10
+	}
+	return c.Retries
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gophergala/matching-snuggies/slicerjob"
+)
+
+// uploadServer implements the upload session api for a single upload.  The
+// first chunk it receives is cut short and answered with an error, as when a
+// connection drops mid-chunk.
+type uploadServer struct {
+	mut    sync.Mutex
+	upload *slicerjob.Upload
+	data   []byte
+	failed bool
+	puts   []string
+}
+
+func (s *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/slicer/uploads":
+		var size int64
+		fmt.Sscan(r.FormValue("size"), &size)
+		s.upload = &slicerjob.Upload{ID: "u1", Filename: r.FormValue("filename"), Size: size}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "GET" && r.URL.Path == "/slicer/uploads/u1":
+	case r.Method == "PUT" && r.URL.Path == "/slicer/uploads/u1":
+		s.puts = append(s.puts, r.Header.Get("Content-Range"))
+		var start, end, total int64
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if start != s.upload.Offset {
+			w.WriteHeader(http.StatusConflict)
+			break
+		}
+		p, _ := ioutil.ReadAll(r.Body)
+		if !s.failed {
+			s.failed = true
+			s.data = append(s.data, p[:len(p)/2]...)
+			s.upload.Offset = int64(len(s.data))
+			http.Error(w, "connection lost", http.StatusInternalServerError)
+			return
+		}
+		s.data = append(s.data, p...)
+		s.upload.Offset = int64(len(s.data))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(s.upload)
+}
+
+func TestUploadFileResume(t *testing.T) {
+	s := new(uploadServer)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "snuggier-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := strings.Repeat("solid cube\n", 10)
+	path := filepath.Join(dir, "cube.stl")
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{
+		ServerAddr: strings.TrimPrefix(ts.URL, "http://"),
+		ChunkSize:  40,
+		Retries:    2,
+	}
+	upload, err := c.UploadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upload.Complete() {
+		t.Errorf("upload incomplete: offset %d of %d", upload.Offset, upload.Size)
+	}
+	if string(s.data) != content {
+		t.Errorf("server received %q", s.data)
+	}
+	expect := []string{"bytes 0-39/110", "bytes 20-59/110", "bytes 60-99/110", "bytes 100-109/110"}
+	if strings.Join(s.puts, ",") != strings.Join(expect, ",") {
+		t.Errorf("chunks: %q (expected %q)", s.puts, expect)
+	}
+	_, err = os.Stat(c.uploadStatePath(path, mustStat(t, path)))
+	if !os.IsNotExist(err) {
+		t.Errorf("upload state file remains: %v", err)
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat
+}
@@ -0,0 +1,341 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// ArcStats reports the work done by an ArcFitter.
+type ArcStats struct {
+	// LinesIn and LinesOut count the lines read and written.
+	LinesIn  int `json:"lines_in"`
+	LinesOut int `json:"lines_out"`
+
+	// Arcs counts the arc moves written and Replaced counts the linear
+	// moves they replaced.
+	Arcs     int `json:"arcs"`
+	Replaced int `json:"replaced"`
+
+	// Ratio is LinesIn divided by LinesOut.
+	Ratio float64 `json:"ratio"`
+}
+
+// ArcFitter replaces runs of linear moves which lie on a circle with G2/G3 arc
+// moves.  Only moves in the XY plane with absolute coordinates, the same
+// feedrate and a steady extrusion rate are combined.  The extrusion of an arc
+// equals the total extrusion of the moves it replaces.
+type ArcFitter struct {
+	// Tolerance is the maximum distance in mm between the arc and the
+	// replaced path.  If Tolerance is not positive 0.05mm is used.
+	Tolerance float64
+
+	// MinSegments is the least number of moves replaced by an arc.  If
+	// MinSegments is less than 3, 3 is used.
+	MinSegments int
+
+	// MaxRadius limits the radius of fitted arcs, in mm.  Paths which are
+	// nearly straight are left alone.  If MaxRadius is not positive 1000mm is
+	// used.
+	MaxRadius float64
+
+	// Stats is computed by Process.
+	Stats ArcStats
+}
+
+// arcSeg is a buffered linear move which is a candidate for arc fitting.
+type arcSeg struct {
+	line     string
+	from     [4]float64
+	to       [4]float64
+	feedrate float64
+	hasF     bool
+	eDigits  int
+}
+
+// Process implements the Processor interface.
+func (a *ArcFitter) Process(w io.Writer, r io.ReadSeeker) error {
+	a.Stats = ArcStats{}
+	bw := bufio.NewWriterSize(w, 64<<10)
+	f := &arcFitState{a: a, w: bw}
+	s := NewScanner(r)
+	for s.Scan() {
+		a.Stats.LinesIn++
+		c := s.Command()
+		if f.candidate(c) {
+			from := f.m.Pos
+			f.m.Exec(c, nil)
+			f.add(arcSeg{
+				line:     s.Line(),
+				from:     from,
+				to:       f.m.Pos,
+				feedrate: f.m.Feedrate,
+				hasF:     c.Has('F'),
+				eDigits:  argDigits(c.Raw, 'E'),
+			}, c.Comment)
+			continue
+		}
+		f.flush()
+		f.m.Exec(c, nil)
+		f.write(s.Line())
+	}
+	if s.Err() != nil {
+		return s.Err()
+	}
+	f.flush()
+	if f.err != nil {
+		return f.err
+	}
+	if a.Stats.LinesOut > 0 {
+		a.Stats.Ratio = round(float64(a.Stats.LinesIn)/float64(a.Stats.LinesOut), 4)
+	}
+	return bw.Flush()
+}
+
+type arcFitState struct {
+	a       *ArcFitter
+	w       *bufio.Writer
+	m       Machine
+	err     error
+	run     []arcSeg
+	comment string
+}
+
+// candidate returns true if c may be replaced by an arc.
+func (f *arcFitState) candidate(c *Command) bool {
+	if c.Code != "G1" || f.m.RelativeXYZ || f.m.Inches {
+		return false
+	}
+	if !c.Has('X') && !c.Has('Y') {
+		return false
+	}
+	for _, letter := range []byte("ZIJRABC") {
+		if c.Has(letter) {
+			return false
+		}
+	}
+	return true
+}
+
+// add appends a move to the current run, first writing out the run if the
+// move cannot continue it.
+func (f *arcFitState) add(seg arcSeg, comment string) {
+	if len(f.run) > 0 && (seg.feedrate != f.run[0].feedrate || comment != f.comment) {
+		f.flush()
+	}
+	f.comment = comment
+	f.run = append(f.run, seg)
+	for len(f.run) >= f.minSegments() {
+		if _, ok := f.fit(f.run); ok {
+			return
+		}
+		// the new move does not lie on the arc.  write the longest run
+		// which does as an arc and start again from the new move.
+		// otherwise no arc starts at the first move of the run.
+		n := len(f.run) - 1
+		if n >= f.minSegments() {
+			if arc, ok := f.fit(f.run[:n]); ok {
+				f.writeArc(f.run[:n], arc)
+				f.run = append(f.run[:0], seg)
+				return
+			}
+		}
+		f.write(f.run[0].line)
+		f.run = append(f.run[:0], f.run[1:]...)
+	}
+}
+
+func (f *arcFitState) minSegments() int {
+	if f.a.MinSegments < 3 {
+		return 3
+	}
+	return f.a.MinSegments
+}
+
+// flush writes the buffered run, as an arc if it fits one.
+func (f *arcFitState) flush() {
+	run := f.run
+	f.run = nil
+	if len(run) == 0 {
+		return
+	}
+	if len(run) >= f.minSegments() {
+		if arc, ok := f.fit(run); ok {
+			f.writeArc(run, arc)
+			return
+		}
+	}
+	for _, seg := range run {
+		f.write(seg.line)
+	}
+}
+
+func (f *arcFitState) writeArc(run []arcSeg, arc fittedArc) {
+	f.write(f.format(run, arc))
+	f.a.Stats.Arcs++
+	f.a.Stats.Replaced += len(run)
+}
+
+func (f *arcFitState) write(line string) {
+	if f.err != nil {
+		return
+	}
+	_, f.err = f.w.WriteString(line + "\n")
+	f.a.Stats.LinesOut++
+}
+
+type fittedArc struct {
+	cx, cy    float64
+	clockwise bool
+}
+
+// fit determines whether the moves in run lie on a single arc.
+func (f *arcFitState) fit(run []arcSeg) (fittedArc, bool) {
+	tol := f.a.Tolerance
+	if tol <= 0 {
+		tol = 0.05
+	}
+	maxRadius := f.a.MaxRadius
+	if maxRadius <= 0 {
+		maxRadius = 1000
+	}
+
+	p0 := run[0].from
+	pm := run[len(run)/2].from
+	pn := run[len(run)-1].to
+	cx, cy, ok := circle(p0[X], p0[Y], pm[X], pm[Y], pn[X], pn[Y])
+	if !ok {
+		return fittedArc{}, false
+	}
+	radius := math.Hypot(p0[X]-cx, p0[Y]-cy)
+	if radius > maxRadius || radius < tol {
+		return fittedArc{}, false
+	}
+
+	// all moves must turn the same way around the center, the total sweep
+	// must be less than a full circle, and every point and chord must lie
+	// near the arc.
+	var sweep, total, extruded float64
+	var clockwise bool
+	for i, seg := range run {
+		if math.Abs(seg.to[Z]-seg.from[Z]) > 0 {
+			return fittedArc{}, false
+		}
+		d := math.Abs(math.Hypot(seg.to[X]-cx, seg.to[Y]-cy) - radius)
+		if d > tol {
+			return fittedArc{}, false
+		}
+		cross := (seg.from[X]-cx)*(seg.to[Y]-cy) - (seg.from[Y]-cy)*(seg.to[X]-cx)
+		if cross == 0 {
+			return fittedArc{}, false
+		}
+		if i == 0 {
+			clockwise = cross < 0
+		} else if (cross < 0) != clockwise {
+			return fittedArc{}, false
+		}
+		a := ArcSweep(seg.from[X]-cx, seg.from[Y]-cy, seg.to[X]-cx, seg.to[Y]-cy, clockwise)
+		sweep += a
+		half := math.Abs(a) / 2
+		if sagitta := radius * (1 - math.Cos(half)); sagitta > tol {
+			return fittedArc{}, false
+		}
+		length := math.Hypot(seg.to[X]-seg.from[X], seg.to[Y]-seg.from[Y])
+		total += length
+		extruded += seg.to[E] - seg.from[E]
+	}
+	if math.Abs(sweep) >= 2*math.Pi-1e-9 {
+		return fittedArc{}, false
+	}
+
+	// the arc extrudes at a constant rate, so the rate of each move must be
+	// close to the average.
+	rate := extruded / total
+	for _, seg := range run {
+		length := math.Hypot(seg.to[X]-seg.from[X], seg.to[Y]-seg.from[Y])
+		de := seg.to[E] - seg.from[E]
+		if rate == 0 {
+			if de != 0 {
+				return fittedArc{}, false
+			}
+			continue
+		}
+		if r := de / length / rate; r < 0.75 || r > 1.25 {
+			return fittedArc{}, false
+		}
+	}
+	return fittedArc{cx: cx, cy: cy, clockwise: clockwise}, true
+}
+
+// format writes the arc move which replaces run.
+func (f *arcFitState) format(run []arcSeg, arc fittedArc) string {
+	start := run[0].from
+	end := run[len(run)-1].to
+	code := "G3"
+	if arc.clockwise {
+		code = "G2"
+	}
+	line := fmt.Sprintf("%s X%.3f Y%.3f I%.3f J%.3f", code,
+		coord(end[X]), coord(end[Y]), coord(arc.cx-start[X]), coord(arc.cy-start[Y]))
+	if end[E] != start[E] {
+		digits := 0
+		for _, seg := range run {
+			if seg.eDigits > digits {
+				digits = seg.eDigits
+			}
+		}
+		e := end[E]
+		if f.m.RelativeE {
+			e = end[E] - start[E]
+		}
+		line += fmt.Sprintf(" E%.*f", digits, e)
+	}
+	if run[0].hasF {
+		line += fmt.Sprintf(" F%g", run[0].feedrate)
+	}
+	if f.comment != "" {
+		line += " ; " + f.comment
+	}
+	return line
+}
+
+// coord rounds v for output so that tiny negative values are not written as
+// -0.000.
+func coord(v float64) float64 {
+	v = round(v, 3)
+	if v == 0 {
+		return 0
+	}
+	return v
+}
+
+// circle computes the center of the circle through three points.
+func circle(x1, y1, x2, y2, x3, y3 float64) (cx, cy float64, ok bool) {
+	d := 2 * (x1*(y2-y3) + x2*(y3-y1) + x3*(y1-y2))
+	if math.Abs(d) < 1e-12 {
+		return 0, 0, false
+	}
+	s1 := x1*x1 + y1*y1
+	s2 := x2*x2 + y2*y2
+	s3 := x3*x3 + y3*y3
+	cx = (s1*(y2-y3) + s2*(y3-y1) + s3*(y1-y2)) / d
+	cy = (s1*(x3-x2) + s2*(x1-x3) + s3*(x2-x1)) / d
+	return cx, cy, true
+}
+
+// argDigits returns the number of decimal places in the argument for letter
+// in the G-code line raw.
+func argDigits(raw string, letter byte) int {
+	for _, field := range strings.Fields(raw) {
+		if upper(field[0]) != letter {
+			continue
+		}
+		if i := strings.IndexByte(field, '.'); i >= 0 {
+			return len(field) - i - 1
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,141 @@
+package gcode
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// Block types and encodings of the binary G-code format (bgcode) read by
+// Prusa printers.
+const (
+	bgcodeVersion     = 1
+	bgcodeCRC32       = 1
+	bgcodeFileMeta    = 0
+	bgcodeGCode       = 1
+	bgcodeSlicerMeta  = 2
+	bgcodePrinterMeta = 3
+	bgcodePrintMeta   = 4
+	bgcodeDeflate     = 1
+	bgcodeEncodingINI = 0
+	bgcodeEncodingRaw = 0
+
+	// bgcodeBlockSize is the largest amount of G-code in a block.
+	bgcodeBlockSize = 65535
+)
+
+// BinaryMetadata is the key value metadata stored in binary G-code.
+// Printers display the printer and print metadata, for example the keys
+// "filament used [g]" and "estimated printing time (normal mode)".
+type BinaryMetadata struct {
+	File    map[string]string
+	Printer map[string]string
+	Print   map[string]string
+	Slicer  map[string]string
+}
+
+// EncodeBinary copies the G-code read from r to w in the binary G-code format
+// (bgcode) with the metadata in meta, which may be nil.  G-code blocks are
+// compressed using deflate.
+func EncodeBinary(w io.Writer, r io.Reader, meta *BinaryMetadata) error {
+	if meta == nil {
+		meta = new(BinaryMetadata)
+	}
+	bw := bufio.NewWriterSize(w, 64<<10)
+	header := make([]byte, 10)
+	copy(header, "GCDE")
+	binary.LittleEndian.PutUint32(header[4:], bgcodeVersion)
+	binary.LittleEndian.PutUint16(header[8:], bgcodeCRC32)
+	bw.Write(header)
+
+	// printer, print and slicer metadata are required and must be in this
+	// order.
+	if len(meta.File) > 0 {
+		err := writeBGCodeMeta(bw, bgcodeFileMeta, meta.File)
+		if err != nil {
+			return err
+		}
+	}
+	for _, block := range []struct {
+		typ  uint16
+		meta map[string]string
+	}{
+		{bgcodePrinterMeta, meta.Printer},
+		{bgcodePrintMeta, meta.Print},
+		{bgcodeSlicerMeta, meta.Slicer},
+	} {
+		err := writeBGCodeMeta(bw, block.typ, block.meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	// blocks are split at line boundaries.
+	var block bytes.Buffer
+	s := NewScanner(r)
+	for s.Scan() {
+		line := s.Line()
+		if block.Len() > 0 && block.Len()+len(line)+1 > bgcodeBlockSize {
+			err := writeBGCodeBlock(bw, bgcodeGCode, bgcodeEncodingRaw, block.Bytes())
+			if err != nil {
+				return err
+			}
+			block.Reset()
+		}
+		block.WriteString(line)
+		block.WriteByte('\n')
+	}
+	if s.Err() != nil {
+		return s.Err()
+	}
+	if block.Len() > 0 {
+		err := writeBGCodeBlock(bw, bgcodeGCode, bgcodeEncodingRaw, block.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeBGCodeMeta(w io.Writer, typ uint16, meta map[string]string) error {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k + "=" + meta[k] + "\n")
+	}
+	return writeBGCodeBlock(w, typ, bgcodeEncodingINI, buf.Bytes())
+}
+
+// writeBGCodeBlock writes a block containing data compressed with deflate.
+// The block is followed by the CRC32 checksum of its header, parameters and
+// compressed data.
+func writeBGCodeBlock(w io.Writer, typ, encoding uint16, data []byte) error {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(data)
+	err := zw.Close()
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, 14, 14+compressed.Len()+4)
+	binary.LittleEndian.PutUint16(block[0:], typ)
+	binary.LittleEndian.PutUint16(block[2:], bgcodeDeflate)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(block[8:], uint32(compressed.Len()))
+	binary.LittleEndian.PutUint16(block[12:], encoding)
+	block = append(block, compressed.Bytes()...)
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(block))
+	block = append(block, sum...)
+	_, err = w.Write(block)
+	return err
+}
@@ -0,0 +1,356 @@
+package gcode
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+)
+
+// Profile describes the motion limits of a printer.  Speeds are in mm/s and
+// accelerations in mm/s^2.  Array values are indexed by axis (X, Y, Z, E).
+type Profile struct {
+	MaxFeedrate     [4]float64 `json:"max_feedrate"`
+	MaxAcceleration [4]float64 `json:"max_acceleration"`
+
+	// Acceleration applies to printing moves, RetractAcceleration to moves of
+	// the extruder alone and TravelAcceleration to moves without extrusion.
+	Acceleration        float64 `json:"acceleration"`
+	RetractAcceleration float64 `json:"retract_acceleration"`
+	TravelAcceleration  float64 `json:"travel_acceleration"`
+
+	// JunctionDeviation limits the speed through the junction of two moves
+	// as in grbl and recent Marlin.  If JunctionDeviation is zero the
+	// classic per-axis Jerk limits are used instead.
+	JunctionDeviation float64    `json:"junction_deviation"`
+	Jerk              [4]float64 `json:"jerk"`
+
+	// MinFeedrate is the lowest speed of printing moves and
+	// MinTravelFeedrate the lowest speed of travel moves.
+	MinFeedrate       float64 `json:"min_feedrate"`
+	MinTravelFeedrate float64 `json:"min_travel_feedrate"`
+}
+
+// DefaultProfile returns a profile with limits typical of a small cartesian
+// printer running Marlin.
+func DefaultProfile() Profile {
+	return Profile{
+		MaxFeedrate:         [4]float64{300, 300, 5, 25},
+		MaxAcceleration:     [4]float64{3000, 3000, 100, 10000},
+		Acceleration:        3000,
+		RetractAcceleration: 3000,
+		TravelAcceleration:  3000,
+		Jerk:                [4]float64{10, 10, 0.4, 5},
+		MinFeedrate:         0,
+		MinTravelFeedrate:   0,
+	}
+}
+
+// ReadProfile reads a JSON encoded profile from the file at path.  Fields
+// missing from the file take values from DefaultProfile.
+func ReadProfile(path string) (Profile, error) {
+	p := DefaultProfile()
+	f, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&p)
+	return p, err
+}
+
+// Estimate is the estimated duration of a print in seconds.
+type Estimate struct {
+	Total  float64   `json:"total"`
+	Layers []float64 `json:"layers"`
+}
+
+// EstimateTime reads G-code from r and estimates the time needed to print it
+// on a printer with the given profile.
+func EstimateTime(r io.Reader, profile Profile) (*Estimate, error) {
+	e := NewEstimator(profile)
+	s := NewScanner(r)
+	for s.Scan() {
+		e.Exec(s.Command())
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return e.Estimate(), nil
+}
+
+// plannerWindow is the number of moves the Estimator plans ahead, similar to
+// the size of a firmware planner buffer.
+const plannerWindow = 32
+
+// block is a move in the planner.  Speeds are in mm/s.
+type block struct {
+	dist     float64
+	nominal  float64
+	accel    float64
+	maxEntry float64
+	entry    float64
+	unit     [4]float64
+	layer    int
+}
+
+// Estimator simulates the motion planner of printer firmware to estimate the
+// time taken by G-code.  Moves accelerate and decelerate with trapezoidal
+// velocity profiles, and speeds through the junctions between moves are
+// limited by junction deviation or jerk.
+type Estimator struct {
+	Machine Machine
+	Profile Profile
+
+	// speedFactor is the feedrate override set by M220.
+	speedFactor float64
+
+	layers   layerCounter
+	blocks   []*block
+	prev     *block
+	times    []float64
+	extruded bool
+}
+
+// NewEstimator returns an Estimator for a printer with the given profile.
+func NewEstimator(profile Profile) *Estimator {
+	return &Estimator{Profile: profile, speedFactor: 1}
+}
+
+// Exec executes c, adding the moves it makes to the simulation.
+func (e *Estimator) Exec(c *Command) {
+	switch c.Code {
+	case "G4":
+		// dwell for P milliseconds or S seconds.
+		e.flush()
+		e.addTime(e.layers.current(), c.Arg('P')/1000+c.Arg('S'))
+	case "M201":
+		for i, letter := range []byte("XYZE") {
+			if c.Has(letter) {
+				e.Profile.MaxAcceleration[i] = c.Arg(letter)
+			}
+		}
+	case "M203":
+		for i, letter := range []byte("XYZE") {
+			if c.Has(letter) {
+				e.Profile.MaxFeedrate[i] = c.Arg(letter)
+			}
+		}
+	case "M204":
+		if c.Has('S') {
+			e.Profile.Acceleration = c.Arg('S')
+			e.Profile.TravelAcceleration = c.Arg('S')
+		}
+		if c.Has('P') {
+			e.Profile.Acceleration = c.Arg('P')
+		}
+		if c.Has('R') {
+			e.Profile.RetractAcceleration = c.Arg('R')
+		}
+		if c.Has('T') {
+			e.Profile.TravelAcceleration = c.Arg('T')
+		}
+	case "M205":
+		for i, letter := range []byte("XYZE") {
+			if c.Has(letter) {
+				e.Profile.Jerk[i] = c.Arg(letter)
+			}
+		}
+		if c.Has('J') {
+			e.Profile.JunctionDeviation = c.Arg('J')
+		}
+	case "M220":
+		if c.Has('S') && c.Arg('S') > 0 {
+			e.speedFactor = c.Arg('S') / 100
+		}
+	}
+	e.Machine.Exec(c, e.move)
+}
+
+func (e *Estimator) move(mv *Move) {
+	e.layers.observe(mv)
+
+	var delta [4]float64
+	for i := range delta {
+		delta[i] = mv.To[i] - mv.From[i]
+	}
+	dist := math.Sqrt(delta[X]*delta[X] + delta[Y]*delta[Y] + delta[Z]*delta[Z])
+	extruding := delta[E] > 0
+	accel := e.Profile.TravelAcceleration
+	if dist == 0 {
+		dist = math.Abs(delta[E])
+		accel = e.Profile.RetractAcceleration
+	} else if extruding {
+		accel = e.Profile.Acceleration
+	}
+	if dist == 0 {
+		return
+	}
+
+	b := &block{dist: dist, layer: e.layers.current()}
+	for i := range delta {
+		b.unit[i] = delta[i] / dist
+	}
+
+	// limit the speed and acceleration so that no axis exceeds its limits.
+	speed := mv.Feedrate / 60 * e.speedFactor
+	minSpeed := e.Profile.MinTravelFeedrate
+	if extruding {
+		minSpeed = e.Profile.MinFeedrate
+	}
+	if speed < minSpeed {
+		speed = minSpeed
+	}
+	if speed <= 0 {
+		speed = e.Profile.MaxFeedrate[X]
+	}
+	for i := range delta {
+		u := math.Abs(b.unit[i])
+		if u == 0 {
+			continue
+		}
+		if max := e.Profile.MaxFeedrate[i]; max > 0 && speed*u > max {
+			speed = max / u
+		}
+		if max := e.Profile.MaxAcceleration[i]; max > 0 && accel*u > max {
+			accel = max / u
+		}
+	}
+	if accel <= 0 {
+		accel = math.Inf(1)
+	}
+	b.nominal = speed
+	b.accel = accel
+	b.maxEntry = e.junctionSpeed(e.prev, b)
+	e.prev = b
+
+	e.blocks = append(e.blocks, b)
+	if len(e.blocks) > plannerWindow {
+		e.plan()
+		e.pop()
+	}
+}
+
+// junctionSpeed computes the maximum speed at the junction of blocks prev and
+// next.
+func (e *Estimator) junctionSpeed(prev, next *block) float64 {
+	if prev == nil {
+		return 0
+	}
+	vmax := math.Min(prev.nominal, next.nominal)
+	if e.Profile.JunctionDeviation > 0 {
+		cos := -(prev.unit[X]*next.unit[X] + prev.unit[Y]*next.unit[Y] + prev.unit[Z]*next.unit[Z] + prev.unit[E]*next.unit[E])
+		if cos > 0.999999 {
+			// the head reverses direction.
+			return 0
+		}
+		if cos < -0.999999 {
+			return vmax
+		}
+		sinHalf := math.Sqrt(0.5 * (1 - cos))
+		v := math.Sqrt(next.accel * e.Profile.JunctionDeviation * sinHalf / (1 - sinHalf))
+		return math.Min(v, vmax)
+	}
+
+	// classic jerk: the change in velocity of each axis across the junction
+	// may not exceed its jerk limit.
+	v := vmax
+	for i := 0; i < 4; i++ {
+		dv := math.Abs(next.unit[i]*v - prev.unit[i]*v)
+		jerk := e.Profile.Jerk[i]
+		if dv > jerk {
+			if jerk <= 0 {
+				return 0
+			}
+			v *= jerk / dv
+		}
+	}
+	return v
+}
+
+// plan computes entry speeds for the buffered blocks assuming that the last
+// block must come to a stop.  The entry speed of the first block is fixed
+// because the block following it has already been executed.
+func (e *Estimator) plan() {
+	n := len(e.blocks)
+	if n == 0 {
+		return
+	}
+	exit := 0.0
+	for i := n - 1; i >= 1; i-- {
+		b := e.blocks[i]
+		b.entry = math.Min(b.maxEntry, math.Sqrt(exit*exit+2*b.accel*b.dist))
+		exit = b.entry
+	}
+	for i := 0; i < n-1; i++ {
+		b, next := e.blocks[i], e.blocks[i+1]
+		v := math.Sqrt(b.entry*b.entry + 2*b.accel*b.dist)
+		if next.entry > v {
+			next.entry = v
+		}
+	}
+}
+
+// pop executes the first buffered block.
+func (e *Estimator) pop() {
+	b := e.blocks[0]
+	exit := 0.0
+	if len(e.blocks) > 1 {
+		exit = e.blocks[1].entry
+	}
+	e.addTime(b.layer, trapezoidTime(b.dist, b.entry, b.nominal, exit, b.accel))
+	e.blocks[0] = nil
+	e.blocks = e.blocks[1:]
+}
+
+// flush executes all buffered blocks, bringing the machine to a stop.
+func (e *Estimator) flush() {
+	e.plan()
+	for len(e.blocks) > 0 {
+		e.pop()
+	}
+	e.prev = nil
+}
+
+func (e *Estimator) addTime(layer int, t float64) {
+	for len(e.times) <= layer {
+		e.times = append(e.times, 0)
+	}
+	e.times[layer] += t
+}
+
+// Estimate stops the machine and returns the estimated time of all executed
+// commands.
+func (e *Estimator) Estimate() *Estimate {
+	e.flush()
+	est := &Estimate{Layers: make([]float64, len(e.times))}
+	for i, t := range e.times {
+		est.Layers[i] = round(t, 3)
+		est.Total += t
+	}
+	est.Total = round(est.Total, 3)
+	return est
+}
+
+// trapezoidTime returns the time taken to move a distance dist which begins
+// at speed entry, accelerates to at most nominal and ends at speed exit.
+func trapezoidTime(dist, entry, nominal, exit, accel float64) float64 {
+	if math.IsInf(accel, 1) {
+		return dist / nominal
+	}
+	if entry > nominal {
+		entry = nominal
+	}
+	if exit > nominal {
+		exit = nominal
+	}
+	accelDist := (nominal*nominal - entry*entry) / (2 * accel)
+	decelDist := (nominal*nominal - exit*exit) / (2 * accel)
+	if accelDist+decelDist <= dist {
+		cruise := dist - accelDist - decelDist
+		return (nominal-entry)/accel + (nominal-exit)/accel + cruise/nominal
+	}
+	// the move never reaches its nominal speed.
+	peak := math.Sqrt((2*accel*dist + entry*entry + exit*exit) / 2)
+	return (peak-entry)/accel + (peak-exit)/accel
+}
@@ -0,0 +1,307 @@
+package gcode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ExcludeObjects labels the objects in G-code for Klipper's exclude_object
+// module, which lets a single object be cancelled during a print.  Objects
+// are detected as groups of extrusion separated from each other by at least
+// CellSize.  The first layer is ignored when detecting objects so that a
+// skirt does not join them, unless the print has a single layer.
+//
+// An EXCLUDE_OBJECT_DEFINE command giving the outline of each object is
+// inserted at the start of the file, and the extrusion of each object is
+// enclosed by EXCLUDE_OBJECT_START and EXCLUDE_OBJECT_END.  Retraction and
+// travel between objects are left outside the markers.  Extrusion which
+// belongs to no object, like a skirt, is not labeled.
+type ExcludeObjects struct {
+	// CellSize is the resolution in mm of object detection.  If CellSize is
+	// not positive 1mm is used.
+	CellSize float64
+
+	// Objects is the number of objects found by Process.
+	Objects int
+}
+
+type cell [2]int
+
+// objectMap assigns cells of the build plate to objects.
+type objectMap struct {
+	size  float64
+	cells map[cell]int
+}
+
+// cellOf returns the cell containing x, y.  Cells are centered on multiples
+// of the cell size.
+func (om *objectMap) cellOf(x, y float64) cell {
+	return cell{int(math.Floor(x/om.size + 0.5)), int(math.Floor(y/om.size + 0.5))}
+}
+
+// mark adds the cells covered by the segment from a to b.
+func (om *objectMap) mark(a, b [4]float64) {
+	n := int(math.Ceil(math.Hypot(b[X]-a[X], b[Y]-a[Y]) / (om.size / 2)))
+	for i := 0; i <= n; i++ {
+		t := 0.0
+		if n > 0 {
+			t = float64(i) / float64(n)
+		}
+		om.cells[om.cellOf(a[X]+t*(b[X]-a[X]), a[Y]+t*(b[Y]-a[Y]))] = -1
+	}
+}
+
+// label numbers the connected groups of cells and returns their count.
+// Objects are numbered in order of their lowest cell, from front to back and
+// left to right.
+func (om *objectMap) label() int {
+	keys := make([]cell, 0, len(om.cells))
+	for c := range om.cells {
+		keys = append(keys, c)
+	}
+	sort.Sort(cellOrder(keys))
+	n := 0
+	for _, start := range keys {
+		if om.cells[start] >= 0 {
+			continue
+		}
+		stack := []cell{start}
+		om.cells[start] = n
+		for len(stack) > 0 {
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					nc := cell{c[0] + dx, c[1] + dy}
+					if v, ok := om.cells[nc]; ok && v < 0 {
+						om.cells[nc] = n
+						stack = append(stack, nc)
+					}
+				}
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// object returns the object containing the point x, y or -1 if there is none.
+func (om *objectMap) object(x, y float64) int {
+	c := om.cellOf(x, y)
+	if v, ok := om.cells[c]; ok {
+		return v
+	}
+	for dx := -1; dx <= 1; dx++ {
+		for dy := -1; dy <= 1; dy++ {
+			if v, ok := om.cells[cell{c[0] + dx, c[1] + dy}]; ok {
+				return v
+			}
+		}
+	}
+	return -1
+}
+
+// outline returns the convex hull of the cells of object i.
+func (om *objectMap) outline(i int) [][2]float64 {
+	var points [][2]float64
+	for c, v := range om.cells {
+		if v != i {
+			continue
+		}
+		x, y := (float64(c[0])-0.5)*om.size, (float64(c[1])-0.5)*om.size
+		points = append(points,
+			[2]float64{x, y}, [2]float64{x + om.size, y},
+			[2]float64{x, y + om.size}, [2]float64{x + om.size, y + om.size})
+	}
+	return convexHull(points)
+}
+
+type cellOrder []cell
+
+func (s cellOrder) Len() int      { return len(s) }
+func (s cellOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s cellOrder) Less(i, j int) bool {
+	if s[i][1] != s[j][1] {
+		return s[i][1] < s[j][1]
+	}
+	return s[i][0] < s[j][0]
+}
+
+type pointOrder [][2]float64
+
+func (s pointOrder) Len() int      { return len(s) }
+func (s pointOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s pointOrder) Less(i, j int) bool {
+	if s[i][0] != s[j][0] {
+		return s[i][0] < s[j][0]
+	}
+	return s[i][1] < s[j][1]
+}
+
+// convexHull returns the convex hull of points in counter-clockwise order.
+func convexHull(points [][2]float64) [][2]float64 {
+	if len(points) < 3 {
+		return points
+	}
+	sort.Sort(pointOrder(points))
+	cross := func(o, a, b [2]float64) float64 {
+		return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+	}
+	var hull [][2]float64
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for _, p := range points {
+			for len(hull) >= start+2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		hull = hull[:len(hull)-1]
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	return hull
+}
+
+// Process implements the Processor interface.
+func (p *ExcludeObjects) Process(w io.Writer, r io.ReadSeeker) error {
+	size := p.CellSize
+	if size <= 0 {
+		size = 1
+	}
+	om, err := detectObjects(r, size)
+	if err != nil {
+		return err
+	}
+	p.Objects = om.label()
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(w, 64<<10)
+	for i := 0; i < p.Objects; i++ {
+		hull := om.outline(i)
+		var min, max [2]float64
+		var poly bytes.Buffer
+		for j, pt := range hull {
+			if j == 0 {
+				min, max = pt, pt
+			} else {
+				poly.WriteByte(',')
+			}
+			for k := range pt {
+				min[k] = math.Min(min[k], pt[k])
+				max[k] = math.Max(max[k], pt[k])
+			}
+			fmt.Fprintf(&poly, "[%s,%s]", trimFloat(pt[0]), trimFloat(pt[1]))
+		}
+		fmt.Fprintf(bw, "EXCLUDE_OBJECT_DEFINE NAME=%s CENTER=%s,%s POLYGON=[%s]\n",
+			objectName(i), trimFloat((min[0]+max[0])/2), trimFloat((min[1]+max[1])/2), poly.String())
+	}
+
+	// lines following an extrusion are held until the next extrusion shows
+	// whether they are within the same object.
+	var m Machine
+	var pending []string
+	current := -1
+	s := NewScanner(r)
+	for s.Scan() {
+		obj := -1
+		extrudes, zchange := false, false
+		m.Exec(s.Command(), func(mv *Move) {
+			if mv.To[Z] != mv.From[Z] {
+				zchange = true
+			}
+			if mv.IsExtrusion() {
+				extrudes = true
+				obj = om.object(mv.To[X], mv.To[Y])
+			}
+		})
+		if current < 0 && !extrudes {
+			fmt.Fprintln(bw, s.Line())
+			continue
+		}
+		if !extrudes {
+			pending = append(pending, s.Line())
+			if zchange && current >= 0 {
+				// objects end at layer changes.
+				fmt.Fprintf(bw, "EXCLUDE_OBJECT_END NAME=%s\n", objectName(current))
+				current = -1
+				for _, line := range pending {
+					fmt.Fprintln(bw, line)
+				}
+				pending = pending[:0]
+			}
+			continue
+		}
+		if obj != current {
+			if current >= 0 {
+				fmt.Fprintf(bw, "EXCLUDE_OBJECT_END NAME=%s\n", objectName(current))
+			}
+			for _, line := range pending {
+				fmt.Fprintln(bw, line)
+			}
+			if obj >= 0 {
+				fmt.Fprintf(bw, "EXCLUDE_OBJECT_START NAME=%s\n", objectName(obj))
+			}
+			current = obj
+		} else {
+			for _, line := range pending {
+				fmt.Fprintln(bw, line)
+			}
+		}
+		pending = pending[:0]
+		fmt.Fprintln(bw, s.Line())
+	}
+	if s.Err() != nil {
+		return s.Err()
+	}
+	if current >= 0 {
+		fmt.Fprintf(bw, "EXCLUDE_OBJECT_END NAME=%s\n", objectName(current))
+	}
+	for _, line := range pending {
+		fmt.Fprintln(bw, line)
+	}
+	return bw.Flush()
+}
+
+// detectObjects marks the cells covered by extrusion in the G-code read from
+// r.  The first layer is only used if no other layer has extrusion.
+func detectObjects(r io.Reader, size float64) (*objectMap, error) {
+	first := &objectMap{size: size, cells: make(map[cell]int)}
+	rest := &objectMap{size: size, cells: make(map[cell]int)}
+	var m Machine
+	var layers layerCounter
+	s := NewScanner(r)
+	for s.Scan() {
+		skirt := ParseFeature(s.Command().Comment) == FeatureSkirt
+		m.Exec(s.Command(), func(mv *Move) {
+			layers.observe(mv)
+			if !mv.IsExtrusion() || skirt {
+				return
+			}
+			if layers.current() == 0 {
+				first.mark(mv.From, mv.To)
+			} else {
+				rest.mark(mv.From, mv.To)
+			}
+		})
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	if len(rest.cells) == 0 {
+		return first, nil
+	}
+	return rest, nil
+}
+
+func objectName(i int) string {
+	return fmt.Sprintf("object_%d", i)
+}
@@ -0,0 +1,190 @@
+/*
+Package gcode reads and analyzes G-code produced by 3D printer slicers.
+
+Lines are parsed into Commands and executed by a Machine, which tracks the
+position of the print head and reports the linear moves it makes.  Analysis
+tools in the package, such as Analyze, are built on top of Machine.
+*/
+package gcode
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Command is a single parsed line of G-code.  For standard commands the
+// letter arguments following the code are parsed.  Extended commands, such as
+// those used by Klipper, keep their arguments unparsed in Raw.
+type Command struct {
+	// Code is the first word of the line in upper case, for example "G1" or
+	// "M104".  Code is empty for lines which contain only a comment.
+	Code string
+
+	// Comment is the text following a ';' without leading space.
+	Comment string
+
+	// Raw is the line with the comment removed.
+	Raw string
+
+	args [26]float64
+	has  uint32
+}
+
+// Parse parses a line of G-code.
+func Parse(line string) *Command {
+	c := new(Command)
+	ParseInto(c, line)
+	return c
+}
+
+// ParseInto parses a line of G-code into c, overwriting its contents.
+// ParseInto can be used to avoid allocation when processing large files.
+func ParseInto(c *Command, line string) {
+	*c = Command{}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		c.Comment = strings.TrimSpace(line[i+1:])
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	c.Raw = line
+	if line == "" {
+		return
+	}
+	fields := strings.Fields(line)
+	c.Code = strings.ToUpper(fields[0])
+	if !isStandard(c.Code) {
+		return
+	}
+	for _, f := range fields[1:] {
+		letter := upper(f[0])
+		if letter < 'A' || letter > 'Z' {
+			continue
+		}
+		c.has |= 1 << (letter - 'A')
+		v, err := strconv.ParseFloat(f[1:], 64)
+		if err == nil {
+			c.args[letter-'A'] = v
+		}
+	}
+}
+
+// isStandard returns true if code is a letter followed by a number, like G1.
+func isStandard(code string) bool {
+	if len(code) < 2 {
+		return false
+	}
+	switch code[0] {
+	case 'G', 'M', 'T':
+	default:
+		return false
+	}
+	for i := 1; i < len(code); i++ {
+		if (code[i] < '0' || code[i] > '9') && code[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+// Has returns true if the command has an argument for letter.
+func (c *Command) Has(letter byte) bool {
+	letter = upper(letter)
+	if letter < 'A' || letter > 'Z' {
+		return false
+	}
+	return c.has&(1<<(letter-'A')) != 0
+}
+
+// Arg returns the value of the argument for letter.  If the command has no
+// such argument Arg returns 0.
+func (c *Command) Arg(letter byte) float64 {
+	letter = upper(letter)
+	if letter < 'A' || letter > 'Z' {
+		return 0
+	}
+	return c.args[letter-'A']
+}
+
+// IsMove returns true if c is a linear or arc move.
+func (c *Command) IsMove() bool {
+	switch c.Code {
+	case "G0", "G1", "G2", "G3":
+		return true
+	}
+	return false
+}
+
+// Scanner reads G-code line by line and tracks the byte offset of each line.
+type Scanner struct {
+	r      *bufio.Reader
+	line   string
+	offset int64
+	next   int64
+	err    error
+	cmd    Command
+}
+
+// NewScanner returns a Scanner reading from r.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// Scan advances to the next line, which is available through Line and
+// Command.  Scan returns false when input is exhausted or an error occurs.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	line, err := s.r.ReadString('\n')
+	if len(line) == 0 {
+		if err != io.EOF {
+			s.err = err
+		}
+		return false
+	}
+	if err != nil && err != io.EOF {
+		s.err = err
+		return false
+	}
+	s.offset = s.next
+	s.next += int64(len(line))
+	s.line = strings.TrimRight(line, "\r\n")
+	ParseInto(&s.cmd, s.line)
+	return true
+}
+
+// Line returns the current line without its line terminator.
+func (s *Scanner) Line() string {
+	return s.line
+}
+
+// Command returns the parsed current line.  The returned Command is
+// overwritten by the next call to Scan.
+func (s *Scanner) Command() *Command {
+	return &s.cmd
+}
+
+// Offset returns the byte offset of the current line in the input.
+func (s *Scanner) Offset() int64 {
+	return s.offset
+}
+
+// End returns the byte offset following the current line, including its line
+// terminator.
+func (s *Scanner) End() int64 {
+	return s.next
+}
+
+// Err returns the first error encountered by Scan.
+func (s *Scanner) Err() error {
+	return s.err
+}
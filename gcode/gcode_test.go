@@ -0,0 +1,673 @@
+package gcode
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c := Parse("g1 X10.5 y-2 E0.25 F1800 ; perimeter")
+	if c.Code != "G1" {
+		t.Errorf("code: %q", c.Code)
+	}
+	if c.Comment != "perimeter" {
+		t.Errorf("comment: %q", c.Comment)
+	}
+	for _, test := range []struct {
+		letter byte
+		value  float64
+	}{
+		{'X', 10.5},
+		{'Y', -2},
+		{'E', 0.25},
+		{'F', 1800},
+	} {
+		if !c.Has(test.letter) {
+			t.Errorf("missing %c", test.letter)
+		}
+		if c.Arg(test.letter) != test.value {
+			t.Errorf("%c: %v (!= %v)", test.letter, c.Arg(test.letter), test.value)
+		}
+	}
+	if c.Has('Z') {
+		t.Errorf("unexpected Z")
+	}
+
+	c = Parse("EXCLUDE_OBJECT_START NAME=part_1")
+	if c.Code != "EXCLUDE_OBJECT_START" || c.Raw != "EXCLUDE_OBJECT_START NAME=part_1" {
+		t.Errorf("extended command: %q %q", c.Code, c.Raw)
+	}
+	if c.Has('N') {
+		t.Errorf("extended command arguments parsed")
+	}
+}
+
+func TestMachineArc(t *testing.T) {
+	var m Machine
+	m.Exec(Parse("G1 X10 Y0 E0"), nil)
+	var length, extruded float64
+	m.Exec(Parse("G3 X-10 Y0 I-10 J0 E5"), func(mv *Move) {
+		length += mv.Length()
+		extruded += mv.Extrusion()
+	})
+	if math.Abs(length-math.Pi*10) > 0.05 {
+		t.Errorf("arc length: %v", length)
+	}
+	if math.Abs(extruded-5) > 1e-9 {
+		t.Errorf("arc extrusion: %v", extruded)
+	}
+	if m.Pos != [4]float64{-10, 0, 0, 5} {
+		t.Errorf("position: %v", m.Pos)
+	}
+}
+
+func TestMachineArcLimits(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		segment float64
+		moves   int
+	}{
+		{"G2 X0 Y0 I1e8", 0, 0},
+		{"G2 X10 Y0 I1e8", 0, 1},
+		{"G2 X10 Y0 INaN", 0, 1},
+		{"G3 X10 Y0 R-Inf", 0, 1},
+		{"G2 X0 Y0 I5000", 0, maxArcSegments},
+		{"G2 X0 Y0 I10", 1e-9, maxArcSegments},
+	} {
+		m := Machine{ArcSegment: test.segment}
+		moves := 0
+		start := time.Now()
+		m.Exec(Parse(test.line), func(mv *Move) {
+			moves++
+		})
+		if moves != test.moves {
+			t.Errorf("%s: %d moves (expected %d)", test.line, moves, test.moves)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: took %v", test.line, d)
+		}
+	}
+}
+
+func TestMachineRelative(t *testing.T) {
+	var m Machine
+	for _, line := range []string{
+		"G21",
+		"G90",
+		"M83",
+		"G1 X1 Y1 E1",
+		"G1 X2 Y2 E1",
+		"G92 E0",
+		"G91",
+		"G1 X1 Z0.2",
+	} {
+		m.Exec(Parse(line), nil)
+	}
+	if m.Pos != [4]float64{3, 2, 0.2, 0} {
+		t.Errorf("position: %v", m.Pos)
+	}
+}
+
+const testGCode = `G21
+G90
+M82
+G92 E0
+G1 Z0.3 F7800
+G1 X0 Y0
+G1 X10 Y0 E1
+G1 X10 Y10 E2
+G1 E-1
+G1 Z0.4
+G1 X0 Y10
+G1 Z0.5
+G1 E2
+G1 X0 Y0 E3
+G1 X20 Y0 E4
+`
+
+func TestAnalyze(t *testing.T) {
+	stats, err := Analyze(strings.NewReader(testGCode), Filament{Diameter: 1.75, Density: 1.24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Layers != 2 {
+		t.Errorf("layers: %d", stats.Layers)
+	}
+	if len(stats.LayerHeights) != 2 || stats.LayerHeights[0] != 0.3 || stats.LayerHeights[1] != 0.2 {
+		t.Errorf("layer heights: %v", stats.LayerHeights)
+	}
+	if stats.Retractions != 1 {
+		t.Errorf("retractions: %d", stats.Retractions)
+	}
+	if stats.FilamentLength != 4 {
+		t.Errorf("filament length: %v", stats.FilamentLength)
+	}
+	want := Extents{Min: [3]float64{0, 0, 0.3}, Max: [3]float64{20, 10, 0.5}}
+	if stats.Extents != want {
+		t.Errorf("extents: %v", stats.Extents)
+	}
+	volume := 4 * math.Pi * 0.875 * 0.875
+	if math.Abs(stats.FilamentVolume-volume) > 1e-9 {
+		t.Errorf("volume: %v", stats.FilamentVolume)
+	}
+	if math.Abs(stats.FilamentWeight-volume/1000*1.24) > 1e-9 {
+		t.Errorf("weight: %v", stats.FilamentWeight)
+	}
+}
+
+func estimateString(t *testing.T, profile Profile, gcode string) *Estimate {
+	est, err := EstimateTime(strings.NewReader(gcode), profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return est
+}
+
+func TestEstimateTime(t *testing.T) {
+	profile := DefaultProfile()
+	profile.Acceleration = 1000
+	profile.TravelAcceleration = 1000
+	profile.JunctionDeviation = 0.05
+
+	// accelerating to 50mm/s takes 0.05s over 1.25mm and decelerating takes
+	// the same.  the remaining 97.5mm is covered at 50mm/s.
+	est := estimateString(t, profile, "G1 X100 F3000\n")
+	if math.Abs(est.Total-2.05) > 1e-6 {
+		t.Errorf("single move: %v", est.Total)
+	}
+
+	// collinear moves pass through their junction at full speed.
+	est = estimateString(t, profile, "G1 X50 F3000\nG1 X100\n")
+	if math.Abs(est.Total-2.05) > 1e-6 {
+		t.Errorf("collinear moves: %v", est.Total)
+	}
+
+	// a corner forces the head to slow down, but not to stop.
+	corner := estimateString(t, profile, "G1 X50 F3000\nG1 Y50\n").Total
+	stopped := 2 * estimateString(t, profile, "G1 X50 F3000\n").Total
+	if corner <= 2.05 || corner >= stopped {
+		t.Errorf("corner: %v (stopped %v)", corner, stopped)
+	}
+
+	// a move too short to reach its nominal speed.
+	est = estimateString(t, profile, "G1 X1 F3000\n")
+	if math.Abs(est.Total-2*math.Sqrt(2*0.5/1000)) > 1e-3 {
+		t.Errorf("short move: %v", est.Total)
+	}
+
+	est = estimateString(t, profile, "G4 P500\nG4 S1\n")
+	if math.Abs(est.Total-1.5) > 1e-9 {
+		t.Errorf("dwell: %v", est.Total)
+	}
+}
+
+func TestEstimateLayers(t *testing.T) {
+	est := estimateString(t, DefaultProfile(), testGCode)
+	if len(est.Layers) != 2 {
+		t.Fatalf("layers: %v", est.Layers)
+	}
+	var sum float64
+	for _, t := range est.Layers {
+		sum += t
+	}
+	if math.Abs(sum-est.Total) > 0.01 {
+		t.Errorf("layer times %v do not add up to %v", est.Layers, est.Total)
+	}
+}
+
+func TestIndexLayers(t *testing.T) {
+	layers, err := IndexLayers(strings.NewReader(testGCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("layers: %v", layers)
+	}
+	if layers[0].Z != 0.3 || layers[1].Z != 0.5 {
+		t.Errorf("heights: %v", layers)
+	}
+	var joined string
+	for _, layer := range layers {
+		joined += testGCode[layer.Offset : layer.Offset+layer.Length]
+	}
+	if joined != testGCode {
+		t.Errorf("layers do not cover the file: %v", layers)
+	}
+	second := testGCode[layers[1].Offset:]
+	if !strings.HasPrefix(second, "G1 Z0.4\n") {
+		t.Errorf("second layer does not begin at the layer change: %q", second)
+	}
+}
+
+func processString(t *testing.T, spec, gcode string) string {
+	proc, err := ParseProcessor(spec)
+	if err != nil {
+		t.Fatalf("%s: %v", spec, err)
+	}
+	var buf bytes.Buffer
+	err = proc.Process(&buf, strings.NewReader(gcode))
+	if err != nil {
+		t.Fatalf("%s: %v", spec, err)
+	}
+	return buf.String()
+}
+
+func TestProcessors(t *testing.T) {
+	out := processString(t, "pause_at_z=0.5", testGCode)
+	if !strings.Contains(out, "G1 X10 Y10 E2\nG1 E-1\n; pause at z=0.5\nM601\nG1 Z0.4\n") {
+		t.Errorf("pause_at_z:\n%s", out)
+	}
+	out = processString(t, "filament_change=1", testGCode)
+	if !strings.Contains(out, "G1 E-1\n; filament change at layer 1\nM600\nG1 Z0.4\n") {
+		t.Errorf("filament_change:\n%s", out)
+	}
+	out = processString(t, "filament_change=5", testGCode)
+	if out != testGCode {
+		t.Errorf("filament change at a missing layer modified the file:\n%s", out)
+	}
+	out = processString(t, "replace=G92 E0=>G92 E0 ; reset", testGCode)
+	if !strings.Contains(out, "\nG92 E0 ; reset\n") {
+		t.Errorf("replace:\n%s", out)
+	}
+	out = processString(t, `prepend=; header\n; line 2`, testGCode)
+	if out != "; header\n; line 2\n"+testGCode {
+		t.Errorf("prepend:\n%s", out)
+	}
+	out = processString(t, "append=M300", testGCode)
+	if out != testGCode+"M300\n" {
+		t.Errorf("append:\n%s", out)
+	}
+	_, err := ParseProcessor("bogus=1")
+	if err == nil {
+		t.Errorf("unknown processor parsed")
+	}
+}
+
+func TestProcessorText(t *testing.T) {
+	for _, spec := range []string{
+		`prepend=; header\nG28 X Y\nM117 Printing from snuggied\n\n`,
+		`append=M104 S0 ; off\nEXCLUDE_OBJECT_DEFINE NAME=a CENTER=1,2\nPRINT_END`,
+		`replace=M106 S255=>M106 S127`,
+		"append=G1 X10\tY10",
+	} {
+		_, err := ParseProcessor(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+	for _, spec := range []string{
+		`prepend=rm -rf /`,
+		`append=G1 X10 Y=3`,
+		`append=G1 XABC`,
+		`append=M104 S0\nhello world`,
+		`append=1G`,
+		"prepend=G28\x00",
+		"append=G28\r\nG1 X1",
+		`replace=G28=>G28\nbogus text`,
+		"append=" + strings.Repeat("; comment\n", MaxText/10+1),
+		"replace=" + strings.Repeat("G", MaxText+1) + "=>G1",
+	} {
+		_, err := ParseProcessor(spec)
+		if err == nil {
+			t.Errorf("%.40q: parsed without error", spec)
+		}
+	}
+}
+
+func TestArcFitter(t *testing.T) {
+	// a quarter circle of radius 10 around (10, 0) in 16 segments, followed
+	// by a straight line.
+	var buf bytes.Buffer
+	buf.WriteString("G21\nG90\nM82\nG92 E0\nG1 X0 Y0 F1200\n")
+	e := 0.0
+	for i := 1; i <= 16; i++ {
+		a := math.Pi - float64(i)*math.Pi/32
+		e += 0.05
+		fmt.Fprintf(&buf, "G1 X%.3f Y%.3f E%.5f ; perimeter\n", 10+10*math.Cos(a), 10*math.Sin(a), e)
+	}
+	buf.WriteString("G1 X20 Y20 E1.5\nG1 X30 Y30 E2\n")
+	gcode := buf.String()
+
+	a := new(ArcFitter)
+	var out bytes.Buffer
+	err := a.Process(&out, strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "G2 X10.000 Y10.000 I10.000 J0.000 E0.80000 ; perimeter\n"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("arc not fitted:\n%s", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "G1 X20 Y20 E1.5\nG1 X30 Y30 E2\n") {
+		t.Errorf("straight moves modified:\n%s", out.String())
+	}
+	if a.Stats.Arcs != 1 || a.Stats.Replaced != 16 {
+		t.Errorf("stats: %+v", a.Stats)
+	}
+	if a.Stats.LinesIn != 23 || a.Stats.LinesOut != 8 {
+		t.Errorf("line counts: %+v", a.Stats)
+	}
+
+	before, err := Analyze(strings.NewReader(gcode), Filament{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := Analyze(strings.NewReader(out.String()), Filament{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(before.FilamentLength-after.FilamentLength) > 1e-9 {
+		t.Errorf("filament length %g, want %g", after.FilamentLength, before.FilamentLength)
+	}
+
+	// a polygon with large facets is not an arc within tolerance.
+	out.Reset()
+	a.Tolerance = 0.001
+	err = a.Process(&out, strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Stats.Arcs != 0 {
+		t.Errorf("tight tolerance: %+v", a.Stats)
+	}
+}
+
+func TestEncodeMeatPack(t *testing.T) {
+	var buf bytes.Buffer
+	err := EncodeMeatPack(&buf, strings.NewReader("; comment\nG1 X10\n\nM117 Hi\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xfb, 0xff, 0xff, 0xf7,
+		// G1X10
+		0x1d, 0x1e, 0xc0,
+		// M117 Hi keeps its spaces
+		0x1f, 'M', 0x71, 0xff, ' ', 'H', 0xcf, 'i',
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("encoded % x\nwant    % x", buf.Bytes(), want)
+	}
+}
+
+func TestEncodeBinary(t *testing.T) {
+	var buf bytes.Buffer
+	meta := &BinaryMetadata{Printer: map[string]string{"filament used [g]": "1.00"}}
+	err := EncodeBinary(&buf, strings.NewReader(testGCode), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if string(b[:4]) != "GCDE" || binary.LittleEndian.Uint32(b[4:]) != 1 || binary.LittleEndian.Uint16(b[8:]) != 1 {
+		t.Fatalf("file header % x", b[:10])
+	}
+	var types []uint16
+	var gcode bytes.Buffer
+	for b = b[10:]; len(b) > 0; {
+		typ := binary.LittleEndian.Uint16(b)
+		size := binary.LittleEndian.Uint32(b[4:])
+		csize := binary.LittleEndian.Uint32(b[8:])
+		end := 14 + int(csize)
+		if crc32.ChecksumIEEE(b[:end]) != binary.LittleEndian.Uint32(b[end:]) {
+			t.Fatalf("block %d: bad checksum", len(types))
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(b[14:end]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != int(size) {
+			t.Errorf("block %d: size %d, want %d", len(types), len(data), size)
+		}
+		if typ == 3 && string(data) != "filament used [g]=1.00\n" {
+			t.Errorf("printer metadata %q", data)
+		}
+		if typ == 1 {
+			gcode.Write(data)
+		}
+		types = append(types, typ)
+		b = b[end+4:]
+	}
+	if fmt.Sprint(types) != "[3 4 2 1]" {
+		t.Errorf("block types %v", types)
+	}
+	if gcode.String() != testGCode {
+		t.Errorf("gcode:\n%s", gcode.String())
+	}
+}
+
+func TestEmbedThumbnails(t *testing.T) {
+	png := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 30)
+	p := &EmbedThumbnails{Thumbnails: []Thumbnail{{Width: 16, Height: 12, PNG: png}}}
+	var buf bytes.Buffer
+	err := p.Process(&buf, strings.NewReader("; generated by slic3r\n"+testGCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "; generated by slic3r\n;\n; thumbnail begin 16x12 160\n; ") {
+		t.Fatalf("thumbnail block not after header:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "; thumbnail end\n;\n\n"+testGCode) {
+		t.Fatalf("gcode modified:\n%s", out)
+	}
+	var data string
+	for _, line := range strings.Split(out, "\n")[3:] {
+		if line == "; thumbnail end" {
+			break
+		}
+		if len(line) > 80 {
+			t.Errorf("line too long: %q", line)
+		}
+		data += strings.TrimPrefix(line, "; ")
+	}
+	if data != base64.StdEncoding.EncodeToString(png) {
+		t.Errorf("thumbnail data %q", data)
+	}
+}
+
+func TestParseFeature(t *testing.T) {
+	for comment, want := range map[string]string{
+		"perimeter":                FeaturePerimeter,
+		"TYPE:External perimeter":  FeatureExternalPerimeter,
+		"TYPE:WALL-OUTER":          FeatureExternalPerimeter,
+		"TYPE:Solid infill":        FeatureSolidInfill,
+		"infill":                   FeatureInfill,
+		"TYPE:FILL":                FeatureInfill,
+		"support material":         FeatureSupport,
+		"skirt":                    FeatureSkirt,
+		"set temperature":          "",
+		"move to next layer (123)": "",
+	} {
+		if got := ParseFeature(comment); got != want {
+			t.Errorf("%q: %q, want %q", comment, got, want)
+		}
+	}
+}
+
+func TestRenderLayerSVG(t *testing.T) {
+	gcode := strings.Replace(testGCode, "G1 Z0.5\n", "G1 Z0.5\n;TYPE:Support material\n", 1)
+	gcode = strings.Replace(gcode, "G1 X20 Y0 E4\n", "G1 X20 Y0 E4 ; perimeter\n", 1)
+	layers, err := IndexLayers(strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = RenderLayerSVG(&buf, strings.NewReader(gcode), layers[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := buf.String()
+	for _, want := range []string{
+		`viewBox="-2 -12 24 14"`,
+		`<path class="support" stroke="#4a90e2" stroke-width="0.4" d="M0 10L0 0"/>`,
+		`<path class="perimeter" stroke="#f5a623" stroke-width="0.4" d="M0 0L20 0"/>`,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("missing %s in\n%s", want, svg)
+		}
+	}
+	if strings.Contains(svg, "travel") {
+		t.Errorf("travel moves drawn:\n%s", svg)
+	}
+
+	buf.Reset()
+	opts := &SVGOptions{Travel: true, Extents: Extents{Max: [3]float64{100, 100}}}
+	err = RenderLayerSVG(&buf, strings.NewReader(gcode), layers[1], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg = buf.String()
+	if !strings.Contains(svg, `viewBox="-2 -102 104 104"`) {
+		t.Errorf("extents not used:\n%s", svg)
+	}
+	if !strings.Contains(svg, `class="travel"`) || !strings.Contains(svg, `d="M10 10L0 10"`) {
+		t.Errorf("travel moves not drawn:\n%s", svg)
+	}
+}
+
+func TestExcludeObjects(t *testing.T) {
+	square := func(x, y float64, e *float64) string {
+		var s string
+		s += fmt.Sprintf("G1 X%g Y%g\n", x, y)
+		for _, p := range [][2]float64{{x + 5, y}, {x + 5, y + 5}, {x, y + 5}, {x, y}} {
+			*e++
+			s += fmt.Sprintf("G1 X%g Y%g E%g\n", p[0], p[1], *e)
+		}
+		return s
+	}
+	e := 0.0
+	gcode := "G28\nG90\nM82\nG92 E0\nG1 Z0.2\n"
+	// a skirt around both squares on the first layer.
+	gcode += "G1 X0 Y0\nG1 X40 Y0 E1\nG1 X40 Y20 E2\nG1 X0 Y20 E3\nG1 X0 Y0 E4\n"
+	e = 4
+	for _, z := range []string{"0.2", "0.4"} {
+		if z != "0.2" {
+			gcode += "G1 Z" + z + "\n"
+		}
+		gcode += square(5, 5, &e)
+		gcode += "G1 E" + fmt.Sprint(e-1) + "\n"
+		gcode += square(25, 5, &e)
+	}
+
+	var buf bytes.Buffer
+	p := new(ExcludeObjects)
+	err := p.Process(&buf, strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if p.Objects != 2 {
+		t.Fatalf("%d objects:\n%s", p.Objects, out)
+	}
+	want := "EXCLUDE_OBJECT_DEFINE NAME=object_0 CENTER=7.5,7.5 POLYGON=[[4.5,4.5],[10.5,4.5],[10.5,10.5],[4.5,10.5]]\n" +
+		"EXCLUDE_OBJECT_DEFINE NAME=object_1 CENTER=27.5,7.5 POLYGON=[[24.5,4.5],[30.5,4.5],[30.5,10.5],[24.5,10.5]]\n" +
+		"G28\n"
+	if !strings.HasPrefix(out, want) {
+		t.Errorf("objects not defined:\n%s", out)
+	}
+	if !strings.Contains(out, "G1 X0 Y0 E4\nG1 X5 Y5\nEXCLUDE_OBJECT_START NAME=object_0\nG1 X10 Y5 E5\n") {
+		t.Errorf("skirt labeled or object not started:\n%s", out)
+	}
+	if !strings.Contains(out, "G1 X5 Y5 E8\nEXCLUDE_OBJECT_END NAME=object_0\nG1 E7\nG1 X25 Y5\nEXCLUDE_OBJECT_START NAME=object_1\n") {
+		t.Errorf("travel between objects labeled:\n%s", out)
+	}
+	if !strings.Contains(out, "EXCLUDE_OBJECT_END NAME=object_1\nG1 Z0.4\n") {
+		t.Errorf("object not ended at layer change:\n%s", out)
+	}
+	if strings.Count(out, "EXCLUDE_OBJECT_START") != 4 || strings.Count(out, "EXCLUDE_OBJECT_END") != 4 {
+		t.Errorf("unbalanced markers:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "EXCLUDE_OBJECT_END NAME=object_1\n") {
+		t.Errorf("last object not ended:\n%s", out)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	limits := Limits{BedSize: [2]float64{100, 100}, MaxZ: 50, MaxHotend: 260, MaxBed: 100}
+	issues, err := Validate(strings.NewReader("G28\n"+testGCode), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("issues in valid gcode: %v", issues)
+	}
+
+	gcode := `M104 S300
+G1 X10 Y10
+G28
+M140 S60
+G1 X120 Y10
+G1 X130 Y10
+G1 Z60
+M999
+FOO_MACRO A=1
+`
+	issues, err = Validate(strings.NewReader(gcode), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Issue{
+		{Check: CheckTemperature, Message: "hotend temperature 300 above the limit 260", Line: 1, Count: 1},
+		{Check: CheckHoming, Message: "move before homing (G28)", Line: 2, Count: 1},
+		{Check: CheckBounds, Message: "move to X120 Y10 outside the 100x100 bed", Line: 5, Count: 3},
+		{Check: CheckMaxZ, Message: "move to Z60 above the maximum height 50", Line: 7, Count: 1},
+		{Check: CheckUnknown, Message: "unknown command M999", Line: 8, Count: 1},
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("issues: %v", issues)
+	}
+	for i := range want {
+		issues[i].last = 0
+		if issues[i] != want[i] {
+			t.Errorf("issue %d: %+v, want %+v", i, issues[i], want[i])
+		}
+	}
+}
+
+func TestToolpaths(t *testing.T) {
+	gcode := strings.Replace(testGCode, "G1 Z0.5\n", "G1 Z0.5\n;TYPE:Support material\n", 1)
+	gcode = strings.Replace(gcode, "G1 X20 Y0 E4\n", "G1 X20 Y0 E4 ; perimeter\n", 1)
+	layers, err := IndexLayers(strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := Toolpaths(strings.NewReader(gcode), layers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LayerPaths{
+		{Index: 0, Z: 0.3, Paths: []Path{
+			{Feature: FeatureExtrusion, Points: []float64{0, 0, 10, 0, 10, 10}},
+		}},
+		{Index: 1, Z: 0.5, Paths: []Path{
+			{Feature: FeatureSupport, Points: []float64{0, 10, 0, 0}},
+			{Feature: FeaturePerimeter, Points: []float64{0, 0, 20, 0}},
+		}},
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths:\n%v\nwant:\n%v", paths, want)
+	}
+
+	paths, err = Toolpaths(strings.NewReader(gcode), layers, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	travel := Path{Feature: FeatureTravel, Points: []float64{10, 10, 0, 10}}
+	if len(paths[1].Paths) != 3 || !reflect.DeepEqual(paths[1].Paths[0], travel) {
+		t.Errorf("travel paths: %v", paths[1].Paths)
+	}
+}
@@ -0,0 +1,83 @@
+package gcode
+
+import "io"
+
+// Layer locates the G-code for a single layer within a file.
+type Layer struct {
+	Index int `json:"index"`
+
+	// Z is the height of the layer's extrusion in mm.
+	Z float64 `json:"z"`
+
+	// Offset and Length give the byte range of the layer in the file.
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// IndexLayers reads G-code from r and returns the location of each layer.
+func IndexLayers(r io.Reader) ([]Layer, error) {
+	ix := new(Indexer)
+	s := NewScanner(r)
+	for s.Scan() {
+		ix.Exec(s.Command(), s.Offset())
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return ix.Layers(s.End()), nil
+}
+
+// Indexer locates layers in G-code as commands are executed.  A layer begins
+// with the first change in height following the previous layer's last
+// extrusion, so that the layer change itself belongs to the new layer.  The
+// first layer also contains any commands preceding it, and the last layer
+// contains any commands following it.  Concatenating all layers reproduces the
+// original file.
+type Indexer struct {
+	Machine Machine
+
+	layers     []Layer
+	counter    layerCounter
+	zChange    int64
+	hasZChange bool
+}
+
+// Exec executes c, which begins at the given byte offset.
+func (ix *Indexer) Exec(c *Command, offset int64) {
+	ix.Machine.Exec(c, func(mv *Move) {
+		if mv.To[Z] != mv.From[Z] && !ix.hasZChange {
+			ix.zChange = offset
+			ix.hasZChange = true
+		}
+		if _, ok := ix.counter.observe(mv); ok {
+			start := offset
+			if ix.hasZChange {
+				start = ix.zChange
+			}
+			if len(ix.layers) == 0 {
+				start = 0
+			}
+			ix.layers = append(ix.layers, Layer{
+				Index:  len(ix.layers),
+				Z:      round(mv.To[Z], 6),
+				Offset: start,
+			})
+		}
+		if mv.IsExtrusion() {
+			ix.hasZChange = false
+		}
+	})
+}
+
+// Layers returns the located layers given the size of the file in bytes.
+func (ix *Indexer) Layers(size int64) []Layer {
+	layers := append([]Layer(nil), ix.layers...)
+	for i := range layers {
+		end := size
+		if i+1 < len(layers) {
+			end = layers[i+1].Offset
+		}
+		layers[i].Length = end - layers[i].Offset
+	}
+	return layers
+}
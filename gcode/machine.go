@@ -0,0 +1,266 @@
+package gcode
+
+import "math"
+
+// Axis indices into positions.
+const (
+	X = iota
+	Y
+	Z
+	E
+)
+
+// Move is a linear movement of the print head.
+type Move struct {
+	From, To [4]float64
+
+	// Feedrate is the requested speed of the move in mm/min.
+	Feedrate float64
+
+	// Rapid is true if the move was commanded with G0.
+	Rapid bool
+}
+
+// Extrusion returns the amount of filament fed by the move.  Retractions have
+// negative extrusion.
+func (mv *Move) Extrusion() float64 {
+	return mv.To[E] - mv.From[E]
+}
+
+// Length returns the distance travelled by the print head.
+func (mv *Move) Length() float64 {
+	dx := mv.To[X] - mv.From[X]
+	dy := mv.To[Y] - mv.From[Y]
+	dz := mv.To[Z] - mv.From[Z]
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+// IsExtrusion returns true if the move deposits material, that is, the head
+// moves while filament is fed.
+func (mv *Move) IsExtrusion() bool {
+	return mv.Extrusion() > 0 && (mv.To[X] != mv.From[X] || mv.To[Y] != mv.From[Y])
+}
+
+// IsRetraction returns true if the move withdraws filament.
+func (mv *Move) IsRetraction() bool {
+	return mv.Extrusion() < 0
+}
+
+// Machine tracks the state of a printer as G-code commands are executed.
+type Machine struct {
+	// Pos is the current position of the print head and extruder in mm.
+	Pos [4]float64
+
+	// Feedrate is the current feedrate in mm/min.
+	Feedrate float64
+
+	// RelativeXYZ and RelativeE are true when coordinates given for the
+	// respective axes are relative to the current position.
+	RelativeXYZ bool
+	RelativeE   bool
+
+	// Inches is true if coordinates are given in inches (G20).
+	Inches bool
+
+	// ArcSegment is the maximum length of the linear segments used to
+	// approximate arc moves.  If ArcSegment is not positive 1mm is used.
+	ArcSegment float64
+}
+
+// Exec updates the machine state by executing c.  For every linear move made
+// by the print head fn is called.  Arc moves result in several calls to fn,
+// one for each segment approximating the arc.  The Move passed to fn must not
+// be retained.
+func (m *Machine) Exec(c *Command, fn func(mv *Move)) {
+	switch c.Code {
+	case "G0", "G1":
+		m.setFeedrate(c)
+		to := m.target(c)
+		mv := Move{From: m.Pos, To: to, Feedrate: m.Feedrate, Rapid: c.Code == "G0"}
+		m.Pos = to
+		if fn != nil && mv.From != mv.To {
+			fn(&mv)
+		}
+	case "G2", "G3":
+		m.setFeedrate(c)
+		m.arc(c, c.Code == "G2", fn)
+	case "G20":
+		m.Inches = true
+	case "G21":
+		m.Inches = false
+	case "G28":
+		homed := false
+		for i, letter := range []byte("XYZ") {
+			if c.Has(letter) {
+				m.Pos[i] = 0
+				homed = true
+			}
+		}
+		if !homed {
+			m.Pos[X], m.Pos[Y], m.Pos[Z] = 0, 0, 0
+		}
+	case "G90":
+		m.RelativeXYZ = false
+		m.RelativeE = false
+	case "G91":
+		m.RelativeXYZ = true
+		m.RelativeE = true
+	case "G92":
+		set := false
+		for i, letter := range []byte("XYZE") {
+			if c.Has(letter) {
+				m.Pos[i] = m.units(c.Arg(letter))
+				set = true
+			}
+		}
+		if !set {
+			m.Pos = [4]float64{}
+		}
+	case "M82":
+		m.RelativeE = false
+	case "M83":
+		m.RelativeE = true
+	}
+}
+
+func (m *Machine) setFeedrate(c *Command) {
+	if c.Has('F') {
+		m.Feedrate = m.units(c.Arg('F'))
+	}
+}
+
+func (m *Machine) units(v float64) float64 {
+	if m.Inches {
+		return v * 25.4
+	}
+	return v
+}
+
+// target computes the destination of a move command.
+func (m *Machine) target(c *Command) [4]float64 {
+	to := m.Pos
+	for i, letter := range []byte("XYZE") {
+		if !c.Has(letter) {
+			continue
+		}
+		v := m.units(c.Arg(letter))
+		relative := m.RelativeXYZ
+		if i == E {
+			relative = m.RelativeE
+		}
+		if relative {
+			to[i] += v
+		} else {
+			to[i] = v
+		}
+	}
+	return to
+}
+
+const (
+	// maxArcRadius is the largest radius in mm of an arc which is
+	// interpolated.  Arcs with larger or non-finite radii are made as
+	// straight moves to their end point.
+	maxArcRadius = 10000
+
+	// maxArcSegments is the largest number of segments an arc is split
+	// into.  Longer arcs are split into longer segments.
+	maxArcSegments = 4096
+)
+
+// arc executes a G2 (clockwise) or G3 (counter-clockwise) move in the XY
+// plane.  The center is given by I and J offsets or by a radius R.
+func (m *Machine) arc(c *Command, clockwise bool, fn func(mv *Move)) {
+	from := m.Pos
+	to := m.target(c)
+	defer func() { m.Pos = to }()
+
+	var cx, cy float64
+	if c.Has('I') || c.Has('J') {
+		cx = from[X] + m.units(c.Arg('I'))
+		cy = from[Y] + m.units(c.Arg('J'))
+	} else if c.Has('R') {
+		var ok bool
+		cx, cy, ok = arcCenter(from[X], from[Y], to[X], to[Y], m.units(c.Arg('R')), clockwise)
+		if !ok {
+			m.line(from, to, fn)
+			return
+		}
+	} else {
+		m.line(from, to, fn)
+		return
+	}
+
+	radius := math.Hypot(from[X]-cx, from[Y]-cy)
+	if !(radius <= maxArcRadius) {
+		m.line(from, to, fn)
+		return
+	}
+	sweep := ArcSweep(from[X]-cx, from[Y]-cy, to[X]-cx, to[Y]-cy, clockwise)
+	length := math.Abs(sweep) * radius
+	seg := m.ArcSegment
+	if seg <= 0 {
+		seg = 1
+	}
+	n := int(math.Ceil(math.Min(length/seg, maxArcSegments)))
+	if n < 1 {
+		n = 1
+	}
+	start := math.Atan2(from[Y]-cy, from[X]-cx)
+	prev := from
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		next := to
+		if i < n {
+			a := start + sweep*t
+			next[X] = cx + radius*math.Cos(a)
+			next[Y] = cy + radius*math.Sin(a)
+			next[Z] = from[Z] + (to[Z]-from[Z])*t
+			next[E] = from[E] + (to[E]-from[E])*t
+		}
+		m.line(prev, next, fn)
+		prev = next
+	}
+}
+
+func (m *Machine) line(from, to [4]float64, fn func(mv *Move)) {
+	if fn == nil || from == to {
+		return
+	}
+	fn(&Move{From: from, To: to, Feedrate: m.Feedrate})
+}
+
+// ArcSweep returns the signed angle swept moving from the vector (x0, y0) to
+// (x1, y1) around the origin in the given direction.  Clockwise sweeps are
+// negative.  Equal vectors describe a full circle.
+func ArcSweep(x0, y0, x1, y1 float64, clockwise bool) float64 {
+	a0 := math.Atan2(y0, x0)
+	a1 := math.Atan2(y1, x1)
+	sweep := a1 - a0
+	if clockwise {
+		for sweep >= 0 {
+			sweep -= 2 * math.Pi
+		}
+	} else {
+		for sweep <= 0 {
+			sweep += 2 * math.Pi
+		}
+	}
+	return sweep
+}
+
+// arcCenter computes the center of an arc of radius r between two points.  A
+// negative radius selects the arc longer than a semicircle.
+func arcCenter(x0, y0, x1, y1, r float64, clockwise bool) (cx, cy float64, ok bool) {
+	dx, dy := x1-x0, y1-y0
+	d := math.Hypot(dx, dy)
+	if d == 0 || d > 2*math.Abs(r) {
+		return 0, 0, false
+	}
+	h := math.Sqrt(r*r - d*d/4)
+	if clockwise != (r < 0) {
+		h = -h
+	}
+	mx, my := x0+dx/2, y0+dy/2
+	return mx - h*dy/d, my + h*dx/d, true
+}
@@ -0,0 +1,97 @@
+package gcode
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// MeatPack signal bytes.  A command is sent as two signal bytes followed by a
+// command byte.
+const (
+	meatPackSignal        = 0xff
+	meatPackEnable        = 0xfb
+	meatPackNoSpaces      = 0xf7
+	meatPackFullWidth     = 0xf
+	meatPackFullWidthPair = 0xff
+)
+
+// meatPackTable maps the characters which MeatPack packs into four bits.  In
+// no spaces mode the code for ' ' is used for 'E'.
+var meatPackTable = func() [256]byte {
+	var t [256]byte
+	for i := range t {
+		t[i] = meatPackFullWidth
+	}
+	for c := byte('0'); c <= '9'; c++ {
+		t[c] = c - '0'
+	}
+	t['.'] = 10
+	t['E'] = 11
+	t['\n'] = 12
+	t['G'] = 13
+	t['X'] = 14
+	return t
+}()
+
+// EncodeMeatPack copies the G-code read from r to w using the MeatPack
+// encoding, which packs common characters two to a byte.  Comments, blank
+// lines and spaces between arguments are removed.  Printer firmware must
+// support MeatPack to decode the result.
+func EncodeMeatPack(w io.Writer, r io.Reader) error {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	bw.Write([]byte{
+		meatPackSignal, meatPackSignal, meatPackEnable,
+		meatPackSignal, meatPackSignal, meatPackNoSpaces,
+	})
+	s := NewScanner(r)
+	var buf []byte
+	for s.Scan() {
+		c := s.Command()
+		if c.Raw == "" {
+			continue
+		}
+		buf = append(buf[:0], meatPackLine(c)...)
+		if len(buf)%2 == 0 {
+			// packing works on pairs of characters.  a trailing space
+			// is not significant.
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, '\n')
+		for i := 0; i < len(buf); i += 2 {
+			writeMeatPackPair(bw, buf[i], buf[i+1])
+		}
+	}
+	if s.Err() != nil {
+		return s.Err()
+	}
+	return bw.Flush()
+}
+
+// meatPackLine returns the text of c to be packed.  Spaces are removed from
+// commands with letter arguments, which can be parsed without them.
+// Commands with text arguments, like M117, are kept as they are.
+func meatPackLine(c *Command) string {
+	if !isStandard(c.Code) || c.Code == "M117" || c.Code == "M118" || c.Code == "M23" || c.Code == "M28" || c.Code == "M30" {
+		return c.Raw
+	}
+	return strings.Replace(c.Raw, " ", "", -1)
+}
+
+func writeMeatPackPair(w *bufio.Writer, a, b byte) {
+	pa, pb := meatPackTable[a], meatPackTable[b]
+	switch {
+	case pa == meatPackFullWidth && pb == meatPackFullWidth:
+		w.WriteByte(meatPackFullWidthPair)
+		w.WriteByte(a)
+		w.WriteByte(b)
+	case pa == meatPackFullWidth:
+		w.WriteByte(pb<<4 | meatPackFullWidth)
+		w.WriteByte(a)
+	case pb == meatPackFullWidth:
+		w.WriteByte(meatPackFullWidth<<4 | pa)
+		w.WriteByte(b)
+	default:
+		w.WriteByte(pb<<4 | pa)
+	}
+}
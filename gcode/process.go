@@ -0,0 +1,315 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Processor transforms G-code read from r and writes the result to w.
+// Processors which need to inspect the input before transforming it may seek
+// r.
+type Processor interface {
+	Process(w io.Writer, r io.ReadSeeker) error
+}
+
+// ParseProcessor returns the built-in processor described by spec.  A spec is
+// a processor name optionally followed by '=' and an argument.
+//
+//	pause_at_z=<z>        pause before the first layer at or above height z
+//	filament_change=<n>   change filament (M600) before layer n
+//	replace=<old>=><new>  replace text in every line
+//	prepend=<text>        insert text at the start of the file
+//	append=<text>         insert text at the end of the file
+//	arc_fit[=<tolerance>] replace linear moves along arcs with G2/G3 moves
+//	exclude_object        label objects for Klipper's exclude_object module
+//
+// Layers are numbered from zero.  In text arguments the sequence \n begins a
+// new line.  Text is limited to MaxText bytes and each line of it must be a
+// comment or a well formed command.
+func ParseProcessor(spec string) (Processor, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	switch name {
+	case "pause_at_z":
+		z, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid height %q", name, arg)
+		}
+		return &PauseAtZ{Z: z}, nil
+	case "filament_change":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: invalid layer %q", name, arg)
+		}
+		return &FilamentChange{Layer: n}, nil
+	case "replace":
+		pieces := strings.SplitN(arg, "=>", 2)
+		if len(pieces) != 2 || pieces[0] == "" {
+			return nil, fmt.Errorf("%s: expected <old>=><new>", name)
+		}
+		p := &Replace{Old: pieces[0], New: unescape(pieces[1])}
+		if len(p.Old) > MaxText {
+			return nil, fmt.Errorf("%s: text exceeds %d bytes", name, MaxText)
+		}
+		err := checkText(p.New)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return p, nil
+	case "prepend", "append":
+		text := unescape(arg)
+		err := checkText(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if name == "prepend" {
+			return &Prepend{Text: text}, nil
+		}
+		return &Append{Text: text}, nil
+	case "arc_fit":
+		a := new(ArcFitter)
+		if arg != "" {
+			tol, err := strconv.ParseFloat(arg, 64)
+			if err != nil || tol <= 0 {
+				return nil, fmt.Errorf("%s: invalid tolerance %q", name, arg)
+			}
+			a.Tolerance = tol
+		}
+		return a, nil
+	case "exclude_object":
+		if arg != "" {
+			return nil, fmt.Errorf("%s: unexpected argument", name)
+		}
+		return new(ExcludeObjects), nil
+	}
+	return nil, fmt.Errorf("unknown processor %q", name)
+}
+
+// MaxText is the maximum length in bytes of text inserted by a processor.
+const MaxText = 4096
+
+// checkText returns an error if text is longer than MaxText or contains a
+// line which is neither empty, a comment nor a well formed command.
+func checkText(text string) error {
+	if len(text) > MaxText {
+		return fmt.Errorf("text exceeds %d bytes", MaxText)
+	}
+	for i, line := range strings.Split(text, "\n") {
+		err := checkLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkLine returns an error if line contains control characters or is not a
+// comment or a command.  Standard commands take arguments of a letter and an
+// optional number, except M117 and M118 which take a message.  Extended
+// commands, such as Klipper's, take NAME=VALUE parameters.
+func checkLine(line string) error {
+	for _, c := range line {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return fmt.Errorf("control character %q", c)
+		}
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	code := strings.ToUpper(fields[0])
+	if isStandard(code) {
+		if code == "M117" || code == "M118" {
+			return nil
+		}
+		for _, f := range fields[1:] {
+			letter := upper(f[0])
+			if letter < 'A' || letter > 'Z' {
+				return fmt.Errorf("%s: invalid argument %q", code, f)
+			}
+			if len(f) > 1 {
+				_, err := strconv.ParseFloat(f[1:], 64)
+				if err != nil {
+					return fmt.Errorf("%s: invalid argument %q", code, f)
+				}
+			}
+		}
+		return nil
+	}
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if (c < 'A' || c > 'Z') && c != '_' && (i == 0 || c < '0' || c > '9') {
+			return fmt.Errorf("invalid command %q", fields[0])
+		}
+	}
+	for _, f := range fields[1:] {
+		if i := strings.Index(f, "="); i <= 0 {
+			return fmt.Errorf("%s: invalid parameter %q", code, f)
+		}
+	}
+	return nil
+}
+
+func unescape(s string) string {
+	return strings.Replace(s, `\n`, "\n", -1)
+}
+
+// PauseAtZ pauses the print before the first layer at or above height Z.
+type PauseAtZ struct {
+	Z float64
+
+	// Command is the G-code which pauses the printer.  If Command is empty
+	// M601 is used.
+	Command string
+}
+
+// Process implements the Processor interface.
+func (p *PauseAtZ) Process(w io.Writer, r io.ReadSeeker) error {
+	cmd := p.Command
+	if cmd == "" {
+		cmd = "M601"
+	}
+	text := fmt.Sprintf("; pause at z=%g\n%s\n", p.Z, cmd)
+	return insertAtLayer(w, r, text, func(layer Layer) bool {
+		return layer.Z >= p.Z
+	})
+}
+
+// FilamentChange changes filament before the layer with index Layer.
+type FilamentChange struct {
+	Layer int
+
+	// Command is the G-code which begins a filament change.  If Command is
+	// empty M600 is used.
+	Command string
+}
+
+// Process implements the Processor interface.
+func (p *FilamentChange) Process(w io.Writer, r io.ReadSeeker) error {
+	cmd := p.Command
+	if cmd == "" {
+		cmd = "M600"
+	}
+	text := fmt.Sprintf("; filament change at layer %d\n%s\n", p.Layer, cmd)
+	return insertAtLayer(w, r, text, func(layer Layer) bool {
+		return layer.Index == p.Layer
+	})
+}
+
+// insertAtLayer copies r to w, inserting text at the start of the first layer
+// for which match returns true.  Text is not inserted before the first layer
+// because it contains the printer's start G-code.
+func insertAtLayer(w io.Writer, r io.ReadSeeker, text string, match func(Layer) bool) error {
+	layers, err := IndexLayers(r)
+	if err != nil {
+		return err
+	}
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if layer.Index == 0 || !match(layer) {
+			continue
+		}
+		_, err = io.CopyN(w, r, layer.Offset)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, text)
+		if err != nil {
+			return err
+		}
+		break
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Replace replaces every occurrence of Old with New in each line.
+type Replace struct {
+	Old string
+	New string
+}
+
+// Process implements the Processor interface.
+func (p *Replace) Process(w io.Writer, r io.ReadSeeker) error {
+	return mapLines(w, r, func(line string) string {
+		return strings.Replace(line, p.Old, p.New, -1)
+	})
+}
+
+// Prepend inserts Text at the start of the file.
+type Prepend struct {
+	Text string
+}
+
+// Process implements the Processor interface.
+func (p *Prepend) Process(w io.Writer, r io.ReadSeeker) error {
+	_, err := io.WriteString(w, withNewline(p.Text))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Append inserts Text at the end of the file.
+type Append struct {
+	Text string
+}
+
+// Process implements the Processor interface.
+func (p *Append) Process(w io.Writer, r io.ReadSeeker) error {
+	_, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, withNewline(p.Text))
+	return err
+}
+
+func withNewline(s string) string {
+	if s == "" || strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
+}
+
+// mapLines copies r to w, transforming each line with fn.  Line terminators
+// are preserved.
+func mapLines(w io.Writer, r io.Reader, fn func(line string) string) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	bw := bufio.NewWriterSize(w, 64<<10)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			eol := ""
+			if strings.HasSuffix(line, "\n") {
+				line, eol = line[:len(line)-1], "\n"
+				if strings.HasSuffix(line, "\r") {
+					line, eol = line[:len(line)-1], "\r\n"
+				}
+			}
+			_, errw := bw.WriteString(fn(line) + eol)
+			if errw != nil {
+				return errw
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
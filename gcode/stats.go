@@ -0,0 +1,163 @@
+package gcode
+
+import (
+	"io"
+	"math"
+)
+
+// Filament describes the material being printed.
+type Filament struct {
+	// Diameter is the diameter of the filament in mm.
+	Diameter float64
+
+	// Density is the density of the filament in g/cm^3.
+	Density float64
+}
+
+// Extents is an axis aligned bounding box in mm.
+type Extents struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+// Stats summarizes the contents of a G-code file.
+type Stats struct {
+	// Layers is the number of layers which contain extrusion.
+	Layers int `json:"layers"`
+
+	// LayerHeights contains the thickness of each layer in mm.
+	LayerHeights []float64 `json:"layer_heights"`
+
+	// Extents bounds all extrusion moves.
+	Extents Extents `json:"extents"`
+
+	// FilamentLength is the length of filament extruded in mm.  Retracted
+	// filament which is later restored is not counted twice.
+	FilamentLength float64 `json:"filament_length"`
+
+	// FilamentVolume is the volume of extruded filament in mm^3 and
+	// FilamentWeight is its weight in grams.
+	FilamentVolume float64 `json:"filament_volume"`
+	FilamentWeight float64 `json:"filament_weight"`
+
+	// Retractions counts the moves which withdraw filament.
+	Retractions int `json:"retractions"`
+}
+
+// Analyze reads G-code from r and computes its Stats.
+func Analyze(r io.Reader, filament Filament) (*Stats, error) {
+	a := NewAnalyzer(filament)
+	s := NewScanner(r)
+	for s.Scan() {
+		a.Exec(s.Command())
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return a.Stats(), nil
+}
+
+// Analyzer computes Stats incrementally from executed commands.
+type Analyzer struct {
+	Machine  Machine
+	Filament Filament
+
+	stats     Stats
+	layers    layerCounter
+	retracted float64
+	first     bool
+}
+
+// NewAnalyzer returns an Analyzer for G-code printed with filament.
+func NewAnalyzer(filament Filament) *Analyzer {
+	return &Analyzer{Filament: filament, first: true}
+}
+
+// Exec executes c and accumulates statistics for the moves it makes.
+func (a *Analyzer) Exec(c *Command) {
+	a.Machine.Exec(c, a.move)
+}
+
+func (a *Analyzer) move(mv *Move) {
+	de := mv.Extrusion()
+	switch {
+	case de < 0:
+		a.stats.Retractions++
+		a.retracted -= de
+	case de > 0:
+		// feeding filament first restores any retracted filament.
+		restored := math.Min(de, a.retracted)
+		a.retracted -= restored
+		a.stats.FilamentLength += de - restored
+	}
+	if !mv.IsExtrusion() {
+		return
+	}
+
+	if height, ok := a.layers.observe(mv); ok {
+		a.stats.Layers++
+		a.stats.LayerHeights = append(a.stats.LayerHeights, round(height, 6))
+	}
+
+	ext := &a.stats.Extents
+	for _, p := range [][4]float64{mv.From, mv.To} {
+		for i := 0; i < 3; i++ {
+			if a.first || p[i] < ext.Min[i] {
+				ext.Min[i] = p[i]
+			}
+			if a.first || p[i] > ext.Max[i] {
+				ext.Max[i] = p[i]
+			}
+			if i == 2 {
+				a.first = false
+			}
+		}
+	}
+}
+
+// Stats returns the statistics accumulated so far.
+func (a *Analyzer) Stats() *Stats {
+	stats := a.stats
+	stats.LayerHeights = append([]float64(nil), a.stats.LayerHeights...)
+	radius := a.Filament.Diameter / 2
+	stats.FilamentVolume = stats.FilamentLength * math.Pi * radius * radius
+	stats.FilamentWeight = stats.FilamentVolume / 1000 * a.Filament.Density
+	return &stats
+}
+
+// layerCounter detects layer changes.  A layer begins with the first extrusion
+// at a height above the previous layer.  Analysis tools share layerCounter so
+// that they agree on the numbering of layers.
+type layerCounter struct {
+	n int
+	z float64
+}
+
+// observe returns true and the height of the new layer if mv begins a layer.
+func (l *layerCounter) observe(mv *Move) (height float64, ok bool) {
+	if !mv.IsExtrusion() {
+		return 0, false
+	}
+	z := mv.To[Z]
+	if l.n > 0 && z <= l.z {
+		return 0, false
+	}
+	height = z - l.z
+	l.n++
+	l.z = z
+	return height, true
+}
+
+// current returns the index of the current layer.  Moves preceding the first
+// layer belong to it.
+func (l *layerCounter) current() int {
+	if l.n == 0 {
+		return 0
+	}
+	return l.n - 1
+}
+
+func round(x float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Floor(x*p+0.5) / p
+}
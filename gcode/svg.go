@@ -0,0 +1,231 @@
+package gcode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Feature types of extrusion moves.  Slicers identify features using
+// comments, either on each move (Slic3r with gcode_comments enabled) or
+// before a group of moves (";TYPE:" comments written by Cura and
+// PrusaSlicer).
+const (
+	FeatureExternalPerimeter = "external_perimeter"
+	FeaturePerimeter         = "perimeter"
+	FeatureInfill            = "infill"
+	FeatureSolidInfill       = "solid_infill"
+	FeatureBridge            = "bridge"
+	FeatureSupport           = "support"
+	FeatureSkirt             = "skirt"
+	FeatureExtrusion         = "extrusion"
+	FeatureTravel            = "travel"
+)
+
+// FeatureColors are the colors in which features are drawn.
+var FeatureColors = map[string]string{
+	FeatureExternalPerimeter: "#e8590c",
+	FeaturePerimeter:         "#f5a623",
+	FeatureInfill:            "#d0021b",
+	FeatureSolidInfill:       "#9013fe",
+	FeatureBridge:            "#50a0a0",
+	FeatureSupport:           "#4a90e2",
+	FeatureSkirt:             "#417505",
+	FeatureExtrusion:         "#777777",
+	FeatureTravel:            "#bbbbbb",
+}
+
+// ParseFeature returns the feature described by a G-code comment.  If the
+// comment does not describe a feature ParseFeature returns an empty string.
+func ParseFeature(comment string) string {
+	c := strings.ToLower(comment)
+	c = strings.TrimPrefix(c, "type:")
+	switch {
+	case strings.Contains(c, "support"):
+		return FeatureSupport
+	case strings.Contains(c, "skirt"), strings.Contains(c, "brim"):
+		return FeatureSkirt
+	case strings.Contains(c, "bridge"):
+		return FeatureBridge
+	case strings.Contains(c, "external perimeter"), strings.Contains(c, "wall-outer"):
+		return FeatureExternalPerimeter
+	case strings.Contains(c, "perimeter"), strings.Contains(c, "wall"):
+		return FeaturePerimeter
+	case strings.Contains(c, "solid infill"), strings.Contains(c, "skin"):
+		return FeatureSolidInfill
+	case strings.Contains(c, "infill"), c == "fill":
+		return FeatureInfill
+	}
+	return ""
+}
+
+// typeFeature returns the feature named by a ";TYPE:" comment, which applies
+// to the moves following it.  Other comments return an empty string.
+func typeFeature(comment string) string {
+	if !strings.HasPrefix(strings.ToUpper(comment), "TYPE:") {
+		return ""
+	}
+	return ParseFeature(comment)
+}
+
+// moveFeature returns the feature of a move with the given comment made after
+// a ";TYPE:" comment naming feature typ.
+func moveFeature(comment, typ string) string {
+	if f := ParseFeature(comment); f != "" {
+		return f
+	}
+	if typ != "" {
+		return typ
+	}
+	return FeatureExtrusion
+}
+
+// SVGOptions control the rendering of a layer as SVG.
+type SVGOptions struct {
+	// Extents is the area drawn.  If Extents is empty the area covered by
+	// the layer is drawn.  Using the extents of the whole print gives each
+	// layer the same scale.
+	Extents Extents
+
+	// Travel draws travel moves as dashed lines.
+	Travel bool
+}
+
+// RenderLayerSVG writes an SVG image of the moves in layer, read from the
+// G-code file r.  Extrusion moves are colored by their feature type using
+// FeatureColors.  G-code preceding the layer is executed to determine the
+// state of the printer at the start of the layer.
+func RenderLayerSVG(w io.Writer, r io.Reader, layer Layer, opts *SVGOptions) error {
+	if opts == nil {
+		opts = new(SVGOptions)
+	}
+	paths := make(map[string]*svgPath)
+	var m Machine
+	var typ string
+	end := layer.Offset + layer.Length
+	s := NewScanner(r)
+	for s.Scan() {
+		if s.Offset() >= end {
+			break
+		}
+		c := s.Command()
+		if c.Code == "" {
+			if f := typeFeature(c.Comment); f != "" {
+				typ = f
+			}
+			continue
+		}
+		if s.Offset() < layer.Offset {
+			m.Exec(c, nil)
+			continue
+		}
+		feature := moveFeature(c.Comment, typ)
+		m.Exec(c, func(mv *Move) {
+			if mv.To[X] == mv.From[X] && mv.To[Y] == mv.From[Y] {
+				return
+			}
+			name := feature
+			if !mv.IsExtrusion() {
+				if !opts.Travel {
+					return
+				}
+				name = FeatureTravel
+			}
+			p := paths[name]
+			if p == nil {
+				p = new(svgPath)
+				paths[name] = p
+			}
+			p.add(mv.From, mv.To)
+		})
+	}
+	if s.Err() != nil {
+		return s.Err()
+	}
+
+	ext := opts.Extents
+	if ext.Max[X] <= ext.Min[X] || ext.Max[Y] <= ext.Min[Y] {
+		ext = Extents{
+			Min: [3]float64{math.Inf(1), math.Inf(1)},
+			Max: [3]float64{math.Inf(-1), math.Inf(-1)},
+		}
+		for _, p := range paths {
+			for i := range ext.Min[:2] {
+				ext.Min[i] = math.Min(ext.Min[i], p.min[i])
+				ext.Max[i] = math.Max(ext.Max[i], p.max[i])
+			}
+		}
+		if len(paths) == 0 {
+			ext = Extents{Max: [3]float64{1, 1}}
+		}
+	}
+	margin := 2.0
+	minx, miny := ext.Min[X]-margin, ext.Min[Y]-margin
+	width, height := ext.Max[X]-ext.Min[X]+2*margin, ext.Max[Y]-ext.Min[Y]+2*margin
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="%s %s %s %s" width="%smm" height="%smm">`+"\n",
+		trimFloat(minx), trimFloat(-miny-height), trimFloat(width), trimFloat(height), trimFloat(width), trimFloat(height))
+	fmt.Fprintf(bw, "<title>layer %d z=%g</title>\n", layer.Index, layer.Z)
+	// G-code has y increasing away from the front of the printer.
+	fmt.Fprintf(bw, `<g transform="scale(1,-1)" fill="none" stroke-linecap="round" stroke-linejoin="round">`+"\n")
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		style := `stroke-width="0.4"`
+		if name == FeatureTravel {
+			style = `stroke-width="0.1" stroke-dasharray="0.5,0.5"`
+		}
+		fmt.Fprintf(bw, `<path class="%s" stroke="%s" %s d="%s"/>`+"\n", name, FeatureColors[name], style, paths[name].d.String())
+	}
+	bw.WriteString("</g>\n</svg>\n")
+	return bw.Flush()
+}
+
+// svgPath accumulates the path data for a set of line segments.
+type svgPath struct {
+	d        bytes.Buffer
+	last     [4]float64
+	min, max [2]float64
+	n        int
+}
+
+func (p *svgPath) add(from, to [4]float64) {
+	if p.n == 0 {
+		p.min = [2]float64{from[X], from[Y]}
+		p.max = p.min
+	}
+	if p.n == 0 || from[X] != p.last[X] || from[Y] != p.last[Y] {
+		fmt.Fprintf(&p.d, "M%s %sL", trimFloat(from[X]), trimFloat(from[Y]))
+	} else {
+		p.d.WriteByte(' ')
+	}
+	fmt.Fprintf(&p.d, "%s %s", trimFloat(to[X]), trimFloat(to[Y]))
+	for _, v := range [][4]float64{from, to} {
+		p.min[0] = math.Min(p.min[0], v[X])
+		p.min[1] = math.Min(p.min[1], v[Y])
+		p.max[0] = math.Max(p.max[0], v[X])
+		p.max[1] = math.Max(p.max[1], v[Y])
+	}
+	p.last = to
+	p.n++
+}
+
+// trimFloat formats v with at most three decimal places and no trailing
+// zeros.
+func trimFloat(v float64) string {
+	s := fmt.Sprintf("%.3f", v)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
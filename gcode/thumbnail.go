@@ -0,0 +1,72 @@
+package gcode
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Thumbnail is a preview image of a print.
+type Thumbnail struct {
+	Width  int
+	Height int
+
+	// PNG is the image encoded as a PNG file.
+	PNG []byte
+}
+
+// thumbnailLineLength is the number of base64 characters in each comment
+// line of a thumbnail block.
+const thumbnailLineLength = 78
+
+// EmbedThumbnails inserts thumbnails in G-code as base64 comment blocks, which
+// are displayed by printer firmware and print servers like OctoPrint.
+//
+//	; thumbnail begin 16x16 1324
+//	; iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAA...
+//	; thumbnail end
+//
+// The blocks are written after the first line if it is a comment, as
+// slicers generally begin their output with a comment naming themselves.
+type EmbedThumbnails struct {
+	Thumbnails []Thumbnail
+}
+
+// Process implements the Processor interface.
+func (p *EmbedThumbnails) Process(w io.Writer, r io.ReadSeeker) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriterSize(w, 64<<10)
+	first, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	c := Parse(first)
+	if c.Code == "" && c.Comment != "" {
+		bw.WriteString(withNewline(first))
+		first = ""
+	}
+	for _, t := range p.Thumbnails {
+		writeThumbnail(bw, t)
+	}
+	bw.WriteString(first)
+	_, err = io.Copy(bw, br)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeThumbnail(w *bufio.Writer, t Thumbnail) {
+	data := base64.StdEncoding.EncodeToString(t.PNG)
+	fmt.Fprintf(w, ";\n; thumbnail begin %dx%d %d\n", t.Width, t.Height, len(data))
+	for len(data) > 0 {
+		n := thumbnailLineLength
+		if n > len(data) {
+			n = len(data)
+		}
+		fmt.Fprintf(w, "; %s\n", data[:n])
+		data = data[n:]
+	}
+	w.WriteString("; thumbnail end\n;\n\n")
+}
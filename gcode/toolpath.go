@@ -0,0 +1,100 @@
+package gcode
+
+import (
+	"io"
+	"math"
+)
+
+// Path is a connected sequence of moves of a single feature.  Points holds
+// the x and y coordinates of each point in turn.
+type Path struct {
+	Feature string    `json:"feature"`
+	Points  []float64 `json:"points"`
+}
+
+// LayerPaths holds the paths of the moves in a layer.
+type LayerPaths struct {
+	Index int     `json:"index"`
+	Z     float64 `json:"z"`
+	Paths []Path  `json:"paths"`
+}
+
+// Toolpaths reads the G-code file r, whose layers are given by layers as
+// returned by IndexLayers, and returns the paths of the extrusion moves in
+// each layer.  Travel moves are included as paths of FeatureTravel when
+// travel is true.
+func Toolpaths(r io.Reader, layers []Layer, travel bool) ([]LayerPaths, error) {
+	out := make([]LayerPaths, len(layers))
+	for i, layer := range layers {
+		out[i] = LayerPaths{Index: layer.Index, Z: layer.Z, Paths: []Path{}}
+	}
+	if len(layers) == 0 {
+		return out, nil
+	}
+
+	var m Machine
+	var typ string
+	li := -1
+	end := layers[len(layers)-1].Offset + layers[len(layers)-1].Length
+	s := NewScanner(r)
+	for s.Scan() {
+		if s.Offset() >= end {
+			break
+		}
+		for li+1 < len(layers) && s.Offset() >= layers[li+1].Offset {
+			li++
+		}
+		c := s.Command()
+		if c.Code == "" {
+			if f := typeFeature(c.Comment); f != "" {
+				typ = f
+			}
+			continue
+		}
+		if li < 0 {
+			m.Exec(c, nil)
+			continue
+		}
+		feature := moveFeature(c.Comment, typ)
+		lp := &out[li]
+		m.Exec(c, func(mv *Move) {
+			if mv.To[X] == mv.From[X] && mv.To[Y] == mv.From[Y] {
+				return
+			}
+			name := feature
+			if !mv.IsExtrusion() {
+				if !travel {
+					return
+				}
+				name = FeatureTravel
+			}
+			from := [2]float64{roundCoord(mv.From[X]), roundCoord(mv.From[Y])}
+			to := [2]float64{roundCoord(mv.To[X]), roundCoord(mv.To[Y])}
+			if n := len(lp.Paths); n > 0 {
+				p := &lp.Paths[n-1]
+				k := len(p.Points)
+				if p.Feature == name && p.Points[k-2] == from[0] && p.Points[k-1] == from[1] {
+					p.Points = append(p.Points, to[0], to[1])
+					return
+				}
+			}
+			lp.Paths = append(lp.Paths, Path{
+				Feature: name,
+				Points:  []float64{from[0], from[1], to[0], to[1]},
+			})
+		})
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return out, nil
+}
+
+// roundCoord rounds v to the nearest micron.
+func roundCoord(v float64) float64 {
+	v = math.Floor(v*1000+0.5) / 1000
+	if v == 0 {
+		return 0
+	}
+	return v
+}
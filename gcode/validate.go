@@ -0,0 +1,165 @@
+package gcode
+
+import (
+	"fmt"
+	"io"
+)
+
+// Limits describe the capabilities of a printer which G-code must respect.
+// Zero values are not checked.
+type Limits struct {
+	// BedSize is the size of the build plate in mm.  Moves must stay
+	// between the origin and BedSize.
+	BedSize [2]float64 `json:"bed_size"`
+
+	// MaxZ is the greatest height in mm the print head may reach.
+	MaxZ float64 `json:"max_z"`
+
+	// MaxHotend and MaxBed are the highest temperatures in degrees Celsius
+	// which may be set for the hotend and the bed.
+	MaxHotend float64 `json:"max_hotend"`
+	MaxBed    float64 `json:"max_bed"`
+}
+
+// Checks performed by Validator.
+const (
+	CheckBounds      = "bounds"
+	CheckMaxZ        = "max_z"
+	CheckTemperature = "temperature"
+	CheckHoming      = "homing"
+	CheckUnknown     = "unknown_command"
+)
+
+// Issue is a problem found in G-code.  Each check reports one Issue, at the
+// first line where it failed, and counts the lines which fail it.
+type Issue struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+	Count   int    `json:"count"`
+
+	last int
+}
+
+func (i Issue) String() string {
+	if i.Count > 1 {
+		return fmt.Sprintf("line %d: %s (%d lines)", i.Line, i.Message, i.Count)
+	}
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// KnownCommands lists the standard G-code commands accepted by Validator.
+// Commands which are not a letter followed by a number, such as Klipper
+// macros, are never reported as unknown.
+var KnownCommands = map[string]bool{
+	"G0": true, "G1": true, "G2": true, "G3": true, "G4": true,
+	"G10": true, "G11": true, "G20": true, "G21": true, "G28": true,
+	"G29": true, "G90": true, "G91": true, "G92": true,
+	"M0": true, "M1": true, "M17": true, "M18": true, "M73": true,
+	"M82": true, "M83": true, "M84": true, "M104": true, "M105": true,
+	"M106": true, "M107": true, "M109": true, "M114": true, "M117": true,
+	"M140": true, "M190": true, "M201": true, "M203": true, "M204": true,
+	"M205": true, "M220": true, "M221": true, "M300": true, "M400": true,
+	"M486": true, "M600": true, "M601": true, "M900": true,
+	"T0": true, "T1": true, "T2": true, "T3": true,
+}
+
+// Validate reads G-code from r and checks it against limits.
+func Validate(r io.Reader, limits Limits) ([]Issue, error) {
+	v := NewValidator(limits)
+	s := NewScanner(r)
+	for s.Scan() {
+		v.Exec(s.Command())
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return v.Issues(), nil
+}
+
+// Validator checks G-code as it is executed for moves outside the printer's
+// build volume, unsafe temperatures, moves made before the printer is homed
+// and unknown commands.
+type Validator struct {
+	Limits  Limits
+	Machine Machine
+
+	line   int
+	homed  bool
+	issues []Issue
+	index  map[string]int
+}
+
+// NewValidator returns a Validator checking G-code against limits.
+func NewValidator(limits Limits) *Validator {
+	return &Validator{Limits: limits, index: make(map[string]int)}
+}
+
+// Exec checks c, which is the next line of the G-code.
+func (v *Validator) Exec(c *Command) {
+	v.line++
+	switch {
+	case c.Code == "":
+	case c.Code == "G28":
+		v.homed = true
+	case isStandard(c.Code) && !KnownCommands[c.Code]:
+		v.report(CheckUnknown, "unknown command %s", c.Code)
+	}
+	switch c.Code {
+	case "M104", "M109":
+		v.checkTemperature(c, "hotend", v.Limits.MaxHotend)
+	case "M140", "M190":
+		v.checkTemperature(c, "bed", v.Limits.MaxBed)
+	}
+
+	v.Machine.Exec(c, func(mv *Move) {
+		if !v.homed {
+			v.report(CheckHoming, "move before homing (G28)")
+		}
+		to := mv.To
+		bed := v.Limits.BedSize
+		const eps = 1e-6
+		if bed[0] > 0 && bed[1] > 0 &&
+			(to[X] < -eps || to[Y] < -eps || to[X] > bed[0]+eps || to[Y] > bed[1]+eps) {
+			v.report(CheckBounds, "move to X%g Y%g outside the %gx%g bed", round(to[X], 3), round(to[Y], 3), bed[0], bed[1])
+		}
+		if v.Limits.MaxZ > 0 && to[Z] > v.Limits.MaxZ+eps {
+			v.report(CheckMaxZ, "move to Z%g above the maximum height %g", round(to[Z], 3), v.Limits.MaxZ)
+		}
+	})
+}
+
+func (v *Validator) checkTemperature(c *Command, heater string, max float64) {
+	if max <= 0 {
+		return
+	}
+	for _, letter := range []byte("SR") {
+		if c.Has(letter) && c.Arg(letter) > max {
+			v.report(CheckTemperature, "%s temperature %g above the limit %g", heater, c.Arg(letter), max)
+		}
+	}
+}
+
+// report records a failed check at the current line.
+func (v *Validator) report(check, format string, args ...interface{}) {
+	if i, ok := v.index[check]; ok {
+		if v.issues[i].last != v.line {
+			v.issues[i].Count++
+			v.issues[i].last = v.line
+		}
+		return
+	}
+	v.index[check] = len(v.issues)
+	v.issues = append(v.issues, Issue{
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+		Line:    v.line,
+		Count:   1,
+		last:    v.line,
+	})
+}
+
+// Issues returns the problems found, in the order they were first seen.
+func (v *Validator) Issues() []Issue {
+	return append([]Issue(nil), v.issues...)
+}
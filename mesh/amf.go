@@ -0,0 +1,93 @@
+package mesh
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+type amfVolume struct {
+	Triangles []struct {
+		V1 int `xml:"v1"`
+		V2 int `xml:"v2"`
+		V3 int `xml:"v3"`
+	} `xml:"triangle"`
+}
+
+type amfFile struct {
+	Objects []struct {
+		Mesh struct {
+			Vertices []struct {
+				X float64 `xml:"coordinates>x"`
+				Y float64 `xml:"coordinates>y"`
+				Z float64 `xml:"coordinates>z"`
+			} `xml:"vertices>vertex"`
+			Volumes []amfVolume `xml:"volume"`
+
+			// some programs, like Repetier-Host, write volumes inside
+			// the vertices element.
+			MisplacedVolumes []amfVolume `xml:"vertices>volume"`
+		} `xml:"mesh"`
+	} `xml:"object"`
+}
+
+// ReadAMF reads a mesh in the AMF format, which may be zip compressed.  The
+// meshes of all objects are combined.  Object instances are not placed on the
+// build plate.
+func ReadAMF(r io.ReaderAt, size int64) (*Mesh, error) {
+	magic := make([]byte, 2)
+	_, err := r.ReadAt(magic, 0)
+	if err != nil {
+		return nil, fmt.Errorf("amf: %v", err)
+	}
+	if string(magic) == "PK" {
+		return readZipAMF(r, size)
+	}
+	return readAMF(io.NewSectionReader(r, 0, size))
+}
+
+func readZipAMF(r io.ReaderAt, size int64) (*Mesh, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("amf: %v", err)
+	}
+	if len(z.File) == 0 {
+		return nil, fmt.Errorf("amf: empty archive")
+	}
+	f, err := z.File[0].Open()
+	if err != nil {
+		return nil, fmt.Errorf("amf: %v", err)
+	}
+	defer f.Close()
+	return readAMF(f)
+}
+
+func readAMF(r io.Reader) (*Mesh, error) {
+	var doc amfFile
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("amf: %v", err)
+	}
+	m := new(Mesh)
+	for _, obj := range doc.Objects {
+		verts := obj.Mesh.Vertices
+		volumes := append(obj.Mesh.Volumes, obj.Mesh.MisplacedVolumes...)
+		for _, vol := range volumes {
+			for _, tri := range vol.Triangles {
+				var t Triangle
+				for i, v := range []int{tri.V1, tri.V2, tri.V3} {
+					if v < 0 || v >= len(verts) {
+						return nil, fmt.Errorf("amf: vertex %d out of range", v)
+					}
+					t[i] = Vec{verts[v].X, verts[v].Y, verts[v].Z}
+				}
+				if !t.finite() {
+					return nil, fmt.Errorf("amf: coordinate is not finite")
+				}
+				m.Triangles = append(m.Triangles, t)
+			}
+		}
+	}
+	return m, nil
+}
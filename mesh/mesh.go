@@ -0,0 +1,101 @@
+/*
+Package mesh reads triangle meshes from STL and AMF files and renders them to
+images without the use of a GPU.
+*/
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Vec is a point or direction in three dimensions.
+type Vec [3]float64
+
+func (a Vec) sub(b Vec) Vec {
+	return Vec{a[0] - b[0], a[1] - b[1], a[2] - b[2]}
+}
+
+func (a Vec) cross(b Vec) Vec {
+	return Vec{
+		a[1]*b[2] - a[2]*b[1],
+		a[2]*b[0] - a[0]*b[2],
+		a[0]*b[1] - a[1]*b[0],
+	}
+}
+
+func (a Vec) dot(b Vec) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func (a Vec) normalize() Vec {
+	n := math.Sqrt(a.dot(a))
+	if n == 0 {
+		return a
+	}
+	return Vec{a[0] / n, a[1] / n, a[2] / n}
+}
+
+// finite returns true if no coordinate of a is NaN or infinite.
+func (a Vec) finite() bool {
+	for _, x := range a {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Triangle is a face of a mesh.
+type Triangle [3]Vec
+
+func (t Triangle) finite() bool {
+	return t[0].finite() && t[1].finite() && t[2].finite()
+}
+
+// Mesh is a collection of triangles.
+type Mesh struct {
+	Triangles []Triangle
+}
+
+// Bounds returns the corners of the smallest box containing m.
+func (m *Mesh) Bounds() (min, max Vec) {
+	if len(m.Triangles) == 0 {
+		return min, max
+	}
+	min = m.Triangles[0][0]
+	max = min
+	for _, t := range m.Triangles {
+		for _, v := range t {
+			for i := range v {
+				min[i] = math.Min(min[i], v[i])
+				max[i] = math.Max(max[i], v[i])
+			}
+		}
+	}
+	return min, max
+}
+
+// ReadFile reads the mesh at path.  The format is determined by the file
+// extension, which must be .stl or .amf.
+func ReadFile(path string) (*Mesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".stl":
+		return ReadSTL(f)
+	case ".amf":
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return ReadAMF(f, stat.Size())
+	}
+	return nil, fmt.Errorf("unknown mesh format: %v", filepath.Ext(path))
+}
@@ -0,0 +1,162 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReadFile(t *testing.T) {
+	for _, path := range []string{"../testdata/FirstCube.stl", "../testdata/FirstCube.amf"} {
+		m, err := ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if len(m.Triangles) != 12 {
+			t.Errorf("%s: %d triangles", path, len(m.Triangles))
+		}
+		min, max := m.Bounds()
+		for i := range min {
+			if max[i]-min[i] <= 0 {
+				t.Errorf("%s: empty bounds %v %v", path, min, max)
+			}
+		}
+	}
+}
+
+func TestReadBinarySTL(t *testing.T) {
+	tris := []Triangle{
+		{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		{{0, 0, 1}, {1, 0, 1}, {0, 1, 1.5}},
+	}
+	var buf bytes.Buffer
+	header := make([]byte, 80)
+	copy(header, "solid binary file with a misleading header")
+	buf.Write(header)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(tris)))
+	for _, tri := range tris {
+		var rec [12]float32
+		for j, v := range tri {
+			for k := range v {
+				rec[3+3*j+k] = float32(v[k])
+			}
+		}
+		binary.Write(&buf, binary.LittleEndian, rec)
+		binary.Write(&buf, binary.LittleEndian, uint16(0))
+	}
+	m, err := ReadSTL(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Triangles) != len(tris) {
+		t.Fatalf("%d triangles", len(m.Triangles))
+	}
+	for i := range tris {
+		if m.Triangles[i] != tris[i] {
+			t.Errorf("triangle %d: %v, want %v", i, m.Triangles[i], tris[i])
+		}
+	}
+}
+
+func TestReadSTLInvalid(t *testing.T) {
+	// a header claiming far more triangles than the file holds must not
+	// allocate for them.
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 80))
+	binary.Write(&buf, binary.LittleEndian, uint32(1<<28))
+	_, err := ReadSTL(&buf)
+	if err == nil {
+		t.Errorf("short file read without error")
+	}
+
+	buf.Reset()
+	buf.Write(make([]byte, 80))
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+	rec := [12]float32{0, 0, 1, 0, 0, 0, 1, 0, 0, 0, float32(math.NaN()), 0}
+	binary.Write(&buf, binary.LittleEndian, rec)
+	binary.Write(&buf, binary.LittleEndian, uint16(0))
+	_, err = ReadSTL(&buf)
+	if err == nil {
+		t.Errorf("binary NaN coordinate read without error")
+	}
+
+	ascii := "solid x\nfacet normal 0 0 1\nouter loop\nvertex 0 0 0\nvertex 1 0 0\nvertex 0 Inf 0\nendloop\nendfacet\nendsolid x\n"
+	_, err = ReadSTL(strings.NewReader(ascii))
+	if err == nil {
+		t.Errorf("ascii infinite coordinate read without error")
+	}
+}
+
+func TestWriteSTL(t *testing.T) {
+	m, err := ReadFile("../testdata/FirstCube.amf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = WriteSTL(&buf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 84+50*len(m.Triangles) {
+		t.Fatalf("wrote %d bytes for %d triangles", buf.Len(), len(m.Triangles))
+	}
+	m2, err := ReadSTL(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.Triangles) != len(m.Triangles) {
+		t.Fatalf("%d triangles, want %d", len(m2.Triangles), len(m.Triangles))
+	}
+	for i := range m.Triangles {
+		for j := range m.Triangles[i] {
+			for k := range m.Triangles[i][j] {
+				if float32(m.Triangles[i][j][k]) != float32(m2.Triangles[i][j][k]) {
+					t.Fatalf("triangle %d: %v, want %v", i, m2.Triangles[i], m.Triangles[i])
+				}
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	m, err := ReadFile("../testdata/FirstCube.stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := Render(m, 64, 48, DefaultView())
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 48 {
+		t.Fatalf("bounds %v", img.Bounds())
+	}
+	if c := img.NRGBAAt(32, 24); c.A != 0xff {
+		t.Errorf("center pixel not covered: %v", c)
+	}
+	if c := img.NRGBAAt(0, 0); c.A != 0 {
+		t.Errorf("corner pixel covered: %v", c)
+	}
+
+	// looking down at 45 degrees the top of the cube fills the upper half
+	// of the image and its front the lower half.  the light comes from
+	// above.
+	img = Render(m, 32, 32, View{Elevation: 45, Color: DefaultView().Color})
+	top, front := img.NRGBAAt(16, 8), img.NRGBAAt(16, 24)
+	if top.A != 0xff || front.A != 0xff {
+		t.Fatalf("faces not covered: %v %v", top, front)
+	}
+	if top.R <= front.R {
+		t.Errorf("top %v not lighter than front %v", top, front)
+	}
+}
+
+func TestRenderNonFinite(t *testing.T) {
+	inf := math.Inf(1)
+	m := &Mesh{Triangles: []Triangle{
+		{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		{{math.NaN(), 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		{{-inf, 0, 0}, {inf, 0, 0}, {0, 1, 1}},
+		{{-1e308, 0, 0}, {1e308, 0, 0}, {0, 1e308, 1}},
+	}}
+	Render(m, 16, 16, DefaultView())
+}
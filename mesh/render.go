@@ -0,0 +1,189 @@
+package mesh
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// View describes the direction from which a mesh is rendered.
+type View struct {
+	// Azimuth is the rotation of the mesh about the Z axis in degrees.
+	// Elevation is the angle in degrees between the build plate and the
+	// line of sight; 90 looks straight down.
+	Azimuth   float64
+	Elevation float64
+
+	// Color is the color of surfaces facing the viewer.
+	Color color.NRGBA
+}
+
+// DefaultView looks at the front right of a mesh from above.
+func DefaultView() View {
+	return View{
+		Azimuth:   -30,
+		Elevation: 30,
+		Color:     color.NRGBA{0xed, 0x6b, 0x21, 0xff},
+	}
+}
+
+// samples is the number of samples per pixel in each direction.
+const samples = 2
+
+// Render draws m as seen from view into an image of the given size.  The mesh
+// is scaled to fill the image.  Pixels not covered by the mesh are
+// transparent.
+func Render(m *Mesh, width, height int, view View) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if len(m.Triangles) == 0 || width <= 0 || height <= 0 {
+		return img
+	}
+
+	az := view.Azimuth * math.Pi / 180
+	el := view.Elevation * math.Pi / 180
+	sinAz, cosAz := math.Sincos(az)
+	sinEl, cosEl := math.Sincos(el)
+	project := func(v Vec) Vec {
+		x := v[0]*cosAz - v[1]*sinAz
+		y := v[0]*sinAz + v[1]*cosAz
+		// screen x, screen y (up) and depth toward the viewer.
+		return Vec{x, v[2]*cosEl + y*sinEl, v[2]*sinEl - y*cosEl}
+	}
+
+	// triangles with coordinates which are not finite are skipped.  they
+	// cannot be placed in the image.
+	tris := make([]Triangle, 0, len(m.Triangles))
+	min := Vec{math.Inf(1), math.Inf(1), math.Inf(1)}
+	max := Vec{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for _, t := range m.Triangles {
+		var pt Triangle
+		for j, v := range t {
+			pt[j] = project(v)
+		}
+		if !pt.finite() {
+			continue
+		}
+		for _, p := range pt {
+			for k := range p {
+				min[k] = math.Min(min[k], p[k])
+				max[k] = math.Max(max[k], p[k])
+			}
+		}
+		tris = append(tris, pt)
+	}
+	if len(tris) == 0 {
+		return img
+	}
+
+	// fit the projection inside the image with a small margin.
+	sw, sh := width*samples, height*samples
+	margin := 0.05
+	scale := math.Min(
+		float64(sw)*(1-2*margin)/math.Max(max[0]-min[0], 1e-9),
+		float64(sh)*(1-2*margin)/math.Max(max[1]-min[1], 1e-9))
+	offx := (float64(sw) - (max[0]-min[0])*scale) / 2
+	offy := (float64(sh) - (max[1]-min[1])*scale) / 2
+	toScreen := func(p Vec) Vec {
+		return Vec{
+			offx + (p[0]-min[0])*scale,
+			float64(sh) - offy - (p[1]-min[1])*scale,
+			p[2],
+		}
+	}
+
+	depth := make([]float64, sw*sh)
+	for i := range depth {
+		depth[i] = math.Inf(-1)
+	}
+	shade := make([]float64, sw*sh)
+	light := Vec{-0.4, 0.5, 1}.normalize()
+	for _, t := range tris {
+		n := t[1].sub(t[0]).cross(t[2].sub(t[0])).normalize()
+		if n[2] < 0 {
+			// the back of a face is lit like its front so that meshes
+			// with inconsistent winding render correctly.
+			n = Vec{-n[0], -n[1], -n[2]}
+		}
+		intensity := 0.35 + 0.65*math.Max(0, n.dot(light))
+		rasterize(toScreen(t[0]), toScreen(t[1]), toScreen(t[2]), sw, sh, func(i int, z float64) {
+			if z > depth[i] {
+				depth[i] = z
+				shade[i] = intensity
+			}
+		})
+	}
+
+	// average the samples of each pixel.
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var covered int
+			var total float64
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					i := (y*samples+sy)*sw + x*samples + sx
+					if !math.IsInf(depth[i], -1) {
+						covered++
+						total += shade[i]
+					}
+				}
+			}
+			if covered == 0 {
+				continue
+			}
+			s := total / float64(covered)
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(float64(view.Color.R) * s),
+				G: uint8(float64(view.Color.G) * s),
+				B: uint8(float64(view.Color.B) * s),
+				A: uint8(int(view.Color.A) * covered / (samples * samples)),
+			})
+		}
+	}
+	return img
+}
+
+// rasterize calls plot with the index and interpolated depth of each sample
+// inside the triangle a, b, c.
+func rasterize(a, b, c Vec, w, h int, plot func(i int, z float64)) {
+	if !(Triangle{a, b, c}).finite() {
+		return
+	}
+	area := edge(a, b, c)
+	if area == 0 || math.IsInf(area, 0) {
+		return
+	}
+	x0 := clampInt(math.Floor(math.Min(a[0], math.Min(b[0], c[0]))), 0, w-1)
+	x1 := clampInt(math.Ceil(math.Max(a[0], math.Max(b[0], c[0]))), 0, w-1)
+	y0 := clampInt(math.Floor(math.Min(a[1], math.Min(b[1], c[1]))), 0, h-1)
+	y1 := clampInt(math.Ceil(math.Max(a[1], math.Max(b[1], c[1]))), 0, h-1)
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			p := Vec{float64(x) + 0.5, float64(y) + 0.5}
+			w0 := edge(b, c, p) / area
+			w1 := edge(c, a, p) / area
+			w2 := edge(a, b, p) / area
+			if w0 < 0 || w1 < 0 || w2 < 0 {
+				continue
+			}
+			plot(y*w+x, w0*a[2]+w1*b[2]+w2*c[2])
+		}
+	}
+}
+
+// clampInt converts v to an int in the range [min, max].  v is clamped before
+// conversion because converting a float outside the range of int is
+// undefined.
+func clampInt(v float64, min, max int) int {
+	if v <= float64(min) {
+		return min
+	}
+	if v >= float64(max) {
+		return max
+	}
+	return int(v)
+}
+
+// edge returns twice the signed area of the triangle a, b, p.
+func edge(a, b, p Vec) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
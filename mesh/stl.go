@@ -0,0 +1,153 @@
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ReadSTL reads a mesh in the binary or ASCII STL format.
+func ReadSTL(r io.Reader) (*Mesh, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	header, err := br.Peek(84)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	// binary files may also begin with "solid" so the header is only
+	// trusted when the triangle count does not match a binary file.
+	if bytes.HasPrefix(header, []byte("solid")) && !looksBinary(br, header) {
+		return readASCIISTL(br)
+	}
+	return readBinarySTL(br)
+}
+
+// looksBinary returns true if the header of an STL file which starts with
+// "solid" is followed by binary data.
+func looksBinary(br *bufio.Reader, header []byte) bool {
+	if len(header) < 84 {
+		return false
+	}
+	for _, c := range header[:80] {
+		if c == '\n' {
+			// an ASCII file has a facet on the line following the
+			// solid line.
+			peek, _ := br.Peek(512)
+			i := bytes.IndexByte(peek, '\n')
+			rest := strings.TrimSpace(string(peek[i+1:]))
+			return !strings.HasPrefix(rest, "facet") && !strings.HasPrefix(rest, "endsolid")
+		}
+	}
+	return true
+}
+
+func readBinarySTL(r io.Reader) (*Mesh, error) {
+	var header [84]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("stl header: %v", err)
+	}
+	n := binary.LittleEndian.Uint32(header[80:])
+	if n > 1<<28 {
+		return nil, fmt.Errorf("stl: too many triangles: %d", n)
+	}
+	// the count is not trusted for allocation; a short file fails to read
+	// long before the slice grows large.
+	capacity := n
+	if capacity > 1<<16 {
+		capacity = 1 << 16
+	}
+	m := &Mesh{Triangles: make([]Triangle, 0, capacity)}
+	var rec [50]byte
+	for i := uint32(0); i < n; i++ {
+		_, err := io.ReadFull(r, rec[:])
+		if err != nil {
+			return nil, fmt.Errorf("stl triangle %d: %v", i, err)
+		}
+		var t Triangle
+		for j := range t {
+			for k := range t[j] {
+				bits := binary.LittleEndian.Uint32(rec[12+12*j+4*k:])
+				t[j][k] = float64(math.Float32frombits(bits))
+			}
+		}
+		if !t.finite() {
+			return nil, fmt.Errorf("stl triangle %d: coordinate is not finite", i)
+		}
+		m.Triangles = append(m.Triangles, t)
+	}
+	return m, nil
+}
+
+// WriteSTL writes m in the binary STL format.  Facet normals are computed
+// from the vertices, which are taken to be in counter-clockwise order.
+func WriteSTL(w io.Writer, m *Mesh) error {
+	bw := bufio.NewWriter(w)
+	var header [84]byte
+	copy(header[:], "binary stl written by matching-snuggies")
+	binary.LittleEndian.PutUint32(header[80:], uint32(len(m.Triangles)))
+	bw.Write(header[:])
+	var rec [50]byte
+	for _, t := range m.Triangles {
+		n := t[1].sub(t[0]).cross(t[2].sub(t[0])).normalize()
+		for k := range n {
+			binary.LittleEndian.PutUint32(rec[4*k:], math.Float32bits(float32(n[k])))
+		}
+		for j := range t {
+			for k := range t[j] {
+				binary.LittleEndian.PutUint32(rec[12+12*j+4*k:], math.Float32bits(float32(t[j][k])))
+			}
+		}
+		_, err := bw.Write(rec[:])
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func readASCIISTL(r io.Reader) (*Mesh, error) {
+	m := new(Mesh)
+	var t Triangle
+	nv := 0
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "vertex":
+			if len(fields) != 4 || nv >= 3 {
+				return nil, fmt.Errorf("stl line %d: invalid vertex", line)
+			}
+			for k := 0; k < 3; k++ {
+				v, err := strconv.ParseFloat(fields[k+1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("stl line %d: %v", line, err)
+				}
+				if math.IsNaN(v) || math.IsInf(v, 0) {
+					return nil, fmt.Errorf("stl line %d: coordinate is not finite", line)
+				}
+				t[nv][k] = v
+			}
+			nv++
+		case "endloop":
+			if nv != 3 {
+				return nil, fmt.Errorf("stl line %d: facet has %d vertices", line, nv)
+			}
+			m.Triangles = append(m.Triangles, t)
+			nv = 0
+		}
+	}
+	if s.Err() != nil {
+		return nil, s.Err()
+	}
+	return m, nil
+}
@@ -1,6 +1,11 @@
 package slicerjob
 
-import "code.google.com/p/go-uuid/uuid"
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/gophergala/matching-snuggies/gcode"
+)
 
 type Job struct {
 	ID       string  `json:"id"`
@@ -8,11 +13,60 @@ type Job struct {
 	Progress float64 `json:"progress"`
 	URL      string  `json:"url"`
 	GCodeURL string  `json:"gcode_url"`
+
+	// MeshURL is the location of the job's mesh file.  The G-code and mesh
+	// urls may be signed so that they can be retrieved without an API key
+	// until they expire.
+	MeshURL string `json:"mesh_url,omitempty"`
+
+	// Created is the time the job was created.
+	Created time.Time `json:"created"`
+
+	// Node is the name of the server node which scheduled the job.
+	Node string `json:"node,omitempty"`
+
+	// Owner identifies the API key that created the job.  Only the owner
+	// and admins may access the job.
+	Owner string `json:"owner,omitempty"`
+
+	// Error describes the reason a job has Failed.
+	Error string `json:"error,omitempty"`
+
+	// MeshSHA256 is the hex encoded SHA-256 hash of the job's mesh file.  The
+	// hash can be given when creating other jobs to reuse the mesh.
+	MeshSHA256 string `json:"mesh_sha256,omitempty"`
+
+	Slicer string `json:"slicer,omitempty"`
+	Preset string `json:"preset,omitempty"`
+
+	// PostProcess lists the processors applied to the sliced G-code.
+	PostProcess []string `json:"postprocess,omitempty"`
+
+	// CacheKey identifies the job's output in the server's result cache.
+	// Cached is true if the output was taken from the cache instead of being
+	// sliced for the job.
+	CacheKey string `json:"cache_key,omitempty"`
+	Cached   bool   `json:"cached,omitempty"`
+
+	// Stats summarizes the G-code produced by a completed job.
+	Stats *gcode.Stats `json:"stats,omitempty"`
+
+	// Estimate is the estimated time, in seconds, needed to print the
+	// G-code produced by a completed job.
+	Estimate *gcode.Estimate `json:"estimate,omitempty"`
+
+	// ArcFit reports how much the arc_fit post-processor compressed the
+	// job's G-code.
+	ArcFit *gcode.ArcStats `json:"arc_fit,omitempty"`
+
+	// Warnings lists problems found when the job's G-code was validated
+	// against the printer's limits.
+	Warnings []gcode.Issue `json:"warnings,omitempty"`
 }
 
 type SlicerPreset struct {
-	Slicer  string   `json:slicer`
-	Presets []string `json:presets`
+	Slicer  string   `json:"slicer"`
+	Presets []string `json:"presets"`
 }
 
 // New creates a new Job with a random UUID for an ID.  If urlformat is
@@ -21,5 +75,6 @@ type SlicerPreset struct {
 func New() *Job {
 	job := new(Job)
 	job.ID = uuid.New()
+	job.Created = time.Now()
 	return job
 }
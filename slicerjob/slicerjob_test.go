@@ -8,3 +8,16 @@ func TestSlicerJob(t *testing.T) {
 		t.Fatalf("new job missing ID")
 	}
 }
+
+func TestStatusParse(t *testing.T) {
+	for s := Accepted; s < Invalid; s++ {
+		parsed, err := ParseStatus(s.String())
+		if err != nil {
+			t.Errorf("%v: %v", s, err)
+			continue
+		}
+		if parsed != s {
+			t.Errorf("%v: parsed %v", s, parsed)
+		}
+	}
+}
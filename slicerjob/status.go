@@ -45,6 +45,12 @@ func (s Status) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s.String())
 }
 
+// IsTerminal returns true if s is a state from which a job cannot
+// transition: Complete, Failed or Cancelled.
+func (s Status) IsTerminal() bool {
+	return s == Complete || s == Failed || s == Cancelled
+}
+
 // String returns the string representation of s.
 func (s Status) String() string {
 	return statusStrings[s]
@@ -72,5 +78,6 @@ var statusParse = map[string]Status{
 	statusStrings[Processing]: Processing,
 	statusStrings[Complete]:   Complete,
 	statusStrings[Failed]:     Failed,
+	statusStrings[Cancelled]:  Cancelled,
 	statusStrings[Invalid]:    Invalid,
 }
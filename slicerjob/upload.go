@@ -0,0 +1,32 @@
+package slicerjob
+
+import "code.google.com/p/go-uuid/uuid"
+
+// Upload is a resumable upload session for a mesh file.  Clients PUT chunks of
+// the file to URL, starting at Offset, and create a job from the upload once
+// Offset has reached Size.
+type Upload struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	URL      string `json:"url"`
+
+	// Owner identifies the API key that created the upload.  Only the
+	// owner and admins may append to the upload or create a job from it.
+	Owner string `json:"owner,omitempty"`
+}
+
+// NewUpload creates a new Upload with a random UUID for an ID.
+func NewUpload(filename string, size int64) *Upload {
+	return &Upload{
+		ID:       uuid.New(),
+		Filename: filename,
+		Size:     size,
+	}
+}
+
+// Complete returns true if all bytes of the file have been received.
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Size
+}